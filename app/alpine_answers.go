@@ -0,0 +1,68 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"code.crute.us/mcrute/netboot-server/netboxconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var (
+	alpineAnswersSuccessMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_alpine_answers_success",
+		Help: "Successfully rendered setup-alpine answer files",
+	})
+	alpineAnswersFailureMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_alpine_answers_failure",
+		Help: "Failed setup-alpine answer file host lookups and renderings",
+	})
+)
+
+// AlpineAnswersHandler serves setup-alpine answer files for installing
+// hosts in Netbox to disk at /{mac}/alpine-answers
+type AlpineAnswersHandler struct {
+	Logger      *zap.Logger
+	Coordinator *netboxconfig.ConfigCoordinator
+}
+
+func (h *AlpineAnswersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hw, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		http.Error(w, "invalid MAC address", http.StatusBadRequest)
+		return
+	}
+	mac := hw.String()
+
+	if h.Coordinator == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	cfg, err := h.Coordinator.GetHost(r.Context(), mac)
+	if err != nil {
+		if errors.Is(err, netboxconfig.ErrHostNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		h.Logger.Error("Error looking up host for answer file", zap.String("mac", mac), zap.Error(err))
+		alpineAnswersFailureMetric.Inc()
+		return
+	}
+
+	out, err := netboxconfig.RenderAlpineAnswers(r.Context(), cfg)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		h.Logger.Error("Error rendering answer file", zap.String("mac", mac), zap.Error(err))
+		alpineAnswersFailureMetric.Inc()
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(out)
+	alpineAnswersSuccessMetric.Inc()
+}
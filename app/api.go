@@ -0,0 +1,394 @@
+package app
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"code.crute.us/mcrute/netboot-server/netboxconfig"
+	"go.uber.org/zap"
+)
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type apiDistro struct {
+	Slug             string           `json:"slug"`
+	ShortName        string           `json:"short_name"`
+	Name             string           `json:"name"`
+	Version          string           `json:"version"`
+	Architecture     string           `json:"architecture"`
+	Default          bool             `json:"default"`
+	Hidden           bool             `json:"hidden"`
+	Deprecated       bool             `json:"deprecated"`
+	EOL              string           `json:"eol,omitempty"`
+	Aliases          []string         `json:"aliases"`
+	Path             string           `json:"path"`
+	Kernel           string           `json:"kernel"`
+	Initrd           string           `json:"initrd"`
+	ExtraInitrds     []string         `json:"extra_initrds,omitempty"`
+	Fdt              string           `json:"fdt,omitempty"`
+	FdtDir           string           `json:"fdtdir,omitempty"`
+	InstallConfigs   []string         `json:"install_configs,omitempty"`
+	CommandLine      string           `json:"kernel_command_line"`
+	CommandLineError string           `json:"kernel_command_line_error,omitempty"`
+	FileSizes        map[string]int64 `json:"file_sizes,omitempty"`
+}
+
+type apiDevice struct {
+	Name              string   `json:"name"`
+	Site              string   `json:"site"`
+	Fqdn              string   `json:"fqdn"`
+	PrimaryIP4        string   `json:"primary_ip4,omitempty"`
+	PrimaryIP6        string   `json:"primary_ip6,omitempty"`
+	Interfaces        []string `json:"interfaces"`
+	ConfigContextKeys []string `json:"config_context_keys"`
+}
+
+type apiHost struct {
+	Mac      string                 `json:"mac"`
+	Found    bool                   `json:"found"`
+	Device   *apiDevice             `json:"device,omitempty"`
+	Plugins  []string               `json:"plugins"`
+	Menu     map[string][]apiDistro `json:"menu"`
+	Sessions []BootSession          `json:"sessions"`
+	NextBoot *NextBoot              `json:"next_boot,omitempty"`
+}
+
+type apiNextBoot struct {
+	Mac string `json:"mac"`
+	NextBoot
+}
+
+type apiNextBootRequest struct {
+	Slug       string           `json:"slug"`
+	KernelArgs []KernelArgument `json:"kernel_args"`
+	ExpiresIn  string           `json:"expires_in"`
+}
+
+// ApiHandler serves the JSON API for the distribution catalog, the view
+// of a host's boot configuration and the management of next boot
+// overrides and host tokens.
+type ApiHandler struct {
+	Logger      *zap.Logger
+	Catalog     *DistributionCatalog
+	Coordinator *netboxconfig.ConfigCoordinator
+	Sessions    *SessionTracker
+	Overrides   *NextBootOverrides
+	Tokens      *HostTokens
+}
+
+// RequireToken wraps an API handler so that it requires the bearer
+// token. If the token is empty all requests are refused, which disables
+// the endpoints. The token is also accepted as the password of HTTP
+// basic auth so that browsers can open the dashboard pages.
+func RequireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			writeJsonError(w, http.StatusForbidden, "endpoint disabled, no API token configured")
+			return
+		}
+
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			_, given, ok = r.BasicAuth()
+		}
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Add("WWW-Authenticate", "Bearer")
+			w.Header().Add("WWW-Authenticate", `Basic realm="netboot-server"`)
+			writeJsonError(w, http.StatusUnauthorized, "invalid or missing API token")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hostMac returns the normalized MAC address from the request path
+func hostMac(w http.ResponseWriter, r *http.Request) (string, bool) {
+	hw, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, "invalid MAC address")
+		return "", false
+	}
+	return hw.String(), true
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJsonError(w http.ResponseWriter, status int, msg string) {
+	writeJson(w, status, apiError{msg})
+}
+
+// toApiDistro converts a distribution to its API representation with the
+// kernel command line rendered for the host, which may be nil. File
+// sizes are only included if withSizes is set because it requires
+// reading from the catalog file system.
+func (h *ApiHandler) toApiDistro(d *Distribution, host *HostContext, withSizes bool) apiDistro {
+	out := apiDistro{
+		Slug:         d.Slug(),
+		ShortName:    d.ShortName,
+		Name:         d.Name,
+		Version:      d.FullVersion,
+		Architecture: d.Architecture,
+		Default:      d.Default,
+		Hidden:       d.Hidden,
+		Deprecated:   d.Deprecated,
+		EOL:          d.EOL,
+		Aliases:      d.Aliases,
+		Path:         d.DistroPath(),
+		Kernel:       d.KernelName,
+		Initrd:       d.InitrdName,
+		ExtraInitrds: d.ExtraInitrds,
+		Fdt:          d.FdtName,
+		FdtDir:       d.FdtDir,
+	}
+
+	if len(d.InstallTemplates) > 0 {
+		out.InstallConfigs = d.InstallConfigNames()
+	}
+
+	cmdline, err := d.KernelCommandLine(host)
+	if err != nil {
+		out.CommandLineError = err.Error()
+	} else {
+		out.CommandLine = cmdline
+	}
+
+	if withSizes {
+		out.FileSizes = h.Catalog.FileSizes(d)
+	}
+
+	return out
+}
+
+// ListDistros handles GET /api/v1/distros and supports filtering by the
+// arch and name query parameters, where name is the distribution short
+// name.
+func (h *ApiHandler) ListDistros(w http.ResponseWriter, r *http.Request) {
+	arch := r.URL.Query().Get("arch")
+	name := r.URL.Query().Get("name")
+
+	out := []apiDistro{}
+	for _, d := range h.Catalog.Distros() {
+		if arch != "" && d.Architecture != arch {
+			continue
+		}
+		if name != "" && d.ShortName != name {
+			continue
+		}
+		out = append(out, h.toApiDistro(d, nil, true))
+	}
+
+	writeJson(w, http.StatusOK, out)
+}
+
+// GetDistro handles GET /api/v1/distros/{slug}, the slug may also be a
+// distribution alias.
+func (h *ApiHandler) GetDistro(w http.ResponseWriter, r *http.Request) {
+	d := h.Catalog.Resolve(r.PathValue("slug"))
+	if d == nil {
+		writeJsonError(w, http.StatusNotFound, "distribution not found")
+		return
+	}
+
+	writeJson(w, http.StatusOK, h.toApiDistro(d, nil, true))
+}
+
+// GetHost handles GET /api/v1/hosts/{mac} and shows the Netbox device for
+// the host, the plugins that would run to generate its APKOVL, the boot
+// menu it would be offered and its recent boot sessions.
+func (h *ApiHandler) GetHost(w http.ResponseWriter, r *http.Request) {
+	mac, ok := hostMac(w, r)
+	if !ok {
+		return
+	}
+
+	cfg, err := h.Coordinator.GetHost(r.Context(), mac)
+	if err != nil && !errors.Is(err, netboxconfig.ErrHostNotFound) {
+		h.Logger.Error("Error looking up host in Netbox", zap.String("mac", mac), zap.Error(err))
+		writeJsonError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	host, err := NewHostContext(mac, clientIP(r), cfg)
+	if err != nil {
+		writeJsonError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	out := apiHost{
+		Mac:      mac,
+		Found:    cfg != nil,
+		Plugins:  []string{},
+		Menu:     map[string][]apiDistro{},
+		Sessions: h.Sessions.ForMac(mac),
+	}
+
+	if nb, ok := h.Overrides.Get(mac); ok {
+		out.NextBoot = &nb
+	}
+
+	if cfg != nil {
+		device := &apiDevice{
+			Name:              host.Name,
+			Site:              host.Site,
+			Fqdn:              host.Fqdn,
+			PrimaryIP4:        host.PrimaryIP4,
+			PrimaryIP6:        host.PrimaryIP6,
+			Interfaces:        []string{},
+			ConfigContextKeys: []string{},
+		}
+		for _, iface := range cfg.Interfaces {
+			device.Interfaces = append(device.Interfaces, iface.Name)
+		}
+		for k := range cfg.ConfigContext {
+			device.ConfigContextKeys = append(device.ConfigContextKeys, k)
+		}
+		slices.Sort(device.ConfigContextKeys)
+
+		out.Device = device
+		out.Plugins = h.Coordinator.PluginsForHost(cfg)
+	}
+
+	x86Distros, arm64Distros := menuDistros(h.Catalog.Distros())
+	for arch, distros := range map[string]IpxeDistroList{"x86_64": x86Distros, "aarch64": arm64Distros} {
+		out.Menu[arch] = []apiDistro{}
+		for _, d := range distros {
+			out.Menu[arch] = append(out.Menu[arch], h.toApiDistro(d, host, false))
+		}
+	}
+
+	writeJson(w, http.StatusOK, out)
+}
+
+// GetNextBoot handles GET /api/v1/hosts/{mac}/next-boot
+func (h *ApiHandler) GetNextBoot(w http.ResponseWriter, r *http.Request) {
+	mac, ok := hostMac(w, r)
+	if !ok {
+		return
+	}
+
+	nb, ok := h.Overrides.Get(mac)
+	if !ok {
+		writeJsonError(w, http.StatusNotFound, "no next boot override")
+		return
+	}
+
+	writeJson(w, http.StatusOK, apiNextBoot{mac, nb})
+}
+
+// SetNextBoot handles PUT /api/v1/hosts/{mac}/next-boot which replaces
+// any existing override for the host. The slug may be a distribution
+// alias and is resolved when the host boots. expires_in is a Go
+// duration and defaults to DefaultNextBootExpiry.
+func (h *ApiHandler) SetNextBoot(w http.ResponseWriter, r *http.Request) {
+	mac, ok := hostMac(w, r)
+	if !ok {
+		return
+	}
+
+	var req apiNextBootRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJsonError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+
+	if h.Catalog.Resolve(req.Slug) == nil {
+		writeJsonError(w, http.StatusUnprocessableEntity, "distribution not found")
+		return
+	}
+
+	for _, a := range req.KernelArgs {
+		if a.Key == "" {
+			writeJsonError(w, http.StatusUnprocessableEntity, "kernel arguments require a key")
+			return
+		}
+	}
+
+	expiry := DefaultNextBootExpiry
+	if req.ExpiresIn != "" {
+		var err error
+		if expiry, err = time.ParseDuration(req.ExpiresIn); err != nil || expiry <= 0 {
+			writeJsonError(w, http.StatusUnprocessableEntity, "expires_in must be a positive duration")
+			return
+		}
+	}
+
+	now := time.Now()
+	nb := NextBoot{
+		Slug:       req.Slug,
+		KernelArgs: req.KernelArgs,
+		Created:    now,
+		Expires:    now.Add(expiry),
+	}
+	if err := h.Overrides.Set(mac, nb); err != nil {
+		writeJsonError(w, http.StatusInternalServerError, "override set but not saved: "+err.Error())
+		return
+	}
+
+	h.Logger.Info("Set next boot override",
+		zap.String("mac", mac),
+		zap.String("distro", nb.Slug),
+		zap.Time("expires", nb.Expires),
+	)
+
+	writeJson(w, http.StatusOK, apiNextBoot{mac, nb})
+}
+
+// ClearNextBoot handles DELETE /api/v1/hosts/{mac}/next-boot
+func (h *ApiHandler) ClearNextBoot(w http.ResponseWriter, r *http.Request) {
+	mac, ok := hostMac(w, r)
+	if !ok {
+		return
+	}
+
+	if !h.Overrides.Clear(mac) {
+		writeJsonError(w, http.StatusNotFound, "no next boot override")
+		return
+	}
+
+	h.Logger.Info("Cleared next boot override", zap.String("mac", mac))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ResetToken handles DELETE /api/v1/hosts/{mac}/token which removes the
+// registered host token so that the host registers a new one when it
+// next boots
+func (h *ApiHandler) ResetToken(w http.ResponseWriter, r *http.Request) {
+	mac, ok := hostMac(w, r)
+	if !ok {
+		return
+	}
+
+	found, err := h.Tokens.Reset(mac)
+	if err != nil {
+		h.Logger.Error("Error removing host token", zap.String("mac", mac), zap.Error(err))
+		writeJsonError(w, http.StatusInternalServerError, "error removing host token")
+		return
+	}
+	if !found {
+		writeJsonError(w, http.StatusNotFound, "no host token")
+		return
+	}
+
+	h.Logger.Info("Reset host token", zap.String("mac", mac))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Rescan handles POST /api/v1/catalog/rescan which requests an
+// asynchronous rescan of the distribution catalog
+func (h *ApiHandler) Rescan(w http.ResponseWriter, r *http.Request) {
+	h.Catalog.RequestRescan()
+	writeJson(w, http.StatusAccepted, map[string]string{"status": "rescan requested"})
+}
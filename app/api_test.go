@@ -0,0 +1,46 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    string
+		bearer   string
+		password string
+		want     int
+	}{
+		{name: "no token configured", bearer: "secret", want: http.StatusForbidden},
+		{name: "missing credentials", token: "secret", want: http.StatusUnauthorized},
+		{name: "bearer token", token: "secret", bearer: "secret", want: http.StatusOK},
+		{name: "wrong bearer token", token: "secret", bearer: "wrong", want: http.StatusUnauthorized},
+		{name: "basic auth password", token: "secret", password: "secret", want: http.StatusOK},
+		{name: "wrong basic auth password", token: "secret", password: "wrong", want: http.StatusUnauthorized},
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/ui/hosts/00:11:22:33:44:55", nil)
+			if test.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+test.bearer)
+			}
+			if test.password != "" {
+				r.SetBasicAuth("admin", test.password)
+			}
+
+			w := httptest.NewRecorder()
+			RequireToken(test.token, ok).ServeHTTP(w, r)
+			if w.Code != test.want {
+				t.Errorf("status = %d, want %d", w.Code, test.want)
+			}
+			if w.Code == http.StatusUnauthorized && len(w.Header().Values("WWW-Authenticate")) != 2 {
+				t.Errorf("WWW-Authenticate = %v", w.Header().Values("WWW-Authenticate"))
+			}
+		})
+	}
+}
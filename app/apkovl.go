@@ -35,6 +35,8 @@ var (
 type ApkOvlHandler struct {
 	Logger      *zap.Logger
 	Coordinator *netboxconfig.ConfigCoordinator
+	Sessions    *SessionTracker
+	Writeback   *NetboxWriteback
 }
 
 func (h *ApkOvlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -54,7 +56,7 @@ func (h *ApkOvlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if !macExists {
 		h.Logger.Info("No netbox config for mac", zap.String("mac", mac))
 
-		if err := h.Coordinator.GenerateDefault(ctx, w); err != nil {
+		if err := h.Coordinator.GenerateDefault(ctx, mac, h.Sessions.CurrentDistro(mac), w); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			h.Logger.Error("Error generating default APKOVL", zap.String("mac", mac), zap.Error(err))
 			defaultGenerateErrorMetric.Inc()
@@ -65,12 +67,14 @@ func (h *ApkOvlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.Coordinator.GenerateForMac(ctx, mac, w); err != nil {
+	if err := h.Coordinator.GenerateForMac(ctx, mac, h.Sessions.CurrentDistro(mac), w); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		h.Logger.Error("Error generating APKOVL", zap.String("mac", mac), zap.Error(err))
 		generateErrorMetric.Inc()
+		h.Writeback.BootFailed(mac, "error generating APKOVL: "+err.Error())
 		return
 	}
 
 	apkovlGenerateSuccess.Inc()
+	h.Writeback.BootSucceeded(mac, h.Sessions.CurrentDistro(mac))
 }
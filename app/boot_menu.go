@@ -0,0 +1,280 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"code.crute.us/mcrute/netboot-server/netboxconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var (
+	ipxeHostLookupFailureMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_ipxe_host_lookup_failure",
+		Help: "Failures looking up the Netbox device while rendering IPXE configuration",
+	})
+	kernelArgRenderFailureMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "netboot_kernel_args_render_failure",
+		Help: "Failures rendering a kernel command line for a host",
+	}, []string{"distro"})
+)
+
+var ipxeVarRegexp = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+type IpxeDistroList []*Distribution
+
+func (l IpxeDistroList) Len() int      { return len(l) }
+func (l IpxeDistroList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l IpxeDistroList) Less(i, j int) bool {
+	return l[i].Default
+}
+
+// hostDistribution is a distribution with the kernel command line
+// already rendered for a specific host. This shadows the method on
+// Distribution so that templates can use .KernelCommandLine directly.
+type hostDistribution struct {
+	*Distribution
+	commandLine string
+}
+
+func (d hostDistribution) KernelCommandLine() string {
+	return d.commandLine
+}
+
+// HostMenu is the boot menu for a host. NextBoot is the host's one-time
+// boot override, if any, which is booted instead of showing the menu.
+type HostMenu struct {
+	Host         *HostContext
+	NextBoot     *hostDistribution
+	X86Distros   []hostDistribution
+	ARM64Distros []hostDistribution
+}
+
+// BootMenu builds the boot menu from the distribution catalog. It is
+// shared by the renderers for each boot loader so that every boot loader
+// presents the same menu.
+type BootMenu struct {
+	Logger       *zap.Logger
+	Coordinator  *netboxconfig.ConfigCoordinator
+	Catalog      *DistributionCatalog
+	Overrides    *NextBootOverrides
+	CatalogWatch chan DistroList
+	x86Distros   IpxeDistroList
+	arm64Distros IpxeDistroList
+	sync.RWMutex
+}
+
+func (m *BootMenu) WatchCatalogAsync(ctx context.Context, wg *sync.WaitGroup) {
+	go func() {
+		wg.Add(1)
+		defer wg.Done()
+
+		m.Logger.Info("Starting boot menu catalog watcher")
+
+		for {
+			select {
+			case distros := <-m.CatalogWatch:
+				m.Logger.Info("Boot menu catalog watcher updated")
+				m.updateDistros(distros)
+			case <-ctx.Done():
+				m.Logger.Info("Shutting down boot menu catalog watcher")
+				return
+			}
+		}
+	}()
+}
+
+// menuDistros splits the visible distributions into the per
+// architecture lists shown in boot menus, default distributions first.
+// Raspberry Pi distributions are only booted by the Pi bootloader so
+// they are left out.
+func menuDistros(distros []*Distribution) (x86Distros, arm64Distros IpxeDistroList) {
+	x86Distros, arm64Distros = IpxeDistroList{}, IpxeDistroList{}
+	for _, d := range distros {
+		if d.Hidden || d.RaspberryPi != nil {
+			continue
+		}
+		if d.Architecture == "x86_64" {
+			x86Distros = append(x86Distros, d)
+		} else if d.Architecture == "aarch64" {
+			arm64Distros = append(arm64Distros, d)
+		}
+	}
+	sort.Stable(x86Distros)
+	sort.Stable(arm64Distros)
+	return x86Distros, arm64Distros
+}
+
+func (m *BootMenu) updateDistros(distros []*Distribution) {
+	x86Distros, arm64Distros := menuDistros(distros)
+
+	m.Lock()
+	defer m.Unlock()
+	m.x86Distros = x86Distros
+	m.arm64Distros = arm64Distros
+}
+
+// LookupHost resolves the host context for a MAC address. Netbox
+// lookup failures are logged but do not prevent a boot script from
+// being rendered, the host context will just lack Netbox data. Netbox is
+// not queried without a MAC address, such as for global configurations.
+func (m *BootMenu) LookupHost(ctx context.Context, mac, clientIP string) (*HostContext, error) {
+	var cfg *netboxconfig.RawConfig
+	if m.Coordinator != nil && mac != "" {
+		var err error
+		cfg, err = m.Coordinator.GetHost(ctx, mac)
+		if err != nil {
+			if !errors.Is(err, netboxconfig.ErrHostNotFound) {
+				ipxeHostLookupFailureMetric.Inc()
+				m.Logger.Error("Error looking up host in Netbox", zap.String("mac", mac), zap.Error(err))
+			}
+			cfg = nil
+		}
+	}
+
+	return NewHostContext(mac, clientIP, cfg)
+}
+
+// renderDistros renders the kernel command line of each distribution
+// for the host. Distributions that fail to render are left out of the
+// list so that a host is never offered a boot with missing arguments.
+func (m *BootMenu) renderDistros(distros IpxeDistroList, host *HostContext) []hostDistribution {
+	out := make([]hostDistribution, 0, len(distros))
+	for _, d := range distros {
+		cmdline, err := d.KernelCommandLine(host)
+		if err != nil {
+			kernelArgRenderFailureMetric.WithLabelValues(d.Slug()).Inc()
+			m.Logger.Error("Error rendering kernel command line, omitting distribution",
+				zap.String("mac", host.Mac),
+				zap.String("distro", d.Slug()),
+				zap.Error(err),
+			)
+			continue
+		}
+		out = append(out, hostDistribution{d, cmdline})
+	}
+	return out
+}
+
+// nextBoot returns the distribution for the host's one-time boot
+// override, rendered with the override's extra kernel arguments, or nil
+// if there is no override or it can not be booted. Overrides that can
+// not be booted are logged and the host gets the normal menu.
+func (m *BootMenu) nextBoot(host *HostContext) *hostDistribution {
+	nb, ok := m.Overrides.Get(host.Mac)
+	if !ok || m.Catalog == nil {
+		return nil
+	}
+
+	d := m.Catalog.Resolve(nb.Slug)
+	if d == nil {
+		m.Logger.Error("Next boot override distribution not found",
+			zap.String("mac", host.Mac), zap.String("distro", nb.Slug))
+		return nil
+	}
+
+	overrideHost := *host
+	overrideHost.KernelArgs.Add = append(slices.Clone(host.KernelArgs.Add), nb.KernelArgs...)
+
+	cmdline, err := d.KernelCommandLine(&overrideHost)
+	if err != nil {
+		kernelArgRenderFailureMetric.WithLabelValues(d.Slug()).Inc()
+		m.Logger.Error("Error rendering next boot override kernel command line",
+			zap.String("mac", host.Mac),
+			zap.String("distro", d.Slug()),
+			zap.Error(err),
+		)
+		return nil
+	}
+
+	return &hostDistribution{d, cmdline}
+}
+
+// ForHost builds the boot menu for a host. Hosts without a MAC address,
+// such as those requesting a global boot loader configuration, have no
+// one-time boot override.
+func (m *BootMenu) ForHost(host *HostContext) *HostMenu {
+	m.RLock()
+	defer m.RUnlock()
+
+	menu := &HostMenu{
+		Host:         host,
+		X86Distros:   m.renderDistros(m.x86Distros, host),
+		ARM64Distros: m.renderDistros(m.arm64Distros, host),
+	}
+	if host.Mac != "" {
+		menu.NextBoot = m.nextBoot(host)
+	}
+	return menu
+}
+
+// bootArgs splits a kernel command line rendered for iPXE into arguments
+// for other boot loaders. The initrd= arguments are dropped because other
+// boot loaders load the initrds themselves and the EFI stub would try to
+// load them from the boot device.
+func bootArgs(cmdline string) []string {
+	return slices.DeleteFunc(strings.Fields(cmdline), func(arg string) bool {
+		return strings.HasPrefix(arg, "initrd=")
+	})
+}
+
+// expandIpxeVars replaces references to iPXE variables in a kernel
+// command line for boot loaders that do not have them. The expand
+// function is given the variable name and format and returns false to
+// leave the reference unchanged.
+func expandIpxeVars(cmdline string, expand func(name, format string) (string, bool)) string {
+	return ipxeVarRegexp.ReplaceAllStringFunc(cmdline, func(ref string) string {
+		name, format, _ := strings.Cut(ref[2:len(ref)-1], ":")
+		if value, ok := expand(name, format); ok {
+			return value
+		}
+		return ref
+	})
+}
+
+// staticBootArgs converts a kernel command line rendered for iPXE into
+// one for boot loaders that have no variables, such as PXELINUX. iPXE
+// variables are replaced with the host's values or the default variables
+// from vars, which may be nil, and any other references are left
+// unchanged.
+func staticBootArgs(cmdline string, host *HostContext, arch string, vars *VarsConfig) string {
+	return expandIpxeVars(strings.Join(bootArgs(cmdline), " "), func(name, format string) (string, bool) {
+		switch name {
+		case "mac", "net0/mac", "netX/mac":
+			if host.Mac == "" {
+				return "", false
+			}
+			return formatMac(host.Mac, format), true
+		case "ip", "net0/ip", "netX/ip":
+			return host.ClientIP, host.ClientIP != ""
+		case "buildarch":
+			if arch == "aarch64" {
+				return "arm64", true
+			}
+			return arch, true
+		}
+		if vars == nil {
+			return "", false
+		}
+		value, ok := vars.DefaultVars[name]
+		return value, ok
+	})
+}
+
+// formatMac formats a MAC address as iPXE would for a variable format
+func formatMac(mac, format string) string {
+	switch format {
+	case "hexhyp":
+		return strings.ReplaceAll(mac, ":", "-")
+	case "hexraw":
+		return strings.ReplaceAll(mac, ":", "")
+	}
+	return mac
+}
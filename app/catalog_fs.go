@@ -0,0 +1,427 @@
+package app
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"code.crute.us/mcrute/netboot-server/iso9660"
+	"code.crute.us/mcrute/netboot-server/remotefs"
+	"go.uber.org/zap"
+)
+
+// IsoImageName is the name of an ISO image within a version directory
+// that provides the architecture directories for the version
+const IsoImageName = "install.iso"
+
+// isoImage is an open ISO image. Images are kept open across scans as
+// long as they have not changed so that in-flight downloads continue to
+// work.
+type isoImage struct {
+	fsys    *iso9660.FS
+	closer  io.Closer
+	size    int64
+	modTime time.Time
+	holds   int // Snapshot files within the image, guarded by the catalogFS lock
+}
+
+// isoDistro is the iso_architectures of a distro.yaml, kept so that the
+// file is only parsed again when it changes
+type isoDistro struct {
+	size          int64
+	modTime       time.Time
+	architectures map[string]string
+}
+
+// isoMount presents a directory within an ISO image as a directory in
+// the catalog
+type isoMount struct {
+	image *isoImage
+	root  string // Directory within the image
+}
+
+// catalogFS is the file system seen by the catalog scanner and the file
+// server. It is the distribution tree with ISO images mounted as
+// architecture directories. Mounts are found by refreshMounts which the
+// catalog calls before each scan.
+//
+// Images that are replaced or removed stay open for the grace period,
+// and after that until no snapshot files within them are held, so that
+// snapshots of files within them remain readable.
+type catalogFS struct {
+	base    fs.FS
+	logger  *zap.Logger
+	grace   time.Duration
+	images  map[string]*isoImage    // image path -> image
+	mounts  map[string]isoMount     // architecture directory -> mount
+	virtual map[string][]string     // directory -> virtual children
+	retired map[*isoImage]time.Time // image -> time superseded
+	distros map[string]isoDistro    // distro.yaml path -> parsed config
+	sync.RWMutex
+}
+
+var (
+	_ fs.ReadDirFS = (*catalogFS)(nil)
+	_ fs.StatFS    = (*catalogFS)(nil)
+)
+
+func newCatalogFS(base fs.FS, logger *zap.Logger) *catalogFS {
+	return &catalogFS{
+		base:    base,
+		logger:  logger,
+		images:  map[string]*isoImage{},
+		mounts:  map[string]isoMount{},
+		virtual: map[string][]string{},
+		retired: map[*isoImage]time.Time{},
+		distros: map[string]isoDistro{},
+	}
+}
+
+// openImage opens an ISO image, reusing the open image from a previous
+// scan if the file has not changed
+func (f *catalogFS) openImage(name string, old map[string]*isoImage) (*isoImage, error) {
+	info, err := fs.Stat(f.base, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if img, ok := old[name]; ok && img.size == info.Size() && img.modTime.Equal(info.ModTime()) {
+		return img, nil
+	}
+
+	fd, err := f.base.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	ra, ok := fd.(io.ReaderAt)
+	if !ok {
+		fd.Close()
+		return nil, errors.New("file system does not support random access reads")
+	}
+
+	isoFs, err := iso9660.Open(ra)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	return &isoImage{fsys: isoFs, closer: fd, size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+// refreshMounts finds ISO images in the versions of every distribution
+// and mounts them at the architecture directories listed in the
+// iso_architectures of the distro.yaml. An image is either install.iso
+// in a version directory or <version>.iso in the distribution directory.
+// Failures are reported to softFailure and skip only the affected
+// image.
+func (f *catalogFS) refreshMounts(softFailure func(string)) {
+	f.RLock()
+	old := f.images
+	f.RUnlock()
+
+	images := map[string]*isoImage{}
+	mounts := map[string]isoMount{}
+
+	root, err := fs.ReadDir(f.base, ".")
+	if err != nil {
+		softFailure("mount_root_read_failed")
+		f.logger.Debug("Error reading distribution root for ISO images", zap.Error(err))
+		return
+	}
+
+	distros := map[string]isoDistro{}
+	for _, distroDir := range root {
+		if !distroDir.IsDir() {
+			continue
+		}
+
+		distro, ok := f.isoDistro(path.Join(distroDir.Name(), "distro.yaml"))
+		if !ok {
+			continue // Not a distribution
+		}
+		distros[path.Join(distroDir.Name(), "distro.yaml")] = distro
+		if len(distro.architectures) == 0 {
+			continue // No ISO images
+		}
+
+		entries, err := fs.ReadDir(f.base, distroDir.Name())
+		if err != nil {
+			continue
+		}
+
+		for _, e := range entries {
+			var version, image string
+			if e.IsDir() {
+				version = e.Name()
+				image = path.Join(distroDir.Name(), version, IsoImageName)
+				if _, err := fs.Stat(f.base, image); err != nil {
+					continue
+				}
+			} else if strings.HasSuffix(e.Name(), ".iso") {
+				version = strings.TrimSuffix(e.Name(), ".iso")
+				image = path.Join(distroDir.Name(), e.Name())
+			} else {
+				continue
+			}
+
+			img, err := f.openImage(image, old)
+			if err != nil {
+				softFailure("iso_open_failed")
+				f.logger.Debug("Error opening ISO image", zap.String("path", image), zap.Error(err))
+				continue
+			}
+			images[image] = img
+
+			for arch, isoPath := range distro.architectures {
+				isoPath = path.Clean(strings.TrimPrefix(isoPath, "/"))
+				if info, err := fs.Stat(img.fsys, isoPath); err != nil || !info.IsDir() {
+					softFailure("iso_path_missing")
+					f.logger.Debug("ISO image does not contain architecture path",
+						zap.String("path", image),
+						zap.String("architecture", arch),
+						zap.String("iso_path", isoPath),
+					)
+					continue
+				}
+				mounts[path.Join(distroDir.Name(), version, arch)] = isoMount{img, isoPath}
+			}
+		}
+	}
+
+	virtual := map[string][]string{}
+	for p := range mounts {
+		for dir := p; dir != "."; dir = path.Dir(dir) {
+			parent := path.Dir(dir)
+			if !slices.Contains(virtual[parent], path.Base(dir)) {
+				virtual[parent] = append(virtual[parent], path.Base(dir))
+			}
+		}
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.images, f.mounts, f.virtual, f.distros = images, mounts, virtual, distros
+
+	now := time.Now()
+	for name, img := range old {
+		if images[name] != img {
+			f.retired[img] = now
+		}
+	}
+	f.expireLocked(now)
+}
+
+// isoDistro returns the iso_architectures of a distro.yaml, parsing it
+// only if it has changed since the last scan. Errors are reported by the
+// catalog scan.
+func (f *catalogFS) isoDistro(name string) (isoDistro, bool) {
+	info, err := fs.Stat(f.base, name)
+	if err != nil {
+		return isoDistro{}, false
+	}
+
+	f.RLock()
+	cached, ok := f.distros[name]
+	f.RUnlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached, true
+	}
+
+	distro, err := DistributionFromYaml(f.base, name)
+	if err != nil {
+		return isoDistro{}, false
+	}
+	return isoDistro{info.Size(), info.ModTime(), distro.IsoArchitectures}, true
+}
+
+// expireImages closes the retired images that are past their grace
+// period
+func (f *catalogFS) expireImages(now time.Time) {
+	f.Lock()
+	defer f.Unlock()
+	f.expireLocked(now)
+}
+
+func (f *catalogFS) expireLocked(now time.Time) {
+	for img, retired := range f.retired {
+		if img.holds == 0 && !now.Before(retired.Add(f.grace)) {
+			img.closer.Close()
+			delete(f.retired, img)
+		}
+	}
+}
+
+// mount returns the mount containing a name and the directory at which
+// it is mounted
+func (f *catalogFS) mount(name string) (isoMount, string, bool) {
+	f.RLock()
+	defer f.RUnlock()
+
+	for dir := name; dir != "."; dir = path.Dir(dir) {
+		if m, ok := f.mounts[dir]; ok {
+			return m, dir, true
+		}
+	}
+	return isoMount{}, "", false
+}
+
+// resolve returns the file system and path for a name that is within a
+// mount
+func (f *catalogFS) resolve(name string) (fs.FS, string, bool) {
+	m, dir, ok := f.mount(name)
+	if !ok {
+		return nil, "", false
+	}
+
+	rel := strings.TrimPrefix(strings.TrimPrefix(name, dir), "/")
+	if rel == "" {
+		return m.image.fsys, m.root, true
+	}
+	return m.image.fsys, path.Join(m.root, rel), true
+}
+
+// holdImage keeps an image open until it is released, even if it is
+// retired and past its grace period
+func (f *catalogFS) holdImage(img *isoImage) {
+	f.Lock()
+	defer f.Unlock()
+	img.holds++
+}
+
+// releaseImage releases an image held by holdImage. Retired images are
+// closed by the next expiry once they are no longer held.
+func (f *catalogFS) releaseImage(img *isoImage) {
+	f.Lock()
+	defer f.Unlock()
+	img.holds--
+}
+
+// imageFor returns the image containing a name, if any
+func (f *catalogFS) imageFor(name string) *isoImage {
+	m, _, _ := f.mount(name)
+	return m.image
+}
+
+// redirectURL returns a URL from which a client can fetch a file
+// directly if the distribution tree is remote. Directories and files
+// within ISO images can not be redirected.
+func (f *catalogFS) redirectURL(name string) (string, bool) {
+	r, ok := f.base.(remotefs.Redirector)
+	if !ok || !fs.ValidPath(name) {
+		return "", false
+	}
+
+	if _, _, mounted := f.resolve(name); mounted {
+		return "", false
+	}
+
+	info, err := fs.Stat(f.base, name)
+	if err != nil || info.IsDir() {
+		return "", false
+	}
+
+	u, err := r.URL(name)
+	if err != nil {
+		return "", false
+	}
+	return u, true
+}
+
+func (f *catalogFS) virtualChildren(name string) []string {
+	f.RLock()
+	defer f.RUnlock()
+	return f.virtual[name]
+}
+
+func (f *catalogFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if mfs, rel, ok := f.resolve(name); ok {
+		return mfs.Open(rel)
+	}
+
+	fd, err := f.base.Open(name)
+	if err != nil && errors.Is(err, fs.ErrNotExist) && len(f.virtualChildren(name)) > 0 {
+		return &virtualDir{fs: f, name: name}, nil
+	}
+	return fd, err
+}
+
+func (f *catalogFS) Stat(name string) (fs.FileInfo, error) {
+	fd, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return fd.Stat()
+}
+
+func (f *catalogFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	children := f.virtualChildren(name)
+
+	var entries []fs.DirEntry
+	var err error
+	if mfs, rel, ok := f.resolve(name); ok {
+		entries, err = fs.ReadDir(mfs, rel)
+	} else {
+		entries, err = fs.ReadDir(f.base, name)
+	}
+	if err != nil && !(errors.Is(err, fs.ErrNotExist) && len(children) > 0) {
+		return nil, err
+	}
+
+	for _, c := range children {
+		if !slices.ContainsFunc(entries, func(e fs.DirEntry) bool { return e.Name() == c }) {
+			entries = append(entries, fs.FileInfoToDirEntry(virtualDirInfo(c)))
+		}
+	}
+
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+// virtualDir is a directory that only exists because an ISO image is
+// mounted beneath it, such as the version directory for <version>.iso
+type virtualDir struct {
+	fs   *catalogFS
+	name string
+	done bool
+}
+
+type virtualDirInfo string
+
+func (i virtualDirInfo) Name() string       { return string(i) }
+func (i virtualDirInfo) Size() int64        { return 0 }
+func (i virtualDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (i virtualDirInfo) ModTime() time.Time { return time.Time{} }
+func (i virtualDirInfo) IsDir() bool        { return true }
+func (i virtualDirInfo) Sys() any           { return nil }
+
+func (d *virtualDir) Stat() (fs.FileInfo, error) { return virtualDirInfo(path.Base(d.name)), nil }
+func (d *virtualDir) Close() error               { return nil }
+
+func (d *virtualDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir returns the whole listing on the first call, listings of
+// virtual directories are always small
+func (d *virtualDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.done {
+		if n <= 0 {
+			return nil, nil
+		}
+		return nil, io.EOF
+	}
+	d.done = true
+	return d.fs.ReadDir(d.name)
+}
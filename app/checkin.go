@@ -0,0 +1,73 @@
+package app
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var (
+	checkinMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_checkin_count",
+		Help: "Number of boot-complete check-ins received",
+	})
+	checkinRejectedMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_checkin_rejected",
+		Help: "Number of check-ins rejected for an invalid host token",
+	})
+)
+
+// CheckinHandler receives boot-complete reports from hosts. The report
+// is sent by a script that is added to every generated APKOVL and runs
+// once the host reaches the default runlevel. Check-ins are
+// authenticated with the host's token because they update Netbox.
+type CheckinHandler struct {
+	Logger    *zap.Logger
+	Sessions  *SessionTracker
+	Tokens    *HostTokens
+	Writeback *NetboxWriteback
+}
+
+func (h *CheckinHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mac := r.PathValue("mac")
+	if _, err := net.ParseMAC(mac); err != nil {
+		http.Error(w, "invalid MAC address", http.StatusBadRequest)
+		return
+	}
+
+	if !h.Tokens.Authenticate(mac, r) {
+		checkinRejectedMetric.Inc()
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid check-in", http.StatusBadRequest)
+		return
+	}
+
+	c := h.Sessions.CheckIn(mac, CheckIn{
+		Time:      time.Now(),
+		Distro:    r.PostForm.Get("distro"),
+		Kernel:    r.PostForm.Get("kernel"),
+		OSRelease: r.PostForm.Get("os_release"),
+		Uptime:    r.PostForm.Get("uptime"),
+	})
+
+	checkinMetric.Inc()
+	h.Logger.Info("Host checked in after boot",
+		zap.String("mac", mac),
+		zap.String("distro", c.Distro),
+		zap.String("kernel", c.Kernel),
+		zap.String("os_release", c.OSRelease),
+		zap.String("uptime", c.Uptime),
+	)
+
+	h.Writeback.BootSucceeded(mac, c.Distro)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,83 @@
+package app
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+
+	"code.crute.us/mcrute/netboot-server/netboxconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var (
+	cloudInitSuccessMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "netboot_cloud_init_success",
+		Help: "Successfully rendered cloud-init datasource files",
+	}, []string{"file"})
+	cloudInitFailureMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "netboot_cloud_init_failure",
+		Help: "Failed cloud-init host lookups and renderings",
+	}, []string{"file"})
+)
+
+// CloudInitHandler serves a cloud-init NoCloud datasource for each host
+// in Netbox at /{mac}/cloud-init/. Hosts that are not in Netbox get a not
+// found error since there is nothing host specific to configure.
+type CloudInitHandler struct {
+	Logger      *zap.Logger
+	Coordinator *netboxconfig.ConfigCoordinator
+}
+
+func (h *CloudInitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	file := r.PathValue("file")
+	switch file {
+	case netboxconfig.CloudInitMetaData, netboxconfig.CloudInitUserData,
+		netboxconfig.CloudInitNetworkConfig, netboxconfig.CloudInitVendorData:
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	hw, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		http.Error(w, "invalid MAC address", http.StatusBadRequest)
+		return
+	}
+	mac := hw.String()
+
+	if h.Coordinator == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	cfg, err := h.Coordinator.GetHost(r.Context(), mac)
+	if err != nil {
+		if errors.Is(err, netboxconfig.ErrHostNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		h.Logger.Error("Error looking up host for cloud-init", zap.String("mac", mac), zap.Error(err))
+		cloudInitFailureMetric.WithLabelValues(file).Inc()
+		return
+	}
+
+	out, err := netboxconfig.RenderCloudInit(cfg, file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		h.Logger.Error("Error rendering cloud-init file", zap.String("mac", mac), zap.String("file", file), zap.Error(err))
+		cloudInitFailureMetric.WithLabelValues(file).Inc()
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(out)
+	cloudInitSuccessMetric.WithLabelValues(file).Inc()
+}
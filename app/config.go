@@ -12,7 +12,12 @@ var (
 	defaultNetboxConfigId  string
 )
 
+// mustAtoi parses a default set at build time. An unset default is zero
+// so that the package can be built and tested without linker flags.
 func mustAtoi(s string) int {
+	if s == "" {
+		return 0
+	}
 	o, err := strconv.Atoi(s)
 	if err != nil {
 		panic(err)
@@ -25,12 +30,24 @@ type Config struct {
 	BindHttp              string `flag:"bind-http" flag-help:"Address and port to bind http server"`
 	BindTftp              string `flag:"bind-tftp" flag-help:"Address and port to bind tftp server"`
 	NetboxHost            string `flag:"netbox-host" flag-help:"Full URL to Netbox"`
-	DistroFilesPath       string `flag:"distro-files" flag-help:"Path to distribution file tree"`
+	DistroFilesPath       string `flag:"distro-files" flag-help:"Path or s3:// or http(s):// URL of distribution file tree"`
+	DistroFilesMode       string `flag:"distro-files-mode" flag-help:"How files in a remote distribution tree are served, proxy or redirect"`
+	DistroCacheDir        string `flag:"distro-cache-dir" flag-help:"Directory for caching files proxied from a remote distribution tree, no caching if empty"`
+	DistroCacheSize       int    `flag:"distro-cache-size" flag-help:"Maximum size in MiB of the remote distribution file cache"`
+	SnapshotGrace         int    `flag:"snapshot-grace" flag-help:"Minutes that removed or replaced distribution files continue to be served, 0 disables snapshots"`
+	TftpDir               string `flag:"tftp-dir" flag-help:"Directory of extra files served over TFTP, such as signed shim and GRUB binaries"`
 	NtpServer             string `flag:"ntp-server" flag-help:"Address of NTP server"`
 	HttpServer            string `flag:"http-server" flag-help:"HTTP/S URL to this server"`
 	VarsConfigFile        string `flag:"vars-config" flag-help:"Path to variables config file, within distro-files"`
 	VaultNetboxPath       string `flag:"vault-netbox-path" flag-help:"Path in Vault KV store for Netbox credential"`
 	NetboxDefaultConfigId int    `flag:"default-config-id" flag-help:"ID for default config context"`
+	NetboxWriteback       bool   `flag:"netbox-writeback" flag-help:"Write boot results to Netbox device custom fields"`
+	NetboxJournalFailures bool   `flag:"netbox-journal-failures" flag-help:"Add Netbox journal entries for boot failures, requires netbox-writeback"`
+	ApiToken              string `flag:"api-token" flag-help:"Bearer token for API endpoints that change state or return host details, disabled if empty"`
+	StateDir              string `flag:"state-dir" flag-help:"Directory for persistent runtime state, state is kept in memory only if empty"`
+	ApkovlCacheSize       int    `flag:"apkovl-cache-size" flag-help:"Maximum size in MiB of the generated APKOVL cache, 0 disables the cache"`
+	SyncInterval          int    `flag:"sync-interval" flag-help:"Hours between syncs of upstream releases into distro-files, 0 disables syncing"`
+	InsecureSkipSignature bool   `flag:"insecure-skip-signature" flag-help:"Sync releases of distributions without a keyring without verifying signatures"`
 }
 
 var DefaultConfig = &Config{
@@ -39,9 +56,21 @@ var DefaultConfig = &Config{
 	BindTftp:              ":69",
 	NetboxHost:            defaultNetboxHost,
 	DistroFilesPath:       "/netboot",
+	DistroFilesMode:       "proxy",
+	DistroCacheDir:        "",
+	DistroCacheSize:       10240,
+	SnapshotGrace:         60,
+	TftpDir:               "",
 	NtpServer:             "0.pool.ntp.org",
 	HttpServer:            defaultHttpServer,
 	VarsConfigFile:        "vars.yaml",
 	VaultNetboxPath:       defaultVaultNetboxPath,
 	NetboxDefaultConfigId: mustAtoi(defaultNetboxConfigId),
+	NetboxWriteback:       false,
+	NetboxJournalFailures: false,
+	ApiToken:              "",
+	StateDir:              "",
+	ApkovlCacheSize:       64,
+	SyncInterval:          0,
+	InsecureSkipSignature: false,
 }
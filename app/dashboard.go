@@ -0,0 +1,181 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"code.crute.us/mcrute/netboot-server/netboxconfig"
+	"go.uber.org/zap"
+)
+
+const netboxPingTimeout = 2 * time.Second
+
+// DashboardHandler serves the operational HTML dashboard. The templates
+// and static assets are loaded from Files, which is embedded in the
+// binary, so the dashboard works on networks without internet access.
+type DashboardHandler struct {
+	Logger      *zap.Logger
+	Catalog     *DistributionCatalog
+	Coordinator *netboxconfig.ConfigCoordinator
+	Renderer    *IpxeRendererHandler
+	Sessions    *SessionTracker
+	Files       fs.FS
+	index       *template.Template
+	host        *template.Template
+}
+
+var dashboardFuncs = template.FuncMap{
+	"since": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return time.Since(t).Truncate(time.Second).String() + " ago"
+	},
+	"timestamp": func(t time.Time) string {
+		return t.Format(time.RFC3339)
+	},
+	"offset": func(start, t time.Time) string {
+		return "+" + t.Sub(start).Truncate(time.Millisecond).String()
+	},
+}
+
+func (h *DashboardHandler) ParseTemplates() (err error) {
+	parse := func(page string) (*template.Template, error) {
+		return template.New(page).Funcs(dashboardFuncs).ParseFS(h.Files, "templates/layout.html", "templates/"+page)
+	}
+
+	if h.index, err = parse("index.html"); err != nil {
+		return err
+	}
+	if h.host, err = parse("host.html"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Static serves the static assets for the dashboard
+func (h *DashboardHandler) Static() http.Handler {
+	return http.StripPrefix("/ui/", http.FileServerFS(h.Files))
+}
+
+type dashboardArch struct {
+	Name    string
+	Distros DistroList
+}
+
+func (h *DashboardHandler) netboxStatus(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, netboxPingTimeout)
+	defer cancel()
+	return h.Coordinator.Ping(ctx)
+}
+
+func (h *DashboardHandler) execute(w http.ResponseWriter, t *template.Template, data map[string]any) {
+	buf := &bytes.Buffer{}
+	if err := t.ExecuteTemplate(buf, "layout", data); err != nil {
+		h.Logger.Error("Error rendering dashboard template", zap.String("template", t.Name()), zap.Error(err))
+		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+func (h *DashboardHandler) Index(w http.ResponseWriter, r *http.Request) {
+	byArch := map[string]DistroList{}
+	for _, d := range h.Catalog.Distros() {
+		byArch[d.Architecture] = append(byArch[d.Architecture], d)
+	}
+
+	archNames := make([]string, 0, len(byArch))
+	for name := range byArch {
+		archNames = append(archNames, name)
+	}
+	slices.Sort(archNames)
+
+	arches := make([]dashboardArch, 0, len(archNames))
+	for _, name := range archNames {
+		arches = append(arches, dashboardArch{name, byArch[name]})
+	}
+
+	h.execute(w, h.index, map[string]any{
+		"Title":       "Netboot Server",
+		"Arches":      arches,
+		"Scan":        h.Catalog.LastScan(),
+		"NetboxError": h.netboxStatus(r.Context()),
+		"Sessions":    h.Sessions.Latest(),
+	})
+}
+
+func (h *DashboardHandler) overlayFiles(ctx context.Context, mac string) ([]netboxconfig.APKOVLEntry, error) {
+	exists, err := h.Coordinator.MacExists(ctx, mac)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	distro := h.Sessions.CurrentDistro(mac)
+	if exists {
+		err = h.Coordinator.GenerateForMac(ctx, mac, distro, buf)
+	} else {
+		err = h.Coordinator.GenerateDefault(ctx, mac, distro, buf)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return netboxconfig.ListAPKOVL(buf)
+}
+
+func (h *DashboardHandler) Host(w http.ResponseWriter, r *http.Request) {
+	mac := r.PathValue("mac")
+	data := map[string]any{
+		"Title":    "Host " + mac,
+		"Mac":      mac,
+		"Sessions": h.Sessions.ForMac(mac),
+	}
+
+	if c, ok := h.Sessions.LastCheckIn(mac); ok {
+		data["CheckIn"] = c
+	}
+	data["OverlaysSinceCheckIn"], data["BootLoop"] = h.Sessions.OverlaysSinceCheckIn(mac)
+
+	host, err := h.Renderer.LookupHost(r.Context(), mac, "")
+	if err != nil {
+		data["ScriptError"] = err
+	} else {
+		data["Host"] = host
+
+		script := &bytes.Buffer{}
+		if _, err := h.Renderer.Render(script, host); err != nil {
+			data["ScriptError"] = err
+		} else {
+			data["Script"] = script.String()
+		}
+	}
+
+	files, err := h.overlayFiles(r.Context(), mac)
+	if err != nil {
+		data["OverlayError"] = err
+	} else {
+		data["OverlayFiles"] = files
+	}
+
+	h.execute(w, h.host, data)
+}
+
+// HostSearch redirects the host search form to the host page
+func (h *DashboardHandler) HostSearch(w http.ResponseWriter, r *http.Request) {
+	mac := r.URL.Query().Get("mac")
+	if mac == "" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/ui/hosts/"+url.PathEscape(mac), http.StatusSeeOther)
+}
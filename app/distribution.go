@@ -1,13 +1,18 @@
 package app
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
 	"io/fs"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
+	"text/template"
+	"time"
 
 	mapset "github.com/deckarep/golang-set/v2"
-	"golang.org/x/mod/semver"
 	"gopkg.in/yaml.v2"
 )
 
@@ -16,22 +21,168 @@ type DistroList []*Distribution
 func (l DistroList) Len() int      { return len(l) }
 func (l DistroList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
 func (l DistroList) Less(i, j int) bool {
-	if cmp := semver.Compare(l[i].FullVersion, l[j].FullVersion); cmp != 0 {
-		return cmp < 0
+	return compareVersions(l[i].FullVersion, l[j].FullVersion) < 0
+}
+
+// compareVersions compares version strings such as 3.20.1, 22.04 or
+// 3.21.0_rc10. Versions are split into runs of digits and of letters,
+// separators only end a run, so 3.21.0_rc10, 3.21.0-rc10 and 3.21.0rc10
+// are ordered the same. Digit runs are compared as numbers so that 3.20
+// is newer than 3.9 and rc10 is newer than rc2, letter runs are compared
+// as strings. A letter run after the first marks a pre-release so it is
+// older than a digit run or the end of the version (3.20.0-rc1 before
+// 3.20.0).
+func compareVersions(a, b string) int {
+	as, bs := versionParts(a), versionParts(b)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		aNum, bNum := isVersionNumber(as[i]), isVersionNumber(bs[i])
+		switch {
+		case aNum && bNum:
+			if c := compareVersionNumbers(as[i], bs[i]); c != 0 {
+				return c
+			}
+		case aNum != bNum && i > 0:
+			if aNum {
+				return 1
+			}
+			return -1
+		default:
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	// A longer version is newer (3.20.1 after 3.20) unless the extra
+	// part is a pre-release (3.20.0-rc1 before 3.20.0)
+	if len(as) != len(bs) {
+		longer, sign := bs, -1
+		if len(as) > len(bs) {
+			longer, sign = as, 1
+		}
+		if !isVersionNumber(longer[min(len(as), len(bs))]) {
+			return -sign
+		}
+		return sign
+	}
+	return strings.Compare(a, b)
+}
+
+// versionParts splits a version into runs of digits and of letters,
+// dropping everything else
+func versionParts(v string) []string {
+	parts := []string{}
+	start := -1
+	for i, r := range v {
+		if start >= 0 && (!isVersionChar(r) || isDigit(r) != isDigit(rune(v[start]))) {
+			parts = append(parts, v[start:i])
+			start = -1
+		}
+		if start < 0 && isVersionChar(r) {
+			start = i
+		}
+	}
+	if start >= 0 {
+		parts = append(parts, v[start:])
 	}
-	return l[i].FullVersion < l[j].FullVersion
+	return parts
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+func isVersionChar(r rune) bool {
+	return isDigit(r) || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+func isVersionNumber(part string) bool {
+	return isDigit(rune(part[0]))
+}
+
+// compareVersionNumbers compares runs of digits as numbers of any length
+func compareVersionNumbers(a, b string) int {
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		return cmp.Compare(len(a), len(b))
+	}
+	return strings.Compare(a, b)
 }
 
 type Distribution struct {
-	ShortName    string
-	Name         string `yaml:"name"`
-	Default      bool   `yaml:"default"`
-	FullVersion  string
-	Architecture string
-	KernelName   string           `yaml:"kernel"`
-	InitrdName   string           `yaml:"initrd"`
-	KernelParams []KernelArgument `yaml:"kernel_args"`
-	Files        map[string]any
+	ShortName      string
+	Name           string `yaml:"name"`
+	Default        bool   `yaml:"default"`
+	FullVersion    string
+	Architecture   string
+	KernelName     string           `yaml:"kernel"`
+	InitrdName     string           `yaml:"initrd"`
+	ExtraInitrds   []string         `yaml:"extra_initrds"`
+	FdtName        string           `yaml:"fdt"`
+	FdtDir         string           `yaml:"fdtdir"`
+	KernelParams   []KernelArgument `yaml:"kernel_args"`
+	Hidden         bool             `yaml:"hidden"`
+	Deprecated     bool             `yaml:"deprecated"`
+	EOL            string           `yaml:"eol"`
+	RetainVersions int              `yaml:"retain_versions"`
+	Aliases        []string
+	// IsoArchitectures maps architecture names to directories within ISO
+	// images in the version directories. See catalogFS.
+	IsoArchitectures map[string]string `yaml:"iso_architectures"`
+	// RaspberryPi marks the distribution as booted by the Raspberry Pi
+	// bootloader. See RaspberryPiHandler.
+	RaspberryPi *RaspberryPiConfig `yaml:"raspberry_pi"`
+	// InstallTemplates are the kickstart and preseed templates next to
+	// distro.yaml. See InstallConfigHandler.
+	InstallTemplates map[string]*template.Template `yaml:"-"`
+	Files            map[string]any
+}
+
+// RaspberryPiConfig configures a distribution for Raspberry Pi network
+// boot
+type RaspberryPiConfig struct {
+	Config []string `yaml:"config"` // Lines added to config.txt
+}
+
+// versionMetadata is loaded from an optional version.yaml file in a
+// version directory and overrides the lifecycle settings from
+// distro.yaml for that version only.
+type versionMetadata struct {
+	Hidden     *bool   `yaml:"hidden"`
+	Deprecated *bool   `yaml:"deprecated"`
+	EOL        *string `yaml:"eol"`
+}
+
+func versionMetadataFromYaml(f fs.FS, path string) (*versionMetadata, error) {
+	fd, err := f.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer fd.Close()
+
+	m := &versionMetadata{}
+	if err := yaml.NewDecoder(fd).Decode(&m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *versionMetadata) apply(d *Distribution) {
+	if m == nil {
+		return
+	}
+	if m.Hidden != nil {
+		d.Hidden = *m.Hidden
+	}
+	if m.Deprecated != nil {
+		d.Deprecated = *m.Deprecated
+	}
+	if m.EOL != nil {
+		d.EOL = *m.EOL
+	}
 }
 
 func DistributionFromYaml(f fs.FS, path string) (*Distribution, error) {
@@ -53,6 +204,12 @@ func (d Distribution) DistroPath() string {
 	return filepath.Join("/distros", d.ShortName, d.FullVersion, d.Architecture)
 }
 
+// FilesPath is the path to the distribution files relative to the root
+// of the distribution catalog
+func (d Distribution) FilesPath() string {
+	return path.Join(d.ShortName, d.FullVersion, d.Architecture)
+}
+
 func (d Distribution) Slug() string {
 	return strings.Join([]string{
 		d.ShortName,
@@ -61,6 +218,39 @@ func (d Distribution) Slug() string {
 	}, "-")
 }
 
+// LatestAlias is the stable slug that always resolves to the newest
+// visible version of the distribution for an architecture.
+func (d Distribution) LatestAlias() string {
+	return strings.Join([]string{
+		d.ShortName,
+		"latest",
+		d.Architecture,
+	}, "-")
+}
+
+// DisplayName is the name of the distribution as shown in boot menus
+func (d Distribution) DisplayName() string {
+	name := fmt.Sprintf("%s %s (%s)", d.Name, d.FullVersion, d.Architecture)
+	if d.Deprecated {
+		name += " [deprecated]"
+	}
+	return name
+}
+
+// IsEOL returns true if the distribution has an end of life date and
+// that date has passed. Invalid dates are treated as not EOL and are
+// reported as an error.
+func (d Distribution) IsEOL(now time.Time) (bool, error) {
+	if d.EOL == "" {
+		return false, nil
+	}
+	eol, err := time.Parse(time.DateOnly, d.EOL)
+	if err != nil {
+		return false, err
+	}
+	return !now.Before(eol), nil
+}
+
 func (d Distribution) BaseVersion() string {
 	parts := strings.Split(d.FullVersion, ".")
 	if len(parts) > 2 {
@@ -69,25 +259,85 @@ func (d Distribution) BaseVersion() string {
 	return d.FullVersion
 }
 
-func (d Distribution) KernelCommandLine() string {
-	out := []string{
-		// Should always be first
-		fmt.Sprintf("initrd=%s", d.InitrdName),
+// Initrds returns the names of the initrds in the order they are loaded,
+// which is the extra initrds followed by the main initrd
+func (d Distribution) Initrds() []string {
+	return append(slices.Clone(d.ExtraInitrds), d.InitrdName)
+}
+
+// BootFiles returns the names of the files that must exist for the
+// distribution to boot
+func (d Distribution) BootFiles() []string {
+	files := append([]string{d.KernelName}, d.Initrds()...)
+	if d.FdtName != "" {
+		files = append(files, d.FdtName)
+	}
+	return files
+}
+
+// KernelArguments returns the kernel arguments for the distribution
+// after applying the additions and removals configured for the host.
+// Host additions replace distribution arguments with the same key.
+func (d Distribution) KernelArguments(host *HostContext) []KernelArgument {
+	if host == nil {
+		return d.KernelParams
+	}
+
+	removed := mapset.NewSet(host.KernelArgs.Remove...)
+	added := map[string]KernelArgument{}
+	for _, a := range host.KernelArgs.Add {
+		added[a.Key] = a
 	}
 
+	out := []KernelArgument{}
 	for _, a := range d.KernelParams {
-		// Skip any arguments that fail to render
-		if arg, err := a.Render(&d); err == nil {
-			out = append(out, arg)
+		if removed.Contains(a.Key) {
+			continue
+		}
+		if replacement, ok := added[a.Key]; ok {
+			out = append(out, replacement)
+			delete(added, a.Key)
+			continue
+		}
+		out = append(out, a)
+	}
+
+	// Preserve the order of the host configuration for new arguments
+	for _, a := range host.KernelArgs.Add {
+		if _, ok := added[a.Key]; ok && !removed.Contains(a.Key) {
+			out = append(out, a)
+		}
+	}
+
+	return out
+}
+
+// KernelCommandLine renders the full kernel command line for booting
+// the distribution on a host. The host may be nil if there is no
+// request context. Any argument that fails to render fails the entire
+// command line.
+func (d Distribution) KernelCommandLine(host *HostContext) (string, error) {
+	// Should always be first. iPXE names images by the base name of their
+	// URL so nested initrds are referenced by base name.
+	out := []string{}
+	for _, initrd := range d.Initrds() {
+		out = append(out, fmt.Sprintf("initrd=%s", path.Base(initrd)))
+	}
+
+	for _, a := range d.KernelArguments(host) {
+		arg, err := a.Render(&d, host)
+		if err != nil {
+			return "", err
 		}
+		out = append(out, arg)
 	}
 
 	// Should always be last
 	out = append(out, "console=ttyS0,115200n8")
 
-	return strings.Join(out, " ")
+	return strings.Join(out, " "), nil
 }
 
 func (d Distribution) FilesContainDistro(files mapset.Set[string]) bool {
-	return files.Contains(d.KernelName) && files.Contains(d.InitrdName)
+	return files.Contains(d.BootFiles()...)
 }
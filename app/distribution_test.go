@@ -0,0 +1,41 @@
+package app
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"3.20", "3.20", 0},
+		{"3.9", "3.20", -1},
+		{"3.20.1", "3.20", 1},
+		{"22.04", "24.04", -1},
+		{"3.20.0-rc1", "3.20.0", -1},
+		{"3.20.0_rc1", "3.20.0", -1},
+		{"3.20.0rc1", "3.20.0", -1},
+		{"3.20.0-rc2", "3.20.0-rc10", -1},
+		{"3.20.0_rc2", "3.20.0-rc10", -1},
+		{"3.20.0rc2", "3.20.0_rc10", -1},
+		{"3.20.0_alpha", "3.20.0-rc1", -1},
+		{"3.20.0-alpha", "3.20.0_rc1", -1},
+		{"3.20.0_alpha2", "3.20.0_beta1", -1},
+		{"3.20.0-rc1", "3.19.4", 1},
+		{"3.20.0-rc1", "3.20.1", -1},
+		{"3.20.0-rc1", "3.20.0.1", -1},
+		{"010", "9", 1},
+		{"18446744073709551616", "18446744073709551615", 1},
+		{"edge", "3.20", 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.a+"_"+test.b, func(t *testing.T) {
+			if got := compareVersions(test.a, test.b); got != test.want {
+				t.Errorf("compareVersions(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+			}
+			if got := compareVersions(test.b, test.a); got != -test.want {
+				t.Errorf("compareVersions(%q, %q) = %d, want %d", test.b, test.a, got, -test.want)
+			}
+		})
+	}
+}
@@ -6,12 +6,16 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"code.crute.us/mcrute/netboot-server/remotefs"
 	mapset "github.com/deckarep/golang-set/v2"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -27,6 +31,10 @@ var (
 		Name: "netboot_scan_timer_count",
 		Help: "Number of rescan events triggered by the timer",
 	})
+	scanRequestMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_scan_request_count",
+		Help: "Number of rescan events requested by the API or sync job",
+	})
 	scanCountMetric = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "netboot_scan_count",
 		Help: "Number of rescan events",
@@ -45,24 +53,52 @@ var (
 	})
 )
 
+// ScanStatus describes the result of the most recent catalog scan
+type ScanStatus struct {
+	Time         time.Time
+	Duration     time.Duration
+	DistroCount  int
+	SoftFailures map[string]int
+	Error        error
+}
+
 type DistributionCatalog struct {
-	files       fs.FS
-	logger      *zap.Logger
-	distros     DistroList
-	watchers    []chan<- DistroList
-	watchErrors chan<- error
-	httpHandler http.Handler
+	files        *catalogFS
+	snapshot     *catalogSnapshot
+	logger       *zap.Logger
+	distros      DistroList
+	watchers     []chan<- DistroList
+	watchErrors  chan<- error
+	served       fs.FS
+	httpHandler  http.Handler
+	lastScan     ScanStatus
+	scanFailures map[string]int
+	rescan       chan struct{}
+	redirect     bool
 	sync.Mutex
 }
 
 func LoadDistributionCatalog(files fs.FS, errors chan<- error, logger *zap.Logger) (*DistributionCatalog, error) {
+	// Remote files can not be held open so there is nothing to snapshot
+	grace := DefaultSnapshotGrace
+	if _, remote := files.(remotefs.Redirector); remote {
+		grace = 0
+	}
+
+	catalogFiles := newCatalogFS(files, logger)
+	catalogFiles.grace = grace
+	snapshot := newCatalogSnapshot(grace)
+
 	c := &DistributionCatalog{
-		files:       files,
+		files:       catalogFiles,
+		snapshot:    snapshot,
 		logger:      logger,
 		watchers:    []chan<- DistroList{},
 		watchErrors: errors,
-		httpHandler: http.StripPrefix("/distros/", http.FileServerFS(files)),
+		served:      &snapshotFS{catalogFiles, snapshot},
+		rescan:      make(chan struct{}, 1),
 	}
+	c.httpHandler = http.StripPrefix("/distros/", http.FileServerFS(c))
 
 	// Do the initial scan on startup
 	if err := c.scanFiles(); err != nil {
@@ -82,6 +118,41 @@ func fileSet(entries []fs.DirEntry) mapset.Set[string] {
 	return files
 }
 
+// archFiles returns the names of the files in an architecture directory.
+// Boot files may be in subdirectories, such as within ISO images, so
+// those paths are included if they exist.
+func (c *DistributionCatalog) archFiles(archPath string, entries []fs.DirEntry, distro Distribution) mapset.Set[string] {
+	files := fileSet(entries)
+	for _, name := range distro.BootFiles() {
+		if !strings.Contains(name, "/") {
+			continue
+		}
+		if info, err := fs.Stat(c.files, path.Join(archPath, name)); err == nil && !info.IsDir() {
+			files.Add(name)
+		}
+	}
+	return files
+}
+
+// softFailure records a failure that does not abort the scan
+func (c *DistributionCatalog) softFailure(reason string) {
+	scanSoftFailureMetric.WithLabelValues(reason).Inc()
+	c.scanFailures[reason]++
+}
+
+// hardFailure records a failure that aborts the scan
+func (c *DistributionCatalog) hardFailure(reason string, err error) {
+	scanHardFailureMetric.WithLabelValues(reason).Inc()
+
+	c.Lock()
+	c.lastScan = ScanStatus{
+		Time:         time.Now(),
+		SoftFailures: c.scanFailures,
+		Error:        err,
+	}
+	c.Unlock()
+}
+
 func (c *DistributionCatalog) scanVersions(root string, versionCandidates []fs.DirEntry, distro Distribution) (DistroList, error) {
 	validDistros := DistroList{}
 
@@ -94,9 +165,20 @@ func (c *DistributionCatalog) scanVersions(root string, versionCandidates []fs.D
 		// Enumerate architecture candidates
 		versionName := versionCandidate.Name()
 		versionPath := filepath.Join(root, versionName)
+
+		// Load lifecycle overrides for the version, if any
+		versionMeta, err := versionMetadataFromYaml(c.files, filepath.Join(versionPath, "version.yaml"))
+		if err != nil {
+			c.softFailure("version_yaml_read_failed")
+			c.logger.Debug("Error loading version.yaml",
+				zap.String("path", versionPath),
+				zap.Error(err),
+			)
+		}
+
 		archCandidates, err := fs.ReadDir(c.files, versionPath)
 		if err != nil {
-			scanSoftFailureMetric.WithLabelValues("arch_candidate_read_failed").Inc()
+			c.softFailure("arch_candidate_read_failed")
 			c.logger.Debug("Error reading architecture candidates",
 				zap.String("path", versionPath),
 				zap.Error(err),
@@ -115,7 +197,7 @@ func (c *DistributionCatalog) scanVersions(root string, versionCandidates []fs.D
 			archPath := filepath.Join(versionPath, archName)
 			entries, err := fs.ReadDir(c.files, archPath)
 			if err != nil {
-				scanSoftFailureMetric.WithLabelValues("list_files_read_failed").Inc()
+				c.softFailure("list_files_read_failed")
 				c.logger.Debug("Error reading architecture files",
 					zap.String("path", archPath),
 					zap.Error(err),
@@ -123,10 +205,11 @@ func (c *DistributionCatalog) scanVersions(root string, versionCandidates []fs.D
 				continue
 			}
 
-			if distro.FilesContainDistro(fileSet(entries)) {
+			if distro.FilesContainDistro(c.archFiles(archPath, entries, distro)) {
 				newDistro := distro
 				newDistro.Architecture = archName
 				newDistro.FullVersion = versionName
+				versionMeta.apply(&newDistro)
 				validDistros = append(validDistros, &newDistro)
 
 				c.logger.Debug("Found valid distribution",
@@ -152,12 +235,18 @@ func (c *DistributionCatalog) scanFiles() error {
 	// <files> to be considered a valid distro, otherwise it's skipped.
 
 	distros := DistroList{}
+	start := time.Now()
+	c.scanFailures = map[string]int{}
+
+	// Mount any ISO images so their contents are scanned like any other
+	// architecture directory
+	c.files.refreshMounts(c.softFailure)
 
 	// Fetch distribution candidates from the filesystem root
 	root, err := fs.ReadDir(c.files, ".")
 	if err != nil {
 		c.logger.Error("Error reading root distro candidates", zap.Error(err))
-		scanHardFailureMetric.WithLabelValues("root_read_failed").Inc()
+		c.hardFailure("root_read_failed", err)
 		c.watchErrors <- err
 		return err
 	}
@@ -171,7 +260,7 @@ func (c *DistributionCatalog) scanFiles() error {
 		// Fetch version candidates
 		versionCandidateFiles, err := fs.ReadDir(c.files, distroCandidate.Name())
 		if err != nil {
-			scanSoftFailureMetric.WithLabelValues("distro_candidate_read_failed").Inc()
+			c.softFailure("distro_candidate_read_failed")
 			c.logger.Debug("Error reading distro candidate files",
 				zap.String("distro", distroCandidate.Name()),
 				zap.Error(err),
@@ -193,7 +282,7 @@ func (c *DistributionCatalog) scanFiles() error {
 				// considered for any further processing.
 				distro, err = DistributionFromYaml(c.files, filepath.Join(distroCandidate.Name(), item.Name()))
 				if err != nil {
-					scanSoftFailureMetric.WithLabelValues("distro_yaml_read_failed").Inc()
+					c.softFailure("distro_yaml_read_failed")
 					c.logger.Debug("Error loading distro.yaml",
 						zap.String("distro", distroCandidate.Name()),
 						zap.Error(err),
@@ -206,11 +295,21 @@ func (c *DistributionCatalog) scanFiles() error {
 			}
 		}
 
-		// If we found a valid distro then scan all of its versions
+		// If we found a valid distro then load its install templates and
+		// scan all of its versions
 		if distro != nil {
+			distro.InstallTemplates, err = loadInstallTemplates(c.files, distroCandidate.Name())
+			if err != nil {
+				c.softFailure("install_template_read_failed")
+				c.logger.Debug("Error loading install templates",
+					zap.String("distro", distroCandidate.Name()),
+					zap.Error(err),
+				)
+			}
+
 			scanned, err := c.scanVersions(distroCandidate.Name(), versionCandidates, *distro)
 			if err != nil {
-				scanHardFailureMetric.WithLabelValues("version_scan_failed").Inc()
+				c.hardFailure("version_scan_failed", err)
 				c.watchErrors <- err
 				return err
 			}
@@ -220,12 +319,16 @@ func (c *DistributionCatalog) scanFiles() error {
 
 	sort.Stable(sort.Reverse(distros))
 
+	c.applyLifecycle(distros, time.Now())
+
 	// Only the first distribution for an architecture that has the default
 	// flag can be considered default. Unset default flags on everything
-	// else.
+	// else. Hidden distributions can never be default.
 	archHasDefault := mapset.NewSet[string]()
 	for _, d := range distros {
-		if d.Default {
+		if d.Default && d.Hidden {
+			d.Default = false
+		} else if d.Default {
 			if archHasDefault.Contains(d.Architecture) {
 				d.Default = false
 			} else {
@@ -234,9 +337,19 @@ func (c *DistributionCatalog) scanFiles() error {
 		}
 	}
 
+	// Hold the files of the new set open before any client can be given
+	// a boot script for them
+	c.snapshot.update(c.files, distros, time.Now())
+
 	// Flip the current set of distros to this new set...
 	c.Lock()
 	c.distros = distros
+	c.lastScan = ScanStatus{
+		Time:         start,
+		Duration:     time.Since(start),
+		DistroCount:  len(distros),
+		SoftFailures: c.scanFailures,
+	}
 	c.Unlock()
 
 	// Log some metrics
@@ -251,11 +364,151 @@ func (c *DistributionCatalog) scanFiles() error {
 	return nil
 }
 
+// applyLifecycle hides distributions that are past their EOL date or
+// beyond the retention count for their distribution and architecture,
+// then assigns the latest alias to the newest visible version. The
+// distros must be sorted newest first.
+func (c *DistributionCatalog) applyLifecycle(distros DistroList, now time.Time) {
+	visibleCount := map[string]int{}
+	hasAlias := mapset.NewSet[string]()
+
+	for _, d := range distros {
+		d.Aliases = nil
+
+		eol, err := d.IsEOL(now)
+		if err != nil {
+			c.softFailure("invalid_eol_date")
+			c.logger.Debug("Invalid EOL date for distribution",
+				zap.String("distro", d.Slug()),
+				zap.String("eol", d.EOL),
+				zap.Error(err),
+			)
+		}
+		if eol && !d.Hidden {
+			c.logger.Debug("Hiding distribution past EOL", zap.String("distro", d.Slug()))
+			d.Hidden = true
+		}
+
+		if d.Hidden {
+			continue
+		}
+
+		key := d.LatestAlias()
+		visibleCount[key]++
+		if d.RetainVersions > 0 && visibleCount[key] > d.RetainVersions {
+			c.logger.Debug("Hiding distribution beyond retention count", zap.String("distro", d.Slug()))
+			d.Hidden = true
+			continue
+		}
+
+		if !hasAlias.Contains(key) {
+			hasAlias.Add(key)
+			d.Aliases = append(d.Aliases, key)
+		}
+	}
+}
+
+// Resolve returns the distribution for a slug or alias slug. Hidden
+// distributions can be resolved by their full slug but aliases only
+// ever point to visible distributions.
+func (c *DistributionCatalog) Resolve(slug string) *Distribution {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, d := range c.distros {
+		if d.Slug() == slug || slices.Contains(d.Aliases, slug) {
+			return d
+		}
+	}
+	return nil
+}
+
+// LastScan returns the status of the most recent scan
+func (c *DistributionCatalog) LastScan() ScanStatus {
+	c.Lock()
+	defer c.Unlock()
+	return c.lastScan
+}
+
+// StageForPath classifies a request for a distribution file by the boot
+// stage it represents and returns the slug of the distribution the file
+// belongs to, if any.
+func (c *DistributionCatalog) StageForPath(urlPath string) (BootStage, string) {
+	rel := strings.TrimPrefix(urlPath, "/distros/")
+
+	c.Lock()
+	defer c.Unlock()
+
+	for _, d := range c.distros {
+		file, ok := strings.CutPrefix(rel, d.FilesPath()+"/")
+		if !ok {
+			continue
+		}
+		switch {
+		case file == d.KernelName:
+			return StageKernel, d.Slug()
+		case slices.Contains(d.Initrds(), file):
+			return StageInitrd, d.Slug()
+		default:
+			return StageFile, d.Slug()
+		}
+	}
+
+	return StageFile, ""
+}
+
+// Distros returns the current set of distributions, including hidden
+// distributions.
+func (c *DistributionCatalog) Distros() DistroList {
+	c.Lock()
+	defer c.Unlock()
+	return c.distros
+}
+
+// FileSizes returns the size of the files in a distribution's
+// directory, keyed by file name, including boot files in
+// subdirectories. Files that can not be read are left out.
+func (c *DistributionCatalog) FileSizes(d *Distribution) map[string]int64 {
+	entries, err := fs.ReadDir(c.files, d.FilesPath())
+	if err != nil {
+		c.logger.Debug("Error reading distribution files",
+			zap.String("distro", d.Slug()),
+			zap.Error(err),
+		)
+		return nil
+	}
+
+	sizes := map[string]int64{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			sizes[e.Name()] = info.Size()
+		}
+	}
+
+	for _, name := range d.BootFiles() {
+		if !strings.Contains(name, "/") {
+			continue
+		}
+		if info, err := fs.Stat(c.files, path.Join(d.FilesPath(), name)); err == nil {
+			sizes[name] = info.Size()
+		}
+	}
+
+	return sizes
+}
+
 func (c *DistributionCatalog) Watch(notify chan<- DistroList) {
 	c.watchers = append(c.watchers, notify)
 	notify <- c.distros // Always give new watchers current catalog
 }
 
+// snapshotExpireInterval is how often superseded distribution files and
+// ISO images are checked for the end of their grace period
+const snapshotExpireInterval = time.Minute
+
 func (c *DistributionCatalog) ManageAsync(ctx context.Context, wg *sync.WaitGroup) {
 	go func() {
 		wg.Add(1)
@@ -266,6 +519,10 @@ func (c *DistributionCatalog) ManageAsync(ctx context.Context, wg *sync.WaitGrou
 
 		t := time.NewTicker(time.Hour)
 
+		// Superseded files are closed when their grace period ends rather
+		// than at the next scan, which could be an hour later
+		expire := time.NewTicker(snapshotExpireInterval)
+
 		c.logger.Info("Starting distribution scanner")
 
 		for {
@@ -273,6 +530,10 @@ func (c *DistributionCatalog) ManageAsync(ctx context.Context, wg *sync.WaitGrou
 			case <-ctx.Done():
 				c.logger.Info("Application finished, stopping distribution scanner")
 				return
+			case <-c.rescan:
+				c.logger.Info("Rescan requested, re-scanning distributions")
+				scanRequestMetric.Inc()
+				c.scanFiles()
 			case <-hupChan:
 				c.logger.Info("Got SIGHUP, re-scanning distributions")
 				scanHupMetric.Inc()
@@ -281,11 +542,62 @@ func (c *DistributionCatalog) ManageAsync(ctx context.Context, wg *sync.WaitGrou
 				c.logger.Debug("Performing periodic scan of distributions")
 				scanTimerMetric.Inc()
 				c.scanFiles()
+			case now := <-expire.C:
+				c.snapshot.expire(now)
+				c.files.expireImages(now)
 			}
 		}
 	}()
 }
 
+// RequestRescan asks the catalog manager to rescan the distribution
+// files. Requests made while a rescan is pending are merged.
+func (c *DistributionCatalog) RequestRescan() {
+	select {
+	case c.rescan <- struct{}{}:
+	default:
+	}
+}
+
+// ServeRemote configures how files are served when the distribution
+// tree is remote. If redirect is set clients are redirected to the
+// remote tree for any file it can serve directly. All other files are
+// proxied through the disk cache, which may be nil to proxy without
+// caching. Must be called before the catalog serves requests.
+func (c *DistributionCatalog) ServeRemote(redirect bool, cache *remotefs.DiskCache) {
+	c.redirect = redirect
+	c.served = cache.Wrap(c.served)
+}
+
+// SetSnapshotGrace sets how long distribution files that are removed or
+// replaced on disk continue to be served, zero disables snapshots. It
+// takes effect at the next scan and has no effect for remote trees.
+func (c *DistributionCatalog) SetSnapshotGrace(grace time.Duration) {
+	if _, remote := c.files.base.(remotefs.Redirector); remote {
+		return
+	}
+
+	c.snapshot.Lock()
+	c.snapshot.grace = grace
+	c.snapshot.Unlock()
+
+	c.files.Lock()
+	c.files.grace = grace
+	c.files.Unlock()
+}
+
+// Open opens a file in the distribution tree as it is served to clients,
+// from the snapshot or through the disk cache
+func (c *DistributionCatalog) Open(name string) (fs.File, error) {
+	return c.served.Open(name)
+}
+
 func (c *DistributionCatalog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if c.redirect {
+		if u, ok := c.files.redirectURL(strings.TrimPrefix(r.URL.Path, "/distros/")); ok {
+			http.Redirect(w, r, u, http.StatusFound)
+			return
+		}
+	}
 	c.httpHandler.ServeHTTP(w, r)
 }
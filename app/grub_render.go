@@ -0,0 +1,273 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var (
+	grubRenderSuccessMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_grub_render_success",
+		Help: "Successful GRUB configuration renderings",
+	})
+	grubRenderFailureMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_grub_render_failure",
+		Help: "Failed GRUB configuration renderings",
+	})
+)
+
+// GrubConfigName is the name of the global GRUB configuration. GRUB
+// looks for grub.cfg-01-<mac> then grub.cfg-<hex ip> prefixes then
+// grub.cfg in its prefix directory when booted from the network.
+const GrubConfigName = "grub.cfg"
+
+// ParseGrubConfigName returns the MAC address from a GRUB configuration
+// file name, which is empty for the global configuration. Names that are
+// not served, such as those for IP addresses, return false so GRUB moves
+// on to the next name.
+func ParseGrubConfigName(name string) (string, bool) {
+	if name == GrubConfigName {
+		return "", true
+	}
+
+	hw, ok := strings.CutPrefix(name, GrubConfigName+"-01-")
+	if !ok {
+		return "", false
+	}
+
+	mac, err := net.ParseMAC(strings.ReplaceAll(hw, "-", ":"))
+	if err != nil {
+		return "", false
+	}
+	return mac.String(), true
+}
+
+// grubEntry is a distribution as a GRUB menu entry
+type grubEntry struct {
+	ID      string
+	Title   string
+	Kernel  string
+	Initrds string
+	Args    string
+	Default bool
+}
+
+// GrubRendererHandler renders GRUB configuration with the same menu as
+// the iPXE script, for hosts that must boot through shim and GRUB for
+// Secure Boot. Boot files are fetched by GRUB over plain HTTP from the
+// host in HttpServer.
+type GrubRendererHandler struct {
+	*BootMenu
+	VarsConfig *VarsConfig
+	HttpServer string
+	template   *template.Template
+	sync.RWMutex
+}
+
+func (h *GrubRendererHandler) ParseTemplate(content string) (err error) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.template, err = template.New("grub").Funcs(template.FuncMap{
+		"quote": grubQuote,
+	}).Parse(content)
+	return err
+}
+
+// grubQuote quotes a string as a GRUB word. Variable references are
+// expanded by GRUB so that variables can refer to other variables as
+// they can in iPXE.
+func grubQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// grubTitle quotes a menu entry title, which is never expanded
+func grubTitle(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// grubRoot returns the GRUB device for the HTTP server followed by any
+// path prefix. GRUB only supports plain HTTP so the scheme is ignored
+// and a port is only used for http URLs.
+func grubRoot(httpServer string) (string, error) {
+	u, err := url.Parse(httpServer)
+	if err != nil {
+		return "", err
+	}
+
+	dev := "(http," + u.Hostname()
+	if u.Scheme == "http" && u.Port() != "" {
+		dev += "," + u.Port()
+	}
+	return dev + ")" + strings.TrimSuffix(u.Path, "/"), nil
+}
+
+// grubArgs converts a kernel command line rendered for iPXE into one for
+// GRUB. iPXE variables that GRUB does not have are replaced with the
+// host's values or the GRUB equivalents and characters that GRUB treats
+// specially are escaped.
+func grubArgs(cmdline, mac string) string {
+	cmdline = strings.Join(bootArgs(cmdline), " ")
+
+	cmdline = strings.NewReplacer(
+		`\`, `\\`, `"`, `\"`, `'`, `\'`, `;`, `\;`,
+		`&`, `\&`, `|`, `\|`, `<`, `\<`, `>`, `\>`,
+	).Replace(cmdline)
+
+	return expandIpxeVars(cmdline, func(name, format string) (string, bool) {
+		switch name {
+		case "mac", "net0/mac", "netX/mac":
+			if mac == "" {
+				return "${net_default_mac}", true
+			}
+			return formatMac(mac, format), true
+		case "ip", "net0/ip", "netX/ip":
+			return "${net_default_ip}", true
+		case "buildarch":
+			return "${grub_cpu}", true
+		}
+		return "", false
+	})
+}
+
+func (h *GrubRendererHandler) entries(distros []hostDistribution, root, mac string) []grubEntry {
+	out := make([]grubEntry, 0, len(distros))
+	for _, d := range distros {
+		initrds := []string{}
+		for _, initrd := range d.Initrds() {
+			initrds = append(initrds, root+d.DistroPath()+"/"+initrd)
+		}
+
+		out = append(out, grubEntry{
+			ID:      d.Slug(),
+			Title:   grubTitle(d.DisplayName()),
+			Kernel:  root + d.DistroPath() + "/" + d.KernelName,
+			Initrds: strings.Join(initrds, " "),
+			Args:    grubArgs(d.KernelCommandLine(), mac),
+			Default: d.Default,
+		})
+	}
+	return out
+}
+
+// grubFallback returns the ID of the entry to boot if a one-time boot
+// override fails, the default entry or the first if none is default
+func grubFallback(entries []grubEntry) string {
+	for _, e := range entries {
+		if e.Default {
+			return e.ID
+		}
+	}
+	if len(entries) > 0 {
+		return entries[0].ID
+	}
+	return ""
+}
+
+// Render renders the GRUB configuration for a host. Hosts without a MAC
+// address get the global configuration. If the host has a one-time boot
+// override it is booted without a timeout, falling back to the default
+// entry if it fails, and Render returns true. The configuration is
+// shared by both architectures so the override is only offered when
+// GRUB is running on the architecture of the override, which is what
+// hosts without an architecture in Netbox boot with, like PXELINUX.
+func (h *GrubRendererHandler) Render(w io.Writer, host *HostContext) (bool, error) {
+	h.RLock()
+	defer h.RUnlock()
+
+	root, err := grubRoot(h.HttpServer)
+	if err != nil {
+		return false, err
+	}
+
+	menu := h.ForHost(host)
+
+	x86 := h.entries(menu.X86Distros, root, host.Mac)
+	arm64 := h.entries(menu.ARM64Distros, root, host.Mac)
+
+	data := map[string]any{
+		"DefaultVars":  h.VarsConfig.DefaultVars,
+		"ProductVars":  h.VarsConfig.ProductVars,
+		"HttpServer":   h.HttpServer,
+		"Host":         host,
+		"X86Distros":   x86,
+		"ARM64Distros": arm64,
+		"NextBootArch": "",
+	}
+
+	nextBoot := menu.NextBoot != nil && (host.Architecture == "" || menu.NextBoot.Architecture == host.Architecture)
+	if nextBoot {
+		data["NextBoot"] = h.entries([]hostDistribution{*menu.NextBoot}, root, host.Mac)[0]
+		data["NextBootArch"] = menu.NextBoot.Architecture
+		if menu.NextBoot.Architecture == "aarch64" {
+			data["Fallback"] = grubFallback(arm64)
+		} else {
+			data["Fallback"] = grubFallback(x86)
+		}
+	}
+
+	return nextBoot, h.template.Execute(w, data)
+}
+
+// RenderConfig renders a GRUB configuration by file name, for serving
+// over TFTP
+func (h *GrubRendererHandler) RenderConfig(ctx context.Context, name, clientIP string) ([]byte, string, error) {
+	mac, _ := ParseGrubConfigName(name)
+
+	host, err := h.LookupHost(ctx, mac, clientIP)
+	if err != nil {
+		grubRenderFailureMetric.Inc()
+		h.Logger.Error("Error building host context", zap.String("mac", mac), zap.Error(err))
+		return nil, mac, err
+	}
+
+	buf := &bytes.Buffer{}
+	nextBoot, err := h.Render(buf, host)
+	if err != nil {
+		grubRenderFailureMetric.Inc()
+		h.Logger.Error("Error rendering GRUB template", zap.String("mac", mac), zap.Error(err))
+		return nil, mac, err
+	}
+
+	if nextBoot {
+		h.Overrides.MarkServed(mac)
+	}
+	grubRenderSuccessMetric.Inc()
+	return buf.Bytes(), mac, nil
+}
+
+// ServeHTTP handles GET /grub/{file} for GRUB loaded over HTTP
+func (h *GrubRendererHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("file")
+
+	mac, ok := ParseGrubConfigName(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// The MAC is in the file name rather than the path so set it for
+	// boot session tracking
+	r.SetPathValue("mac", mac)
+
+	buf, _, err := h.RenderConfig(r.Context(), name, clientIP(r))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(buf)
+}
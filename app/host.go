@@ -0,0 +1,82 @@
+package app
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"code.crute.us/mcrute/netboot-server/netboxconfig"
+)
+
+// HostKernelArgs are per-host changes to a distribution's kernel
+// arguments. They come from the kernel_args key in the host's Netbox
+// config context.
+type HostKernelArgs struct {
+	Add    []KernelArgument `json:"add"`
+	Remove []string         `json:"remove"`
+}
+
+// HostContext describes the client for which a boot script is being
+// rendered. Fields that come from Netbox are empty if the host is not
+// known to Netbox. Serial is only set for Raspberry Pi boards, which are
+// identified by serial number. Architecture comes from the architecture
+// key in the host's config context and is only needed by boot loaders
+// that can not report their architecture, such as PXELINUX and U-Boot.
+type HostContext struct {
+	Mac          string
+	ClientIP     string
+	Serial       string
+	Name         string
+	Site         string
+	Fqdn         string
+	PrimaryIP4   string
+	PrimaryIP6   string
+	Architecture string
+	KernelArgs   HostKernelArgs
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// NewHostContext builds a host context from the request metadata and
+// the Netbox device record, which may be nil.
+func NewHostContext(mac, clientIP string, cfg *netboxconfig.RawConfig) (*HostContext, error) {
+	h := &HostContext{
+		Mac:      mac,
+		ClientIP: clientIP,
+	}
+
+	if cfg == nil {
+		return h, nil
+	}
+
+	h.Name = cfg.Name
+	h.Site = cfg.Site.Name
+	h.Fqdn = cfg.Fqdn()
+
+	if cfg.PrimaryIP4 != nil {
+		h.PrimaryIP4 = cfg.PrimaryIP4.Address
+	}
+	if cfg.PrimaryIP6 != nil {
+		h.PrimaryIP6 = cfg.PrimaryIP6.Address
+	}
+
+	if arch, ok := cfg.ConfigContext["architecture"]; ok {
+		if err := json.Unmarshal(arch, &h.Architecture); err != nil {
+			return nil, err
+		}
+	}
+
+	if args, ok := cfg.ConfigContext["kernel_args"]; ok {
+		if err := json.Unmarshal(args, &h.KernelArgs); err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
@@ -0,0 +1,118 @@
+package app
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"code.crute.us/mcrute/netboot-server/store"
+	"go.uber.org/zap"
+)
+
+// hostTokenRegisterWindow is how long after fetching an APKOVL a host
+// can register a new token
+const hostTokenRegisterWindow = time.Hour
+
+const hostTokenPrefix = "host/"
+
+// HostTokens authenticates requests that hosts make once they have
+// booted, such as check-ins and lbu uploads. Overlays are served without
+// authentication so they can not carry a secret. Instead the check-in
+// script generates a random token on each boot and the first request
+// with a new token from the address that fetched an APKOVL registers
+// it. Only a hash of the token is kept. A nil HostTokens rejects every
+// token.
+type HostTokens struct {
+	Logger   *zap.Logger
+	Store    *store.Bucket[store.Token]
+	Sessions *SessionTracker
+	tokens   map[string]store.Token
+	sync.Mutex
+}
+
+// Load restores registered tokens from the store
+func (t *HostTokens) Load() error {
+	if t == nil {
+		return nil
+	}
+
+	items, err := t.Store.Scan(hostTokenPrefix)
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.tokens = map[string]store.Token{}
+	for _, item := range items {
+		t.tokens[item.Value.Name] = item.Value
+	}
+
+	return err
+}
+
+// Authenticate returns true if the bearer token of a request is the
+// registered token for a host, registering it if the host has fetched
+// an APKOVL from the same address since its last token was registered
+func (t *HostTokens) Authenticate(mac string, r *http.Request) bool {
+	if t == nil {
+		return false
+	}
+
+	secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || secret == "" {
+		return false
+	}
+	hash := store.HashToken(secret)
+	now := time.Now()
+
+	t.Lock()
+	if t.tokens == nil {
+		t.tokens = map[string]store.Token{}
+	}
+
+	current, registered := t.tokens[mac]
+	if registered && subtle.ConstantTimeCompare([]byte(current.Hash), []byte(hash)) == 1 {
+		t.Unlock()
+		return true
+	}
+
+	// A new token is only accepted once per APKOVL fetch, which is once
+	// per boot, and only from the address that fetched the APKOVL
+	ip := clientIP(r)
+	fetched, fetchedIP, ok := t.Sessions.LastOverlay(mac)
+	if !ok || ip != fetchedIP || now.Sub(fetched) > hostTokenRegisterWindow || (registered && current.Created.After(fetched)) {
+		t.Unlock()
+		t.Logger.Warn("Rejected host token", zap.String("mac", mac), zap.String("client_ip", ip))
+		return false
+	}
+
+	token := store.Token{Name: mac, Hash: hash, ClientIP: ip, Created: now}
+	t.tokens[mac] = token
+	t.Unlock()
+
+	t.Logger.Info("Registered host token", zap.String("mac", mac), zap.String("client_ip", ip))
+	if err := t.Store.Put(hostTokenPrefix+mac, token); err != nil {
+		t.Logger.Error("Error saving host token", zap.String("mac", mac), zap.Error(err))
+	}
+	return true
+}
+
+// Reset removes the registered token for a host so that the host can
+// register a new token when it next boots. It returns false if the host
+// has no token.
+func (t *HostTokens) Reset(mac string) (bool, error) {
+	if t == nil {
+		return false, nil
+	}
+
+	t.Lock()
+	_, ok := t.tokens[mac]
+	delete(t.tokens, mac)
+	t.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+	return true, t.Store.Delete(hostTokenPrefix + mac)
+}
@@ -0,0 +1,159 @@
+package app
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"code.crute.us/mcrute/netboot-server/store"
+	"go.uber.org/zap"
+)
+
+const testTokenMac = "00:11:22:33:44:55"
+
+func TestHostTokensAuthenticate(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		fetchIP   string
+		fetchedAt time.Time
+		existing  *store.Token
+		secret    string
+		clientIP  string
+		want      bool
+	}{
+		{
+			name:     "no overlay fetch",
+			secret:   "new",
+			clientIP: "192.0.2.10",
+			want:     false,
+		},
+		{
+			name:      "register after fetch",
+			fetchIP:   "192.0.2.10",
+			fetchedAt: now.Add(-time.Minute),
+			secret:    "new",
+			clientIP:  "192.0.2.10",
+			want:      true,
+		},
+		{
+			name:      "register from another address",
+			fetchIP:   "192.0.2.10",
+			fetchedAt: now.Add(-time.Minute),
+			secret:    "new",
+			clientIP:  "192.0.2.99",
+			want:      false,
+		},
+		{
+			name:      "register after window",
+			fetchIP:   "192.0.2.10",
+			fetchedAt: now.Add(-2 * hostTokenRegisterWindow),
+			secret:    "new",
+			clientIP:  "192.0.2.10",
+			want:      false,
+		},
+		{
+			name:      "missing token",
+			fetchIP:   "192.0.2.10",
+			fetchedAt: now.Add(-time.Minute),
+			clientIP:  "192.0.2.10",
+			want:      false,
+		},
+		{
+			name:      "registered token",
+			fetchIP:   "192.0.2.10",
+			fetchedAt: now.Add(-2 * hostTokenRegisterWindow),
+			existing:  &store.Token{Hash: store.HashToken("old"), Created: now.Add(-time.Hour)},
+			secret:    "old",
+			clientIP:  "192.0.2.10",
+			want:      true,
+		},
+		{
+			name:      "new token after registration is locked out",
+			fetchIP:   "192.0.2.10",
+			fetchedAt: now.Add(-time.Minute),
+			existing:  &store.Token{Hash: store.HashToken("old"), Created: now.Add(-time.Second)},
+			secret:    "new",
+			clientIP:  "192.0.2.10",
+			want:      false,
+		},
+		{
+			name:      "new token after next fetch",
+			fetchIP:   "192.0.2.10",
+			fetchedAt: now.Add(-time.Minute),
+			existing:  &store.Token{Hash: store.HashToken("old"), Created: now.Add(-time.Hour)},
+			secret:    "new",
+			clientIP:  "192.0.2.10",
+			want:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sessions := &SessionTracker{Logger: zap.NewNop()}
+			if test.fetchIP != "" {
+				sessions.Record(testTokenMac, "", StageEvent{
+					Stage:    StageApkovl,
+					Time:     test.fetchedAt,
+					ClientIP: test.fetchIP,
+					Status:   200,
+				})
+			}
+
+			tokens := &HostTokens{Logger: zap.NewNop(), Sessions: sessions}
+			if test.existing != nil {
+				tokens.tokens = map[string]store.Token{testTokenMac: *test.existing}
+			}
+
+			r := httptest.NewRequest("POST", "/"+testTokenMac+"/checkin", nil)
+			r.RemoteAddr = test.clientIP + ":1234"
+			if test.secret != "" {
+				r.Header.Set("Authorization", "Bearer "+test.secret)
+			}
+
+			if got := tokens.Authenticate(testTokenMac, r); got != test.want {
+				t.Errorf("Authenticate() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHostTokensReset(t *testing.T) {
+	sessions := &SessionTracker{Logger: zap.NewNop()}
+	sessions.Record(testTokenMac, "", StageEvent{
+		Stage:    StageApkovl,
+		Time:     time.Now().Add(-time.Minute),
+		ClientIP: "192.0.2.10",
+		Status:   200,
+	})
+	tokens := &HostTokens{Logger: zap.NewNop(), Sessions: sessions}
+
+	request := func(secret string) bool {
+		r := httptest.NewRequest("POST", "/"+testTokenMac+"/checkin", nil)
+		r.RemoteAddr = "192.0.2.10:1234"
+		r.Header.Set("Authorization", "Bearer "+secret)
+		return tokens.Authenticate(testTokenMac, r)
+	}
+
+	if !request("squatter") {
+		t.Fatal("first token was not registered")
+	}
+	if request("host") {
+		t.Fatal("second token was registered for the same fetch")
+	}
+
+	if found, err := tokens.Reset(testTokenMac); !found || err != nil {
+		t.Fatalf("Reset() = %v, %v", found, err)
+	}
+	if found, _ := tokens.Reset(testTokenMac); found {
+		t.Fatal("Reset() found a token that was already removed")
+	}
+
+	if !request("host") {
+		t.Fatal("token was not registered after reset")
+	}
+	if request("squatter") {
+		t.Fatal("removed token was accepted")
+	}
+}
@@ -0,0 +1,68 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"code.crute.us/mcrute/netboot-server/netboxconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var (
+	ignitionSuccessMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_ignition_success",
+		Help: "Successfully generated Ignition configs",
+	})
+	ignitionFailureMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_ignition_failure",
+		Help: "Failed Ignition host lookups and generations",
+	})
+	ignitionInvalidMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_ignition_invalid",
+		Help: "Generated Ignition configs that failed validation",
+	})
+)
+
+// IgnitionHandler serves Ignition configs for Fedora CoreOS and Flatcar
+// hosts in Netbox at /{mac}/ignition.json. Configs that fail validation
+// are not served since Ignition fails the boot on an invalid config.
+type IgnitionHandler struct {
+	Logger      *zap.Logger
+	Coordinator *netboxconfig.ConfigCoordinator
+}
+
+func (h *IgnitionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hw, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		http.Error(w, "invalid MAC address", http.StatusBadRequest)
+		return
+	}
+	mac := hw.String()
+
+	if h.Coordinator == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	out, err := h.Coordinator.GenerateIgnition(r.Context(), mac)
+	if err != nil {
+		if errors.Is(err, netboxconfig.ErrHostNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if errors.Is(err, netboxconfig.ErrInvalidIgnition) {
+			ignitionInvalidMetric.Inc()
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		h.Logger.Error("Error generating Ignition config", zap.String("mac", mac), zap.Error(err))
+		ignitionFailureMetric.Inc()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+	ignitionSuccessMetric.Inc()
+}
@@ -0,0 +1,173 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"path"
+	"slices"
+	"text/template"
+
+	"code.crute.us/mcrute/netboot-server/netboxconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var (
+	installConfigSuccessMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "netboot_install_config_render_success",
+		Help: "Successful kickstart and preseed renderings",
+	}, []string{"file"})
+	installConfigFailureMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "netboot_install_config_render_failure",
+		Help: "Failed kickstart and preseed renderings",
+	}, []string{"file"})
+)
+
+// installConfigFiles are the unattended install files that can be
+// rendered for a host, mapped to the template next to distro.yaml that
+// renders them
+var installConfigFiles = map[string]string{
+	"ks.cfg":      "ks.cfg.tpl",
+	"preseed.cfg": "preseed.cfg.tpl",
+}
+
+// loadInstallTemplates parses the unattended install templates in a
+// distribution directory. Templates that do not exist are skipped.
+func loadInstallTemplates(files fs.FS, dir string) (map[string]*template.Template, error) {
+	out := map[string]*template.Template{}
+	for name, tplName := range installConfigFiles {
+		content, err := fs.ReadFile(files, path.Join(dir, tplName))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+
+		t, err := template.New(tplName).Funcs(kernelArgFuncs).Option("missingkey=error").Parse(string(content))
+		if err != nil {
+			return nil, err
+		}
+		out[name] = t
+	}
+	return out, nil
+}
+
+// InstallConfigNames returns the sorted names of the unattended install
+// files that the distribution can render
+func (d Distribution) InstallConfigNames() []string {
+	out := make([]string, 0, len(d.InstallTemplates))
+	for name := range d.InstallTemplates {
+		out = append(out, name)
+	}
+	slices.Sort(out)
+	return out
+}
+
+// installConfigData is the data passed to kickstart and preseed
+// templates. The distribution is embedded like kernelArgData so the
+// same template expressions work in both.
+type installConfigData struct {
+	*Distribution
+	Host       *HostContext
+	Config     *netboxconfig.RawConfig
+	Context    map[string]any
+	HttpServer string
+}
+
+// InstallConfigHandler renders kickstart and preseed files for a host
+// from the templates of the distribution it is installing. The
+// distribution is the slug or alias in the distro query parameter, else
+// the distribution the host is booting in its current session. Only
+// hosts in Netbox get install files because they are host specific.
+type InstallConfigHandler struct {
+	Logger      *zap.Logger
+	Coordinator *netboxconfig.ConfigCoordinator
+	Catalog     *DistributionCatalog
+	Sessions    *SessionTracker
+	HttpServer  string
+}
+
+func (h *InstallConfigHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	file := path.Base(r.URL.Path)
+
+	hw, err := net.ParseMAC(r.PathValue("mac"))
+	if err != nil {
+		http.Error(w, "invalid MAC address", http.StatusBadRequest)
+		return
+	}
+	mac := hw.String()
+
+	slug := r.URL.Query().Get("distro")
+	if slug == "" {
+		slug = h.Sessions.CurrentDistro(mac)
+	}
+
+	d := h.Catalog.Resolve(slug)
+	if d == nil || d.InstallTemplates[file] == nil {
+		h.Logger.Info("No install template for host",
+			zap.String("mac", mac), zap.String("file", file), zap.String("distro", slug))
+		http.NotFound(w, r)
+		return
+	}
+
+	if h.Coordinator == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	cfg, err := h.Coordinator.GetHost(r.Context(), mac)
+	if err != nil {
+		if errors.Is(err, netboxconfig.ErrHostNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		h.Logger.Error("Error looking up host for install config", zap.String("mac", mac), zap.Error(err))
+		installConfigFailureMetric.WithLabelValues(file).Inc()
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	if err := h.render(buf, d, file, mac, clientIP(r), cfg); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		h.Logger.Error("Error rendering install config",
+			zap.String("mac", mac), zap.String("file", file), zap.String("distro", d.Slug()), zap.Error(err))
+		installConfigFailureMetric.WithLabelValues(file).Inc()
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.Copy(w, buf)
+	installConfigSuccessMetric.WithLabelValues(file).Inc()
+}
+
+func (h *InstallConfigHandler) render(w io.Writer, d *Distribution, file, mac, clientIP string, cfg *netboxconfig.RawConfig) error {
+	host, err := NewHostContext(mac, clientIP, cfg)
+	if err != nil {
+		return err
+	}
+
+	context := map[string]any{}
+	for k, v := range cfg.ConfigContext {
+		var value any
+		if err := json.Unmarshal(v, &value); err != nil {
+			return err
+		}
+		context[k] = value
+	}
+
+	return d.InstallTemplates[file].Execute(w, &installConfigData{
+		Distribution: d,
+		Host:         host,
+		Config:       cfg,
+		Context:      context,
+		HttpServer:   h.HttpServer,
+	})
+}
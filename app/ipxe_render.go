@@ -1,9 +1,8 @@
 package app
 
 import (
-	"context"
+	"io"
 	"net/http"
-	"sort"
 	"sync"
 	"text/template"
 
@@ -23,23 +22,12 @@ var (
 	})
 )
 
-type IpxeDistroList []*Distribution
-
-func (l IpxeDistroList) Len() int      { return len(l) }
-func (l IpxeDistroList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
-func (l IpxeDistroList) Less(i, j int) bool {
-	return l[i].Default
-}
-
 type IpxeRendererHandler struct {
-	Logger       *zap.Logger
-	VarsConfig   *VarsConfig
-	NtpServer    string
-	HttpServer   string
-	CatalogWatch chan DistroList
-	x86Distros   IpxeDistroList
-	arm64Distros IpxeDistroList
-	template     *template.Template
+	*BootMenu
+	VarsConfig *VarsConfig
+	NtpServer  string
+	HttpServer string
+	template   *template.Template
 	sync.RWMutex
 }
 
@@ -51,66 +39,50 @@ func (h *IpxeRendererHandler) ParseTemplate(content string) (err error) {
 	return err
 }
 
-func (h *IpxeRendererHandler) WatchCatalogAsync(ctx context.Context, wg *sync.WaitGroup) {
-	go func() {
-		wg.Add(1)
-		defer wg.Done()
-
-		h.Logger.Info("Starting IPXE catalog watcher")
-
-		for {
-			select {
-			case distros := <-h.CatalogWatch:
-				h.Logger.Info("IPXE catalog watcher updated")
-				h.updateDistros(distros)
-			case <-ctx.Done():
-				h.Logger.Info("Shutting down IPXE catalog watcher")
-				return
-			}
-		}
-	}()
-}
-
-func (h *IpxeRendererHandler) updateDistros(distros []*Distribution) {
-	x86Distros, arm64Distros := IpxeDistroList{}, IpxeDistroList{}
-	for _, d := range distros {
-		if d.Architecture == "x86_64" {
-			x86Distros = append(x86Distros, d)
-		} else if d.Architecture == "aarch64" {
-			arm64Distros = append(arm64Distros, d)
-		}
-	}
-	sort.Stable(x86Distros)
-	sort.Stable(arm64Distros)
-
-	h.Lock()
-	defer h.Unlock()
-	h.x86Distros = x86Distros
-	h.arm64Distros = arm64Distros
-}
-
-func (h *IpxeRendererHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// Render renders the IPXE script for a host. If the host has a
+// one-time boot override the script boots it directly, without the
+// menu, and Render returns true.
+func (h *IpxeRendererHandler) Render(w io.Writer, host *HostContext) (bool, error) {
 	h.RLock()
 	defer h.RUnlock()
 
-	w.Header().Set("Content-Type", "text/plain")
+	menu := h.ForHost(host)
 
-	if err := h.template.Execute(w, map[string]any{
+	return menu.NextBoot != nil, h.template.Execute(w, map[string]any{
 		"DefaultVars":  h.VarsConfig.DefaultVars,
 		"ProductVars":  h.VarsConfig.ProductVars,
 		"HttpServer":   h.HttpServer,
 		"NTP":          h.NtpServer,
-		"X86Distros":   h.x86Distros,
-		"ARM64Distros": h.arm64Distros,
-	}); err != nil {
+		"Host":         host,
+		"NextBoot":     menu.NextBoot,
+		"X86Distros":   menu.X86Distros,
+		"ARM64Distros": menu.ARM64Distros,
+	})
+}
+
+func (h *IpxeRendererHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mac := r.PathValue("mac")
+
+	host, err := h.LookupHost(r.Context(), mac, clientIP(r))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ipxeRenderFailureMetric.Inc()
+		h.Logger.Error("Error building host context", zap.String("mac", mac), zap.Error(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+
+	nextBoot, err := h.Render(w, host)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		ipxeRenderFailureMetric.Inc()
-		h.Logger.Error("Error rendering IPXE template",
-			zap.String("mac", r.PathValue("mac")),
-			zap.Error(err),
-		)
+		h.Logger.Error("Error rendering IPXE template", zap.String("mac", mac), zap.Error(err))
 		return
 	}
 
+	if nextBoot {
+		h.Overrides.MarkServed(mac)
+	}
 	ipxeRenderSuccessMetric.Inc()
 }
@@ -3,15 +3,66 @@ package app
 import (
 	"bytes"
 	"fmt"
+	"net/netip"
 	"strconv"
 	"strings"
 	"text/template"
 )
 
 type KernelArgument struct {
-	Key      string `yaml:"key"`
-	Value    string `yaml:"value"`
-	Template string `yaml:"template"`
+	Key      string `yaml:"key" json:"key"`
+	Value    string `yaml:"value" json:"value"`
+	Template string `yaml:"template" json:"template"`
+}
+
+// kernelArgData is the data passed to kernel argument templates. The
+// distribution is embedded so that templates written before host
+// context existed continue to work.
+type kernelArgData struct {
+	*Distribution
+	Host *HostContext
+}
+
+// Template functions for working with Netbox addresses, which are
+// always in prefix notation (ex: 192.0.2.10/24). These make it
+// possible to render static ip= arguments server side.
+var kernelArgFuncs = template.FuncMap{
+	"addr": func(p string) (string, error) {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return "", err
+		}
+		return prefix.Addr().String(), nil
+	},
+	"prefixlen": func(p string) (int, error) {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return 0, err
+		}
+		return prefix.Bits(), nil
+	},
+	"netmask": func(p string) (string, error) {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return "", err
+		}
+		if !prefix.Addr().Is4() {
+			return "", fmt.Errorf("netmask requires an IPv4 prefix, got %s", p)
+		}
+		mask := uint32(0xffffffff) << (32 - prefix.Bits())
+		return netip.AddrFrom4([4]byte{
+			byte(mask >> 24), byte(mask >> 16), byte(mask >> 8), byte(mask),
+		}).String(), nil
+	},
+	// Assumes the gateway is the first host address in the network, the
+	// same as the ifupdown_ng plugin
+	"gateway": func(p string) (string, error) {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return "", err
+		}
+		return prefix.Masked().Addr().Next().String(), nil
+	},
 }
 
 func conditionalQuote(key, value string) string {
@@ -21,26 +72,33 @@ func conditionalQuote(key, value string) string {
 	return fmt.Sprintf(`%s=%s`, key, value)
 }
 
-func renderTemplateArg(tpl string, d *Distribution) (string, error) {
-	t, err := template.New("t").Parse(tpl)
+func renderTemplateArg(tpl string, data *kernelArgData) (string, error) {
+	t, err := template.New("t").Funcs(kernelArgFuncs).Option("missingkey=error").Parse(tpl)
 	if err != nil {
 		return "", err
 	}
 
 	buf := &bytes.Buffer{}
-	if err := t.Execute(buf, d); err != nil {
+	if err := t.Execute(buf, data); err != nil {
 		return "", err
 	}
 
 	return buf.String(), nil
 }
 
-func (a KernelArgument) Render(d *Distribution) (value string, err error) {
+// Render renders the argument for a distribution booting on a host.
+// Template failures are returned as errors rather than dropping the
+// argument because a missing argument can produce a system that boots
+// but is not configured correctly.
+func (a KernelArgument) Render(d *Distribution, host *HostContext) (value string, err error) {
 	if a.Value != "" { // Value arguments
 		value = a.Value
 	} else if a.Template != "" { // Template Arguments
-		if value, err = renderTemplateArg(a.Template, d); err != nil {
-			return "", nil
+		if host == nil {
+			host = &HostContext{}
+		}
+		if value, err = renderTemplateArg(a.Template, &kernelArgData{d, host}); err != nil {
+			return "", fmt.Errorf("Error rendering kernel argument %s: %w", a.Key, err)
 		}
 	} else { // Unary arguments
 		return a.Key, nil
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"code.crute.us/mcrute/netboot-server/netboxconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var (
+	lbuUploadSuccessMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_lbu_upload_success",
+		Help: "Successful lbu backup uploads",
+	})
+	lbuUploadFailureMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_lbu_upload_failure",
+		Help: "Failed or rejected lbu backup uploads",
+	})
+)
+
+// LbuUploadHandler accepts lbu backups from hosts that opted in with the
+// upload key of the alpine_lbu plugin. The latest backup is merged into
+// the next APKOVL generated for the host. Each host authenticates with
+// its host token.
+type LbuUploadHandler struct {
+	Logger *zap.Logger
+	Store  *netboxconfig.LbuStore
+	Tokens *HostTokens
+}
+
+func (h *LbuUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.Store == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	mac := r.PathValue("mac")
+	if _, err := net.ParseMAC(mac); err != nil {
+		http.Error(w, "invalid MAC address", http.StatusBadRequest)
+		return
+	}
+
+	if !h.Tokens.Authenticate(mac, r) {
+		h.Logger.Info("Rejected lbu upload with invalid token", zap.String("mac", mac))
+		lbuUploadFailureMetric.Inc()
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, netboxconfig.MaxLbuBackupSize)
+	if err := h.Store.Save(mac, body); err != nil {
+		lbuUploadFailureMetric.Inc()
+
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) || errors.Is(err, netboxconfig.ErrLbuBackupTooLarge) {
+			http.Error(w, "backup too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if errors.Is(err, netboxconfig.ErrInvalidLbuBackup) {
+			h.Logger.Info("Rejected invalid lbu backup", zap.String("mac", mac), zap.Error(err))
+			http.Error(w, "invalid backup", http.StatusBadRequest)
+			return
+		}
+
+		h.Logger.Error("Error saving lbu backup", zap.String("mac", mac), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	h.Logger.Info("Saved lbu backup", zap.String("mac", mac))
+	lbuUploadSuccessMetric.Inc()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,177 @@
+package app
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"code.crute.us/mcrute/netboot-server/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var (
+	nextBootServedMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_next_boot_served",
+		Help: "Boot scripts rendered for a one-time next boot override",
+	})
+	nextBootConsumedMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_next_boot_consumed",
+		Help: "One-time next boot overrides consumed by a kernel fetch",
+	})
+)
+
+const DefaultNextBootExpiry = 24 * time.Hour
+
+// NextBoot is a one-time boot override for a host. The host will boot
+// directly into the distribution on its next boot, with any extra kernel
+// arguments, and then return to its normal boot menu.
+type NextBoot struct {
+	Slug       string           `json:"slug"`
+	KernelArgs []KernelArgument `json:"kernel_args,omitempty"`
+	Created    time.Time        `json:"created"`
+	Expires    time.Time        `json:"expires"`
+	Served     bool             `json:"served"`
+}
+
+// normalizeMac returns the canonical lower case, colon separated form of
+// a MAC address, or the input lower cased if it is not a valid MAC.
+func normalizeMac(mac string) string {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return strings.ToLower(mac)
+	}
+	return hw.String()
+}
+
+// NextBootOverrides holds the pending next boot overrides for hosts. An
+// override is served when the host requests its boot script and is
+// consumed once the host has fetched a kernel after that. If Store is
+// set overrides are persisted so they survive restarts. A nil
+// NextBootOverrides is valid and has no overrides.
+type NextBootOverrides struct {
+	Logger    *zap.Logger
+	Store     *store.Bucket[NextBoot]
+	overrides map[string]NextBoot
+	sync.Mutex
+}
+
+// Load restores the overrides from the store, dropping expired ones
+func (o *NextBootOverrides) Load() error {
+	items, err := o.Store.Scan("")
+
+	o.Lock()
+	defer o.Unlock()
+
+	o.overrides = map[string]NextBoot{}
+	for _, item := range items {
+		if time.Now().After(item.Value.Expires) {
+			o.delete(item.Key)
+			continue
+		}
+		o.overrides[item.Key] = item.Value
+	}
+
+	return err
+}
+
+// save persists an override. Persistence failures are logged rather
+// than failing the boot because the in-memory state is still correct.
+// Must be called with the lock held.
+func (o *NextBootOverrides) save(mac string, nb NextBoot) error {
+	o.overrides[mac] = nb
+	if err := o.Store.Put(mac, nb); err != nil {
+		o.Logger.Error("Error saving next boot override", zap.String("mac", mac), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// delete removes an override. Must be called with the lock held.
+func (o *NextBootOverrides) delete(mac string) {
+	delete(o.overrides, mac)
+	if err := o.Store.Delete(mac); err != nil {
+		o.Logger.Error("Error deleting next boot override", zap.String("mac", mac), zap.Error(err))
+	}
+}
+
+// Set replaces the override for a host. An error is returned if the
+// override could not be persisted, it is still applied in memory.
+func (o *NextBootOverrides) Set(mac string, nb NextBoot) error {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.overrides == nil {
+		o.overrides = map[string]NextBoot{}
+	}
+	return o.save(normalizeMac(mac), nb)
+}
+
+// Get returns the override for a host if it has one that has not
+// expired
+func (o *NextBootOverrides) Get(mac string) (NextBoot, bool) {
+	if o == nil {
+		return NextBoot{}, false
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	mac = normalizeMac(mac)
+	nb, ok := o.overrides[mac]
+	if ok && time.Now().After(nb.Expires) {
+		o.delete(mac)
+		return NextBoot{}, false
+	}
+	return nb, ok
+}
+
+// Clear removes the override for a host and returns true if there was
+// one
+func (o *NextBootOverrides) Clear(mac string) bool {
+	o.Lock()
+	defer o.Unlock()
+
+	mac = normalizeMac(mac)
+	_, ok := o.overrides[mac]
+	if ok {
+		o.delete(mac)
+	}
+	return ok
+}
+
+// MarkServed records that the host has been sent a boot script for its
+// override
+func (o *NextBootOverrides) MarkServed(mac string) {
+	if o == nil {
+		return
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	mac = normalizeMac(mac)
+	if nb, ok := o.overrides[mac]; ok {
+		nb.Served = true
+		o.save(mac, nb)
+		nextBootServedMetric.Inc()
+	}
+}
+
+// KernelFetched consumes the override for a host if it has been served
+func (o *NextBootOverrides) KernelFetched(mac string) {
+	if o == nil {
+		return
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	mac = normalizeMac(mac)
+	if nb, ok := o.overrides[mac]; ok && nb.Served {
+		o.delete(mac)
+		nextBootConsumedMetric.Inc()
+	}
+}
@@ -0,0 +1,255 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var (
+	pxeRenderSuccessMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_pxe_render_success",
+		Help: "Successful PXELINUX configuration renderings",
+	})
+	pxeRenderFailureMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_pxe_render_failure",
+		Help: "Failed PXELINUX configuration renderings",
+	})
+)
+
+// PxeConfigDir is the directory in which PXELINUX and U-Boot look for
+// their configuration
+const PxeConfigDir = "pxelinux.cfg"
+
+// ParsePxeConfigName returns the MAC address or architecture for a file
+// name in the PXELINUX configuration directory. Clients try, in order:
+//
+//	01-<mac>          per host configuration
+//	C0A80001 ... C    client IP address in hex, shortened a digit at a time
+//	default-arm-...   U-Boot only, the architecture, SoC and board
+//	default
+//
+// Per host configurations return the MAC address and an empty
+// architecture. A full client IP address returns an empty MAC address
+// and architecture, the host is found from the address. Shortened IP
+// addresses and other architectures return false so the client moves on
+// to the next name. Plain PXELINUX only runs on x86 so default is the
+// x86_64 menu.
+func ParsePxeConfigName(name string) (mac, arch string, ok bool) {
+	if hw, ok := strings.CutPrefix(name, "01-"); ok {
+		mac, err := net.ParseMAC(strings.ReplaceAll(hw, "-", ":"))
+		if err != nil {
+			return "", "", false
+		}
+		return mac.String(), "", true
+	}
+
+	if len(name) == 8 {
+		if _, err := hex.DecodeString(name); err == nil {
+			return "", "", true
+		}
+	}
+
+	switch {
+	case name == "default":
+		return "", "x86_64", true
+	case name == "default-arm" || strings.HasPrefix(name, "default-arm-"):
+		return "", "aarch64", true
+	}
+
+	return "", "", false
+}
+
+// pxeHexIP returns the name PXELINUX uses for an IPv4 address, or an
+// empty string for other addresses
+func pxeHexIP(ip string) string {
+	v4 := net.ParseIP(ip).To4()
+	if v4 == nil {
+		return ""
+	}
+	return strings.ToUpper(hex.EncodeToString(v4))
+}
+
+// pxeEntry is a distribution as a PXELINUX label. Paths are relative to
+// the TFTP root.
+type pxeEntry struct {
+	Label   string
+	Title   string
+	Kernel  string
+	Initrds string
+	Fdt     string
+	FdtDir  string
+	Args    string
+}
+
+// PxeRendererHandler renders PXELINUX configuration, which is also used
+// by the U-Boot pxe command, with the same menu as the iPXE script. The
+// configuration format has no way to detect the architecture of the
+// client so the menu only has the distributions of one architecture,
+// from the name of the default configuration or the host's Netbox config
+// context. Boot files are fetched over TFTP.
+type PxeRendererHandler struct {
+	*BootMenu
+	VarsConfig *VarsConfig
+	Sessions   *SessionTracker // Finds hosts that request their IP address
+	template   *template.Template
+	sync.RWMutex
+}
+
+func (h *PxeRendererHandler) ParseTemplate(content string) (err error) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.template, err = template.New("pxelinux").Parse(content)
+	return err
+}
+
+func (h *PxeRendererHandler) entries(distros []hostDistribution, host *HostContext, arch string) []pxeEntry {
+	out := make([]pxeEntry, 0, len(distros))
+	for _, d := range distros {
+		root := strings.TrimPrefix(d.DistroPath(), "/") + "/"
+
+		initrds := []string{}
+		for _, initrd := range d.Initrds() {
+			initrds = append(initrds, root+initrd)
+		}
+
+		e := pxeEntry{
+			Label:   d.Slug(),
+			Title:   d.DisplayName(),
+			Kernel:  root + d.KernelName,
+			Initrds: strings.Join(initrds, ","),
+			Args:    staticBootArgs(d.KernelCommandLine(), host, arch, h.VarsConfig),
+		}
+		if d.FdtName != "" {
+			e.Fdt = root + d.FdtName
+		}
+		if d.FdtDir != "" {
+			e.FdtDir = root + d.FdtDir
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// Render renders the PXELINUX configuration for a host with the menu for
+// an architecture. If the host has a one-time boot override it is booted
+// without prompting. Otherwise the default distribution, or the first if
+// none is marked default, is booted after a timeout. Render returns true
+// if the override was rendered.
+func (h *PxeRendererHandler) Render(w io.Writer, host *HostContext, arch string) (bool, error) {
+	h.RLock()
+	defer h.RUnlock()
+
+	menu := h.ForHost(host)
+
+	distros := menu.X86Distros
+	if arch == "aarch64" {
+		distros = menu.ARM64Distros
+	}
+
+	data := map[string]any{
+		"Host":    host,
+		"Distros": h.entries(distros, host, arch),
+	}
+	for _, d := range distros {
+		if d.Default {
+			data["Default"] = d.Slug()
+			break
+		}
+	}
+	if _, ok := data["Default"]; !ok && len(distros) > 0 {
+		data["Default"] = distros[0].Slug()
+	}
+	nextBoot := menu.NextBoot != nil && menu.NextBoot.Architecture == arch
+	if nextBoot {
+		data["NextBoot"] = h.entries([]hostDistribution{*menu.NextBoot}, host, arch)[0]
+	}
+
+	return nextBoot, h.template.Execute(w, data)
+}
+
+// RenderConfig renders a PXELINUX configuration by file name. Per host
+// configurations are served to hosts with an architecture in Netbox or a
+// one-time boot override, whose architecture is used. Other hosts get
+// fs.ErrNotExist so that they fall back to the default configuration
+// for their architecture. The configuration for a client IP address is
+// the per host configuration of the MAC address last seen from that
+// address, which is normally the 01-<mac> name the client just tried.
+func (h *PxeRendererHandler) RenderConfig(ctx context.Context, name, clientIP string) ([]byte, string, error) {
+	mac, arch, ok := ParsePxeConfigName(name)
+	if !ok {
+		return nil, "", fs.ErrNotExist
+	}
+
+	if mac == "" && arch == "" {
+		if !strings.EqualFold(name, pxeHexIP(clientIP)) {
+			return nil, "", fs.ErrNotExist
+		}
+		known, ok := h.Sessions.MacForIP(clientIP)
+		if !ok {
+			return nil, "", fs.ErrNotExist
+		}
+		hw, err := net.ParseMAC(known)
+		if err != nil {
+			return nil, "", fs.ErrNotExist
+		}
+		mac = hw.String()
+	}
+
+	// Default configurations are not for any host so Netbox is not
+	// queried for them
+	var host *HostContext
+	var err error
+	if mac == "" {
+		host, err = NewHostContext("", clientIP, nil)
+	} else {
+		host, err = h.LookupHost(ctx, mac, clientIP)
+	}
+	if err != nil {
+		pxeRenderFailureMetric.Inc()
+		h.Logger.Error("Error building host context", zap.String("mac", mac), zap.Error(err))
+		return nil, mac, err
+	}
+
+	if mac != "" {
+		arch = host.Architecture
+		if arch == "" {
+			if nb := h.ForHost(host).NextBoot; nb != nil {
+				arch = nb.Architecture
+			}
+		}
+		if arch == "" {
+			return nil, mac, fs.ErrNotExist
+		}
+		if arch != "x86_64" && arch != "aarch64" {
+			pxeRenderFailureMetric.Inc()
+			return nil, mac, fmt.Errorf("unsupported architecture %q for %s", arch, mac)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	nextBoot, err := h.Render(buf, host, arch)
+	if err != nil {
+		pxeRenderFailureMetric.Inc()
+		h.Logger.Error("Error rendering PXELINUX template", zap.String("mac", mac), zap.Error(err))
+		return nil, mac, err
+	}
+
+	if nextBoot {
+		h.Overrides.MarkServed(mac)
+	}
+	pxeRenderSuccessMetric.Inc()
+	return buf.Bytes(), mac, nil
+}
@@ -0,0 +1,280 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"code.crute.us/mcrute/netboot-server/netboxconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var (
+	piRenderSuccessMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_pi_render_success",
+		Help: "Successful Raspberry Pi config.txt and cmdline.txt renderings",
+	})
+	piRenderFailureMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_pi_render_failure",
+		Help: "Failed Raspberry Pi board lookups and config renderings",
+	})
+)
+
+// piBoardTTL is how long the distribution chosen for a board is kept. A
+// board fetches dozens of files while booting and each would otherwise
+// need a Netbox lookup.
+const piBoardTTL = time.Minute
+
+var piSerialRegexp = regexp.MustCompile(`^[0-9a-f]{8}$`)
+
+// ParsePiPath returns the board serial number and the name of the file
+// within the serial directory for a request from the Raspberry Pi
+// bootloader
+func ParsePiPath(name string) (serial, file string, ok bool) {
+	serial, file, ok = strings.Cut(name, "/")
+	if !ok || file == "" || !piSerialRegexp.MatchString(serial) {
+		return "", "", false
+	}
+	return serial, file, true
+}
+
+// piHostConfig is the raspberry_pi key of a board's Netbox config
+// context
+type piHostConfig struct {
+	Distro string   `json:"distro"` // Slug or alias slug
+	Config []string `json:"config"` // Lines added to config.txt
+}
+
+// piBoard is the distribution chosen for a board and its boot
+// configuration
+type piBoard struct {
+	host     *HostContext
+	distro   *Distribution
+	cmdline  string
+	config   []string
+	nextBoot bool
+	expires  time.Time
+}
+
+// RaspberryPiHandler serves network boot files for Raspberry Pi boards,
+// which fetch all of their files over TFTP from a directory named after
+// the board serial number. The directory is mapped onto the directory
+// of a distribution with the raspberry_pi key in its distro.yaml, which
+// should be laid out like a Pi boot partition, and config.txt and
+// cmdline.txt are generated for each board.
+//
+// Boards are looked up in Netbox by serial number. The distribution is
+// the one named in the board's config context, else the default or
+// newest visible Raspberry Pi distribution.
+type RaspberryPiHandler struct {
+	*BootMenu
+	VarsConfig *VarsConfig
+	boards     map[string]*piBoard
+	sync.Mutex
+}
+
+// defaultDistro returns the visible Raspberry Pi distribution marked
+// default, or the newest if there are none
+func (h *RaspberryPiHandler) defaultDistro() *Distribution {
+	var best *Distribution
+	for _, d := range h.Catalog.Distros() {
+		if d.RaspberryPi == nil || d.Hidden {
+			continue
+		}
+		if best == nil || (d.Default && !best.Default) || (d.Default == best.Default && (DistroList{best, d}).Less(0, 1)) {
+			best = d
+		}
+	}
+	return best
+}
+
+// lookupBoard builds the host context for a board from Netbox. Boards
+// that are not in Netbox get a host context with only the serial number
+// and client IP.
+func (h *RaspberryPiHandler) lookupBoard(ctx context.Context, serial, clientIP string) (*HostContext, *piHostConfig, error) {
+	var cfg *netboxconfig.RawConfig
+	if h.Coordinator != nil {
+		var err error
+		cfg, err = h.Coordinator.GetHostBySerial(ctx, serial)
+		if err != nil {
+			if !errors.Is(err, netboxconfig.ErrSerialNotFound) {
+				piRenderFailureMetric.Inc()
+				h.Logger.Error("Error looking up board in Netbox", zap.String("serial", serial), zap.Error(err))
+			}
+			cfg = nil
+		}
+	}
+
+	mac := ""
+	if cfg != nil {
+		mac = cfg.MacAddress()
+	}
+
+	host, err := NewHostContext(mac, clientIP, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	host.Serial = serial
+
+	piCfg := &piHostConfig{}
+	if cfg != nil {
+		if raw, ok := cfg.ConfigContext["raspberry_pi"]; ok {
+			if err := json.Unmarshal(raw, piCfg); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	return host, piCfg, nil
+}
+
+// board returns the boot configuration for a board, from the cache if it
+// was chosen recently so that every file of a boot comes from the same
+// distribution
+func (h *RaspberryPiHandler) board(ctx context.Context, serial, clientIP string) (*piBoard, error) {
+	now := time.Now()
+
+	h.Lock()
+	if b, ok := h.boards[serial]; ok && now.Before(b.expires) {
+		h.Unlock()
+		return b, nil
+	}
+	h.Unlock()
+
+	host, piCfg, err := h.lookupBoard(ctx, serial, clientIP)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &piBoard{host: host, config: piCfg.Config, expires: now.Add(piBoardTTL)}
+
+	if nb := h.nextBoot(host); nb != nil && nb.RaspberryPi != nil {
+		b.distro, b.cmdline, b.nextBoot = nb.Distribution, nb.KernelCommandLine(), true
+	} else {
+		if piCfg.Distro != "" {
+			if b.distro = h.Catalog.Resolve(piCfg.Distro); b.distro == nil || b.distro.RaspberryPi == nil {
+				h.Logger.Error("Raspberry Pi distribution not found, using default",
+					zap.String("serial", serial), zap.String("distro", piCfg.Distro))
+				b.distro = nil
+			}
+		}
+		if b.distro == nil {
+			b.distro = h.defaultDistro()
+		}
+		if b.distro == nil {
+			return nil, fmt.Errorf("no Raspberry Pi distribution for %s: %w", serial, fs.ErrNotExist)
+		}
+
+		if b.cmdline, err = b.distro.KernelCommandLine(host); err != nil {
+			kernelArgRenderFailureMetric.WithLabelValues(b.distro.Slug()).Inc()
+			return nil, err
+		}
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if h.boards == nil {
+		h.boards = map[string]*piBoard{}
+	}
+	for s, old := range h.boards {
+		if !now.Before(old.expires) {
+			delete(h.boards, s)
+		}
+	}
+	h.boards[serial] = b
+
+	return b, nil
+}
+
+// configTxt renders config.txt for a board. The distribution's lines
+// come after the boot files so that they can be overridden and the
+// board's lines come last.
+func (b *piBoard) configTxt() []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "# Generated by the netboot server for %s\n", b.host.Serial)
+	if b.nextBoot {
+		fmt.Fprintf(buf, "# One-time boot override %s\n", b.distro.Slug())
+	}
+	fmt.Fprintln(buf, "[all]")
+
+	if b.distro.Architecture == "aarch64" {
+		fmt.Fprintln(buf, "arm_64bit=1")
+	}
+	fmt.Fprintf(buf, "kernel=%s\n", b.distro.KernelName)
+	fmt.Fprintf(buf, "initramfs %s followkernel\n", strings.Join(b.distro.Initrds(), ","))
+	if b.distro.FdtName != "" {
+		fmt.Fprintf(buf, "device_tree=%s\n", b.distro.FdtName)
+	}
+
+	for _, lines := range [][]string{b.distro.RaspberryPi.Config, b.config} {
+		for _, line := range lines {
+			fmt.Fprintln(buf, line)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// open opens a file requested by the Raspberry Pi bootloader. Files
+// other than config.txt and cmdline.txt are served from the directory of
+// the board's distribution and recorded as kernel, initrd or bootloader
+// fetches.
+func (h *RaspberryPiHandler) open(serial, name, clientIP string) (*tftpFile, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tftpRenderTimeout)
+	defer cancel()
+
+	b, err := h.board(ctx, serial, clientIP)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			piRenderFailureMetric.Inc()
+			h.Logger.Error("Error choosing Raspberry Pi distribution", zap.String("serial", serial), zap.Error(err))
+		}
+		return &tftpFile{stage: StageTftp}, err
+	}
+
+	var buf []byte
+	switch name {
+	case "config.txt":
+		buf = b.configTxt()
+	case "cmdline.txt":
+		buf = []byte(staticBootArgs(b.cmdline, b.host, b.distro.Architecture, h.VarsConfig) + "\n")
+		if b.nextBoot {
+			h.Overrides.MarkServed(b.host.Mac)
+		}
+	default:
+		p := path.Join(b.distro.FilesPath(), name)
+		stage, distro := h.Catalog.StageForPath("/distros/" + p)
+		if stage == StageFile {
+			stage = StageTftp
+		}
+
+		f, err := openTftp(h.Catalog, p)
+		if f == nil {
+			f = &tftpFile{}
+		}
+		f.mac, f.distro, f.stage = b.host.Mac, distro, stage
+		return f, err
+	}
+
+	piRenderSuccessMetric.Inc()
+	r := bytes.NewReader(buf)
+	return &tftpFile{
+		Reader: r,
+		Closer: io.NopCloser(r),
+		size:   r.Size(),
+		mac:    b.host.Mac,
+		distro: b.distro.Slug(),
+		stage:  StagePiConfig,
+	}, nil
+}
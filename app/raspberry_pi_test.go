@@ -0,0 +1,32 @@
+package app
+
+import "testing"
+
+func TestParsePiPath(t *testing.T) {
+	tests := []struct {
+		name       string
+		wantSerial string
+		wantFile   string
+		wantOk     bool
+	}{
+		{"0123abcd/config.txt", "0123abcd", "config.txt", true},
+		{"0123abcd/overlays/disable-bt.dtbo", "0123abcd", "overlays/disable-bt.dtbo", true},
+		{"0123abcd/", "", "", false},
+		{"0123abcd", "", "", false},
+		{"0123ABCD/config.txt", "", "", false},
+		{"0123abc/config.txt", "", "", false},
+		{"0123abcde/config.txt", "", "", false},
+		{"pxelinux.0", "", "", false},
+		{"", "", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			serial, file, ok := ParsePiPath(test.name)
+			if serial != test.wantSerial || file != test.wantFile || ok != test.wantOk {
+				t.Errorf("ParsePiPath(%q) = %q, %q, %v, want %q, %q, %v", test.name,
+					serial, file, ok, test.wantSerial, test.wantFile, test.wantOk)
+			}
+		})
+	}
+}
@@ -0,0 +1,666 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"code.crute.us/mcrute/netboot-server/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var (
+	bootStageDurationMetric = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "netboot_boot_stage_duration_seconds",
+		Help:    "Time taken to serve each boot stage request",
+		Buckets: prometheus.ExponentialBuckets(0.005, 4, 10),
+	}, []string{"stage"})
+	bootStageOffsetMetric = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "netboot_boot_stage_offset_seconds",
+		Help:    "Time from the start of a boot session until each boot stage",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"stage"})
+	bootSessionsStartedMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_boot_sessions_started",
+		Help: "Number of boot sessions started",
+	})
+	bootLoopDetectedMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_boot_loop_detected",
+		Help: "Number of times a host was detected fetching overlays without checking in",
+	})
+	bootLoopHostsMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "netboot_boot_loop_hosts",
+		Help: "Number of hosts currently fetching overlays without checking in",
+	})
+)
+
+const (
+	defaultSessionTimeout   = 30 * time.Minute
+	defaultSessionsPerHost  = 5
+	defaultSessionRetention = 24 * time.Hour
+	sessionPruneInterval    = time.Minute
+	defaultLoopThreshold    = 3
+)
+
+type BootStage string
+
+const (
+	StageTftp          BootStage = "tftp"
+	StageIpxeChain     BootStage = "ipxe_chain"
+	StageIpxeScript    BootStage = "ipxe_script"
+	StageGrubConfig    BootStage = "grub_config"
+	StagePxeConfig     BootStage = "pxe_config"
+	StagePiConfig      BootStage = "pi_config"
+	StageKernel        BootStage = "kernel"
+	StageInitrd        BootStage = "initrd"
+	StageFile          BootStage = "file"
+	StageApkovl        BootStage = "apkovl"
+	StageCloudInit     BootStage = "cloud_init"
+	StageInstallConfig BootStage = "install_config"
+	StageIgnition      BootStage = "ignition"
+	StageAlpineAnswers BootStage = "alpine_answers"
+	StageCheckin       BootStage = "checkin"
+	StageLbuUpload     BootStage = "lbu_upload"
+)
+
+// startsSession returns true for stages that are only requested at the
+// beginning of a boot. Seeing one of these after later stages means the
+// host has rebooted.
+func (s BootStage) startsSession() bool {
+	return s == StageTftp || s == StageIpxeChain || s == StageIpxeScript || s == StageGrubConfig ||
+		s == StagePxeConfig || s == StagePiConfig
+}
+
+// StageEvent is a single request made by a host during a boot
+type StageEvent struct {
+	Stage    BootStage     `json:"stage"`
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration"`
+	Bytes    int64         `json:"bytes"`
+	Path     string        `json:"path"`
+	ClientIP string        `json:"client_ip"`
+	Status   int           `json:"status,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+func (e StageEvent) Failed() bool {
+	return e.Error != "" || e.Status >= 400
+}
+
+// CheckIn is the report a host makes once it has finished booting
+type CheckIn struct {
+	Time      time.Time `json:"time"`
+	Distro    string    `json:"distro,omitempty"`
+	Kernel    string    `json:"kernel"`
+	OSRelease string    `json:"os_release"`
+	Uptime    string    `json:"uptime"`
+}
+
+// BootSession is the sequence of requests made by a host during a single
+// boot. Sessions for hosts that have only used TFTP are keyed by client
+// IP because TFTP requests do not carry a MAC address, they are merged
+// into the MAC keyed session once the host makes a request with a MAC.
+type BootSession struct {
+	Mac      string       `json:"mac"`
+	ClientIP string       `json:"client_ip"`
+	Distro   string       `json:"distro,omitempty"`
+	Started  time.Time    `json:"started"`
+	Updated  time.Time    `json:"updated"`
+	Stages   []StageEvent `json:"stages"`
+	unsaved  bool         // has events not written to the history store
+}
+
+// LastStage returns the most recent stage of the session
+func (s *BootSession) LastStage() StageEvent {
+	if len(s.Stages) == 0 {
+		return StageEvent{}
+	}
+	return s.Stages[len(s.Stages)-1]
+}
+
+func (s *BootSession) hasLaterStages() bool {
+	for _, e := range s.Stages {
+		if !e.Stage.startsSession() {
+			return true
+		}
+	}
+	return false
+}
+
+// SessionTracker correlates requests from the TFTP and HTTP servers into
+// boot sessions. It also detects boot loops, which are hosts that fetch
+// LoopThreshold or more overlays without checking in. A nil
+// SessionTracker is valid and records nothing.
+type SessionTracker struct {
+	Logger        *zap.Logger
+	Writeback     *NetboxWriteback
+	Overrides     *NextBootOverrides
+	History       *store.Bucket[BootSession]
+	Timeout       time.Duration
+	SessionLimit  int
+	Retention     time.Duration
+	LoopThreshold int
+	sessions      map[string][]*BootSession // mac -> sessions, newest last
+	ipSessions    map[string]*BootSession   // client ip -> session with no mac yet
+	ipToMac       map[string]string
+	overlays      map[string]int // mac -> overlays fetched since last check-in
+	checkins      map[string]CheckIn
+	lastPrune     time.Time
+	sync.Mutex
+}
+
+func (t *SessionTracker) timeout() time.Duration {
+	if t.Timeout <= 0 {
+		return defaultSessionTimeout
+	}
+	return t.Timeout
+}
+
+func (t *SessionTracker) sessionLimit() int {
+	if t.SessionLimit <= 0 {
+		return defaultSessionsPerHost
+	}
+	return t.SessionLimit
+}
+
+func (t *SessionTracker) retention() time.Duration {
+	if t.Retention <= 0 {
+		return defaultSessionRetention
+	}
+	return t.Retention
+}
+
+func (t *SessionTracker) loopThreshold() int {
+	if t.LoopThreshold <= 0 {
+		return defaultLoopThreshold
+	}
+	return t.LoopThreshold
+}
+
+func (t *SessionTracker) init() {
+	if t.sessions == nil {
+		t.sessions = map[string][]*BootSession{}
+		t.ipSessions = map[string]*BootSession{}
+		t.ipToMac = map[string]string{}
+		t.overlays = map[string]int{}
+		t.checkins = map[string]CheckIn{}
+	}
+}
+
+// needsNewSession returns true if an event can not be part of the
+// existing session, either because the session has timed out or because
+// the host has started booting again.
+func (t *SessionTracker) needsNewSession(s *BootSession, e StageEvent) bool {
+	if s == nil {
+		return true
+	}
+	if e.Time.Sub(s.Updated) > t.timeout() {
+		return true
+	}
+	return e.Stage.startsSession() && s.hasLaterStages()
+}
+
+func (t *SessionTracker) currentForMac(mac string) *BootSession {
+	sessions := t.sessions[mac]
+	if len(sessions) == 0 {
+		return nil
+	}
+	return sessions[len(sessions)-1]
+}
+
+func (t *SessionTracker) appendForMac(mac string, s *BootSession) {
+	sessions := append(t.sessions[mac], s)
+	if len(sessions) > t.sessionLimit() {
+		sessions = sessions[len(sessions)-t.sessionLimit():]
+	}
+	t.sessions[mac] = sessions
+}
+
+// Record adds an event to the host's current session, starting a new
+// session if needed. The MAC address may be empty if the request did
+// not include one, in which case the client IP is used to find the
+// session.
+func (t *SessionTracker) Record(mac, distro string, e StageEvent) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+
+	t.init()
+	ended := t.prune(e.Time)
+
+	if mac == "" {
+		if known, ok := t.ipToMac[e.ClientIP]; ok {
+			if s := t.currentForMac(known); !t.needsNewSession(s, e) {
+				mac = known
+			}
+		}
+	}
+
+	var session *BootSession
+	if mac == "" {
+		// Host has not identified itself yet, track by IP
+		session = t.ipSessions[e.ClientIP]
+		if t.needsNewSession(session, e) {
+			session = &BootSession{ClientIP: e.ClientIP, Started: e.Time}
+			t.ipSessions[e.ClientIP] = session
+			bootSessionsStartedMetric.Inc()
+		}
+	} else {
+		t.ipToMac[e.ClientIP] = mac
+
+		// Claim any session started by this IP before the MAC was known.
+		// Requests are only attributed to an IP session if they could not
+		// be attributed to the current session for the MAC so the IP
+		// session is always the newest.
+		pending, hasPending := t.ipSessions[e.ClientIP]
+		if hasPending {
+			delete(t.ipSessions, e.ClientIP)
+		}
+
+		current := t.currentForMac(mac)
+		if hasPending && e.Time.Sub(pending.Updated) <= t.timeout() {
+			pending.Mac = mac
+			session = pending
+			t.appendForMac(mac, session)
+		} else if session = current; t.needsNewSession(session, e) {
+			session = &BootSession{Mac: mac, ClientIP: e.ClientIP, Started: e.Time}
+			t.appendForMac(mac, session)
+			bootSessionsStartedMetric.Inc()
+		}
+
+		// The previous session has ended, save any events that were not
+		// saved with it
+		if current != nil && current != session && current.unsaved {
+			current.unsaved = false
+			ended = append(ended, copySession(current))
+		}
+	}
+
+	// Sessions are only written to the history store when they reach a
+	// new stage, fail or complete, otherwise repeated requests for the
+	// same stage, such as distribution files, would each write the
+	// whole session. Later events are saved when the session ends.
+	persist := session.LastStage().Stage != e.Stage || e.Failed() || e.Stage == StageCheckin
+
+	session.ClientIP = e.ClientIP
+	session.Updated = e.Time
+	session.Stages = append(session.Stages, e)
+	if distro != "" {
+		session.Distro = distro
+	}
+
+	t.trackBootLoop(mac, e)
+
+	// Saving the session and consuming overrides write to disk so are
+	// done without holding the lock
+	if session.Mac != "" {
+		session.unsaved = !persist
+		if persist {
+			ended = append(ended, copySession(session))
+		}
+	}
+	saved := copySession(session)
+	t.Unlock()
+
+	if mac != "" && e.Stage == StageKernel && !e.Failed() {
+		t.Overrides.KernelFetched(mac)
+	}
+
+	t.save(ended)
+
+	bootStageDurationMetric.WithLabelValues(string(e.Stage)).Observe(e.Duration.Seconds())
+	bootStageOffsetMetric.WithLabelValues(string(e.Stage)).Observe(e.Time.Sub(saved.Started).Seconds())
+}
+
+// save writes sessions to the history store
+func (t *SessionTracker) save(sessions []BootSession) {
+	for _, s := range sessions {
+		if err := t.History.Put(historyKey(&s), s); err != nil {
+			t.Logger.Error("Error saving boot session", zap.String("mac", s.Mac), zap.Error(err))
+		}
+	}
+}
+
+func historyKey(s *BootSession) string {
+	return s.Mac + "/" + s.Started.UTC().Format(time.RFC3339Nano)
+}
+
+// Load restores recent sessions from the boot history store so that
+// they survive restarts. Sessions older than the retention period are
+// not loaded but remain in the history store.
+func (t *SessionTracker) Load() error {
+	if t == nil {
+		return nil
+	}
+
+	items, err := t.History.Scan("")
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.init()
+
+	cutoff := time.Now().Add(-t.retention())
+	for _, item := range items { // Sorted by MAC then start time
+		if item.Value.Updated.Before(cutoff) {
+			continue
+		}
+		session := item.Value
+		t.appendForMac(session.Mac, &session)
+		t.ipToMac[session.ClientIP] = session.Mac
+	}
+
+	return err
+}
+
+// trackBootLoop counts the overlays fetched by a host since it last
+// checked in. Must be called with the lock held.
+func (t *SessionTracker) trackBootLoop(mac string, e StageEvent) {
+	if mac == "" || e.Failed() {
+		return
+	}
+
+	switch e.Stage {
+	case StageApkovl:
+		t.overlays[mac]++
+		count := t.overlays[mac]
+		if count < t.loopThreshold() {
+			return
+		}
+		if count == t.loopThreshold() {
+			bootLoopDetectedMetric.Inc()
+			bootLoopHostsMetric.Inc()
+			t.Writeback.BootFailed(mac, fmt.Sprintf("host has fetched %d overlays without checking in, possible boot loop", count))
+		}
+		if t.Logger != nil {
+			t.Logger.Warn("Possible boot loop, host is fetching overlays without checking in",
+				zap.String("mac", mac),
+				zap.Int("overlays_since_checkin", count),
+			)
+		}
+	case StageCheckin:
+		if t.overlays[mac] >= t.loopThreshold() {
+			bootLoopHostsMetric.Dec()
+			if t.Logger != nil {
+				t.Logger.Info("Host in boot loop has checked in", zap.String("mac", mac))
+			}
+		}
+		delete(t.overlays, mac)
+	}
+}
+
+// CheckIn records the check-in of a host that has finished booting. If
+// the host did not report a distribution then the distribution from its
+// current boot session is used. Returns the recorded check-in.
+func (t *SessionTracker) CheckIn(mac string, c CheckIn) CheckIn {
+	if t == nil {
+		return c
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.init()
+
+	if s := t.currentForMac(mac); c.Distro == "" && s != nil {
+		c.Distro = s.Distro
+	}
+	t.checkins[mac] = c
+
+	return c
+}
+
+// CurrentDistro returns the distribution being booted in the current
+// session for a host, if known
+func (t *SessionTracker) CurrentDistro(mac string) string {
+	if t == nil {
+		return ""
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if s := t.currentForMac(mac); s != nil {
+		return s.Distro
+	}
+	return ""
+}
+
+// LastOverlay returns the time and client address of the last APKOVL
+// fetch by a host
+func (t *SessionTracker) LastOverlay(mac string) (time.Time, string, bool) {
+	if t == nil {
+		return time.Time{}, "", false
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	sessions := t.sessions[mac]
+	for i := len(sessions) - 1; i >= 0; i-- {
+		stages := sessions[i].Stages
+		for j := len(stages) - 1; j >= 0; j-- {
+			if stages[j].Stage == StageApkovl && !stages[j].Failed() {
+				return stages[j].Time, stages[j].ClientIP, true
+			}
+		}
+	}
+	return time.Time{}, "", false
+}
+
+// LastCheckIn returns the most recent check-in for a host
+func (t *SessionTracker) LastCheckIn(mac string) (CheckIn, bool) {
+	if t == nil {
+		return CheckIn{}, false
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	c, ok := t.checkins[mac]
+	return c, ok
+}
+
+// OverlaysSinceCheckIn returns the number of overlays a host has fetched
+// since it last checked in and if that count indicates a boot loop
+func (t *SessionTracker) OverlaysSinceCheckIn(mac string) (int, bool) {
+	if t == nil {
+		return 0, false
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	count := t.overlays[mac]
+	return count, count >= t.loopThreshold()
+}
+
+// prune drops sessions that have not been updated within the retention
+// period and returns copies of the sessions that have timed out with
+// events that were not saved. Must be called with the lock held.
+func (t *SessionTracker) prune(now time.Time) (timedOut []BootSession) {
+	if now.Sub(t.lastPrune) < sessionPruneInterval {
+		return nil
+	}
+	t.lastPrune = now
+
+	cutoff := now.Add(-t.retention())
+	for mac, sessions := range t.sessions {
+		for _, s := range sessions {
+			if s.unsaved && now.Sub(s.Updated) > t.timeout() {
+				s.unsaved = false
+				timedOut = append(timedOut, copySession(s))
+			}
+		}
+
+		sessions = slices.DeleteFunc(sessions, func(s *BootSession) bool {
+			return s.Updated.Before(cutoff)
+		})
+		if len(sessions) == 0 {
+			delete(t.sessions, mac)
+		} else {
+			t.sessions[mac] = sessions
+		}
+	}
+
+	for ip, s := range t.ipSessions {
+		if s.Updated.Before(cutoff) {
+			delete(t.ipSessions, ip)
+		}
+	}
+
+	for mac, count := range t.overlays {
+		if _, ok := t.sessions[mac]; !ok {
+			if count >= t.loopThreshold() {
+				bootLoopHostsMetric.Dec()
+			}
+			delete(t.overlays, mac)
+			delete(t.checkins, mac)
+		}
+	}
+
+	for ip, mac := range t.ipToMac {
+		if _, ok := t.sessions[mac]; !ok {
+			delete(t.ipToMac, ip)
+		}
+	}
+
+	return timedOut
+}
+
+// MacForIP returns the MAC address of the host that most recently made
+// a request from the IP address
+func (t *SessionTracker) MacForIP(ip string) (string, bool) {
+	if t == nil {
+		return "", false
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	mac, ok := t.ipToMac[ip]
+	return mac, ok
+}
+
+func copySession(s *BootSession) BootSession {
+	c := *s
+	c.Stages = slices.Clone(s.Stages)
+	return c
+}
+
+// ForMac returns copies of the sessions for a MAC address, newest first
+func (t *SessionTracker) ForMac(mac string) []BootSession {
+	if t == nil {
+		return nil
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	sessions := t.sessions[mac]
+	out := make([]BootSession, 0, len(sessions))
+	for i := len(sessions) - 1; i >= 0; i-- {
+		out = append(out, copySession(sessions[i]))
+	}
+	return out
+}
+
+// Latest returns a copy of the most recent session for each host,
+// including hosts only known by IP, most recently updated first
+func (t *SessionTracker) Latest() []BootSession {
+	if t == nil {
+		return nil
+	}
+
+	t.Lock()
+	out := []BootSession{}
+	for _, sessions := range t.sessions {
+		out = append(out, copySession(sessions[len(sessions)-1]))
+	}
+	for _, s := range t.ipSessions {
+		out = append(out, copySession(s))
+	}
+	t.Unlock()
+
+	slices.SortFunc(out, func(a, b BootSession) int {
+		return b.Updated.Compare(a.Updated)
+	})
+	return out
+}
+
+// stageWriter captures the status and size of an HTTP response
+type stageWriter struct {
+	http.ResponseWriter
+	code     int
+	bytesOut int64
+}
+
+func (s *stageWriter) Write(data []byte) (int, error) {
+	i, err := s.ResponseWriter.Write(data)
+	s.bytesOut += int64(i)
+	return i, err
+}
+
+func (s *stageWriter) WriteHeader(statusCode int) {
+	s.code = statusCode
+	s.ResponseWriter.WriteHeader(statusCode)
+}
+
+// ReadFrom passes io.Copy through to the underlying writer so that file
+// downloads can still use sendfile
+func (s *stageWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(s.ResponseWriter, r)
+	s.bytesOut += n
+	return n, err
+}
+
+func (s *stageWriter) Flush() {
+	http.NewResponseController(s.ResponseWriter).Flush()
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer
+func (s *stageWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// trackHttp records each request handled by next as a boot stage. The
+// stage function classifies the request and can return the slug of the
+// distribution being booted, if known.
+func (t *SessionTracker) trackHttp(stage func(*http.Request) (BootStage, string), next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &stageWriter{ResponseWriter: w, code: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(sw, r)
+
+		s, distro := stage(r)
+		t.Record(r.PathValue("mac"), distro, StageEvent{
+			Stage:    s,
+			Time:     start,
+			Duration: time.Since(start),
+			Bytes:    sw.bytesOut,
+			Path:     r.URL.Path,
+			ClientIP: clientIP(r),
+			Status:   sw.code,
+		})
+	})
+}
+
+// TrackHttp records each request handled by next as a boot stage
+func (t *SessionTracker) TrackHttp(stage BootStage, next http.Handler) http.Handler {
+	return t.trackHttp(func(*http.Request) (BootStage, string) { return stage, "" }, next)
+}
+
+// TrackDistroFiles records requests for distribution files, classifying
+// them as kernel, initrd or other file fetches using the catalog
+func (t *SessionTracker) TrackDistroFiles(c *DistributionCatalog, next http.Handler) http.Handler {
+	return t.trackHttp(func(r *http.Request) (BootStage, string) {
+		return c.StageForPath(r.URL.Path)
+	}, next)
+}
@@ -0,0 +1,251 @@
+package app
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	snapshotFilesMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "netboot_snapshot_files",
+		Help: "Distribution files held open for serving, including superseded files",
+	})
+	snapshotRetiredServedMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_snapshot_retired_served",
+		Help: "Requests served from distribution files that were removed or replaced on disk",
+	})
+)
+
+// DefaultSnapshotGrace is how long files that were removed or replaced
+// on disk remain available to clients that are already booting them
+const DefaultSnapshotGrace = time.Hour
+
+// snapshotFile is a distribution file held open as it was when the
+// catalog was scanned
+type snapshotFile struct {
+	path    string
+	file    fs.File
+	ra      io.ReaderAt
+	info    fs.FileInfo
+	image   *isoImage // Image containing the file, if any
+	release func()    // Releases the image, if any
+	retired time.Time // Set once the file has been superseded
+	refs    int       // Open views, guarded by the snapshot lock
+}
+
+func (f *snapshotFile) close() {
+	f.file.Close()
+	if f.release != nil {
+		f.release()
+	}
+}
+
+// unchanged returns true if info describes the same file on disk. The
+// snapshot is taken from the file system so a file replaced by a rename
+// is a different file even if it has the same size and time.
+func (f *snapshotFile) unchanged(info fs.FileInfo, image *isoImage) bool {
+	if f.image != image || f.info.Size() != info.Size() || !f.info.ModTime().Equal(info.ModTime()) {
+		return false
+	}
+	if f.info.Sys() != nil && info.Sys() != nil {
+		return os.SameFile(f.info, info)
+	}
+	return true
+}
+
+// heldFile is an open view of a snapshot file. Views read with ReadAt
+// so that any number of them can share the held file, which is not
+// closed while any view is open.
+type heldFile struct {
+	*io.SectionReader
+	held     *snapshotFile
+	snapshot *catalogSnapshot
+	once     sync.Once
+}
+
+func (f *heldFile) Stat() (fs.FileInfo, error) { return f.held.info, nil }
+
+func (f *heldFile) Close() error {
+	f.once.Do(func() {
+		f.snapshot.Lock()
+		f.held.refs--
+		f.snapshot.Unlock()
+	})
+	return nil
+}
+
+// catalogSnapshot holds open the files of every distribution found by
+// the most recent scan so that they are served as they were scanned,
+// even if they are later removed or replaced on disk. Files that are no
+// longer part of the scan are kept for a grace period so that clients
+// that already have a boot script can finish fetching its files.
+//
+// Superseded files are closed by expire, which the catalog manager runs
+// every minute, once their grace period ends and no views of them are
+// open. A grace of zero disables snapshots.
+type catalogSnapshot struct {
+	grace   time.Duration
+	current map[string]*snapshotFile
+	retired map[string]*snapshotFile // Newest superseded file for each path
+	closing []*snapshotFile          // Every superseded file not yet closed
+	sync.RWMutex
+}
+
+func newCatalogSnapshot(grace time.Duration) *catalogSnapshot {
+	return &catalogSnapshot{
+		grace:   grace,
+		current: map[string]*snapshotFile{},
+		retired: map[string]*snapshotFile{},
+	}
+}
+
+// distroFiles returns the paths of the files of a distribution that are
+// held by the snapshot. These are the boot files and the files in its
+// directory that are named in its kernel arguments, such as a modloop.
+// Other files, such as install media, are not held.
+func distroFiles(files fs.FS, d *Distribution) []string {
+	paths := []string{}
+	for _, name := range d.BootFiles() {
+		paths = append(paths, path.Join(d.FilesPath(), name))
+	}
+
+	entries, _ := fs.ReadDir(files, d.FilesPath())
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		for _, a := range d.KernelParams {
+			if strings.Contains(a.Value, "/"+e.Name()) || strings.Contains(a.Template, "/"+e.Name()) {
+				paths = append(paths, path.Join(d.FilesPath(), e.Name()))
+				break
+			}
+		}
+	}
+
+	return paths
+}
+
+// update takes a new snapshot of the files of the distros, reusing held
+// files that have not changed, then retires the held files that are no
+// longer current
+func (s *catalogSnapshot) update(files *catalogFS, distros DistroList, now time.Time) {
+	s.RLock()
+	grace, old := s.grace, s.current
+	s.RUnlock()
+
+	current := map[string]*snapshotFile{}
+	if grace > 0 {
+		for _, d := range distros {
+			for _, p := range distroFiles(files, d) {
+				if _, ok := current[p]; ok {
+					continue
+				}
+
+				fd, err := files.Open(p)
+				if err != nil {
+					continue
+				}
+				info, err := fd.Stat()
+				ra, ok := fd.(io.ReaderAt)
+				if err != nil || !ok || !info.Mode().IsRegular() {
+					fd.Close()
+					continue
+				}
+
+				image := files.imageFor(p)
+				if held := old[p]; held != nil && held.unchanged(info, image) {
+					fd.Close()
+					current[p] = held
+					continue
+				}
+
+				held := &snapshotFile{path: p, file: fd, ra: ra, info: info, image: image}
+				if image != nil {
+					files.holdImage(image)
+					held.release = func() { files.releaseImage(image) }
+				}
+				current[p] = held
+			}
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	for p, held := range s.current {
+		if current[p] == held {
+			continue
+		}
+		held.retired = now
+		s.retired[p] = held
+		s.closing = append(s.closing, held)
+	}
+
+	s.current = current
+	s.expireLocked(now)
+}
+
+// expire closes the retired files that are past their grace period
+func (s *catalogSnapshot) expire(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	s.expireLocked(now)
+}
+
+func (s *catalogSnapshot) expireLocked(now time.Time) {
+	s.closing = slices.DeleteFunc(s.closing, func(held *snapshotFile) bool {
+		if now.Before(held.retired.Add(s.grace)) {
+			return false
+		}
+		if s.retired[held.path] == held {
+			delete(s.retired, held.path)
+		}
+		if held.refs > 0 {
+			return false
+		}
+		held.close()
+		return true
+	})
+	snapshotFilesMetric.Set(float64(len(s.current) + len(s.closing)))
+}
+
+// get returns a view of a held file, preferring the current snapshot.
+// The view must be closed so that the held file can be closed.
+func (s *catalogSnapshot) get(name string, now time.Time) (fs.File, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	held, ok := s.current[name]
+	if !ok {
+		if held, ok = s.retired[name]; !ok || !now.Before(held.retired.Add(s.grace)) {
+			return nil, false
+		}
+		snapshotRetiredServedMetric.Inc()
+	}
+
+	held.refs++
+	return &heldFile{SectionReader: io.NewSectionReader(held.ra, 0, held.info.Size()), held: held, snapshot: s}, true
+}
+
+// snapshotFS serves held files from the snapshot and everything else
+// from the catalog file system
+type snapshotFS struct {
+	files    *catalogFS
+	snapshot *catalogSnapshot
+}
+
+func (f *snapshotFS) Open(name string) (fs.File, error) {
+	if fd, ok := f.snapshot.get(name, time.Now()); ok {
+		return fd, nil
+	}
+	return f.files.Open(name)
+}
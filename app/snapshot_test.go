@@ -0,0 +1,89 @@
+package app
+
+import (
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// closeTrackingFile records whether a held file was closed
+type closeTrackingFile struct {
+	fs.File
+	io.ReaderAt
+	closed bool
+}
+
+func (f *closeTrackingFile) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestCatalogSnapshotExpire(t *testing.T) {
+	const name = "alpine/x86_64/vmlinuz-lts"
+
+	tests := []struct {
+		name       string
+		closeView  bool
+		after      time.Duration
+		wantServed bool
+		wantClosed bool
+	}{
+		{"within grace", false, time.Minute, true, false},
+		{"after grace with open view", false, 2 * time.Hour, false, false},
+		{"after grace", true, 2 * time.Hour, false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mapFS := fstest.MapFS{name: &fstest.MapFile{Data: []byte("kernel")}}
+			fd, err := mapFS.Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, _ := fd.Stat()
+			file := &closeTrackingFile{File: fd, ReaderAt: fd.(io.ReaderAt)}
+
+			now := time.Now()
+			s := newCatalogSnapshot(time.Hour)
+			s.current[name] = &snapshotFile{path: name, file: file, ra: file, info: info}
+
+			view, ok := s.get(name, now)
+			if !ok {
+				t.Fatal("current file not served")
+			}
+
+			// The file is superseded twice, the first retired copy must
+			// stay open while it has a view
+			s.update(newCatalogFS(mapFS, zap.NewNop()), nil, now)
+			s.current[name] = &snapshotFile{path: name, file: &closeTrackingFile{}, info: info}
+			s.update(newCatalogFS(mapFS, zap.NewNop()), nil, now)
+
+			if file.closed {
+				t.Fatal("file closed while retired a second time")
+			}
+
+			if test.closeView {
+				view.Close()
+			}
+			s.expire(now.Add(test.after))
+
+			if _, ok := s.get(name, now.Add(test.after)); ok != test.wantServed {
+				t.Errorf("served = %v, want %v", ok, test.wantServed)
+			}
+			if file.closed != test.wantClosed {
+				t.Errorf("closed = %v, want %v", file.closed, test.wantClosed)
+			}
+
+			if !test.closeView {
+				buf := make([]byte, 6)
+				if _, err := view.(io.Reader).Read(buf); err != nil || string(buf) != "kernel" {
+					t.Errorf("open view read %q, %v", buf, err)
+				}
+			}
+		})
+	}
+}
@@ -1,42 +1,207 @@
 package app
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"io"
 	"io/fs"
+	"path"
+	"strings"
+	"time"
 
+	"github.com/pin/tftp"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 var (
 	tftpServeSuccessMetric = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "netboot_tftp_read_success",
-		Help: "Successful TFTP read responses",
-	}, []string{"filename"})
+		Name: "netboot_tftp_stage_success",
+		Help: "Successful TFTP read responses by boot stage",
+	}, []string{"stage"})
 	tftpServeFailuresMetric = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "netboot_tftp_read_failure",
-		Help: "Failed TFTP read responses",
-	}, []string{"filename"})
+		Name: "netboot_tftp_stage_failure",
+		Help: "Failed TFTP read responses by boot stage",
+	}, []string{"stage"})
 )
 
+// tftpRenderTimeout bounds the Netbox lookup when rendering boot loader
+// configuration for a TFTP request
+const tftpRenderTimeout = 10 * time.Second
+
+// TftpHandler serves the embedded boot loader binaries and any files in
+// the optional Files directory, which take precedence. If Grub or Pxe
+// are set, boot loader configuration is rendered for requests within
+// grub/ and pxelinux.cfg/. If Catalog is set, distribution files are
+// served within distros/ for boot loaders that can not use HTTP. If Pi
+// is set, requests within a Raspberry Pi serial number directory are
+// served by it.
 type TftpHandler struct {
-	Root fs.FS
+	Root     fs.FS
+	Files    fs.FS
+	Grub     *GrubRendererHandler
+	Pxe      *PxeRendererHandler
+	Pi       *RaspberryPiHandler
+	Catalog  *DistributionCatalog
+	Sessions *SessionTracker
+}
+
+// tftpFile is the content for a TFTP request and how the request is
+// recorded in the boot session
+type tftpFile struct {
+	io.Reader
+	io.Closer
+	size   int64
+	mac    string
+	distro string
+	stage  BootStage
 }
 
-func (h *TftpHandler) HandleRead(filename string, rf io.ReaderFrom) (int64, error) {
-	file, err := h.Root.Open(filename)
+func (h *TftpHandler) open(filename, clientIP string) (*tftpFile, error) {
+	name := strings.TrimPrefix(path.Clean("/"+filename), "/")
+	dir, file := path.Split(name)
+
+	if h.Grub != nil && dir == "grub/" {
+		if _, ok := ParseGrubConfigName(file); ok {
+			return renderTftp(StageGrubConfig, func(ctx context.Context) ([]byte, string, error) {
+				return h.Grub.RenderConfig(ctx, file, clientIP)
+			})
+		}
+	}
+
+	if h.Pxe != nil && dir == PxeConfigDir+"/" {
+		if _, _, ok := ParsePxeConfigName(file); ok {
+			return renderTftp(StagePxeConfig, func(ctx context.Context) ([]byte, string, error) {
+				return h.Pxe.RenderConfig(ctx, file, clientIP)
+			})
+		}
+	}
+
+	if serial, file, ok := ParsePiPath(name); ok && h.Pi != nil {
+		return h.Pi.open(serial, file, clientIP)
+	}
+
+	if rel, ok := strings.CutPrefix(name, "distros/"); ok && h.Catalog != nil {
+		stage, distro := h.Catalog.StageForPath("/" + name)
+		f, err := openTftp(h.Catalog, rel)
+		if f == nil {
+			f = &tftpFile{}
+		}
+		f.stage, f.distro = stage, distro
+		return f, err
+	}
+
+	for _, root := range []fs.FS{h.Files, h.Root} {
+		if root == nil {
+			continue
+		}
+
+		f, err := openTftp(root, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return &tftpFile{stage: StageTftp}, err
+		}
+		f.stage = StageTftp
+		return f, nil
+	}
+
+	return &tftpFile{stage: StageTftp}, fs.ErrNotExist
+}
+
+// openTftp opens a regular file for a TFTP request
+func openTftp(fsys fs.FS, name string) (*tftpFile, error) {
+	fd, err := fsys.Open(name)
 	if err != nil {
-		tftpServeFailuresMetric.WithLabelValues(filename).Inc()
+		return nil, err
+	}
+
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		fd.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return &tftpFile{Reader: fd, Closer: fd, size: info.Size()}, nil
+}
+
+// renderTftp renders boot loader configuration for a TFTP request
+func renderTftp(stage BootStage, render func(context.Context) ([]byte, string, error)) (*tftpFile, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tftpRenderTimeout)
+	defer cancel()
+
+	buf, mac, err := render(ctx)
+	if err != nil {
+		return &tftpFile{mac: mac, stage: stage}, err
+	}
+
+	r := bytes.NewReader(buf)
+	return &tftpFile{Reader: r, Closer: io.NopCloser(r), size: r.Size(), mac: mac, stage: stage}, nil
+}
+
+func (h *TftpHandler) HandleRead(filename string, rf io.ReaderFrom) (n int64, err error) {
+	start := time.Now()
+
+	clientIP := ""
+	transfer, isTransfer := rf.(tftp.OutgoingTransfer)
+	if isTransfer {
+		addr := transfer.RemoteAddr()
+		clientIP = addr.IP.String()
+	}
+
+	file, err := h.open(filename, clientIP)
+	defer func() {
+		h.recordSession(filename, clientIP, file, start, n, err)
+	}()
+	// File names include MAC addresses, IP addresses and serial numbers
+	// so metrics are labeled by stage to keep the number of series small
+	if err != nil {
+		tftpServeFailuresMetric.WithLabelValues(string(file.stage)).Inc()
 		return 0, err
 	}
 	defer file.Close()
 
-	n, err := rf.ReadFrom(file)
+	// The file is wrapped so the TFTP server can not seek it to find the
+	// size for clients that ask for it, such as PXELINUX
+	if isTransfer {
+		transfer.SetSize(file.size)
+	}
+
+	n, err = rf.ReadFrom(file)
 	if err != nil {
-		tftpServeFailuresMetric.WithLabelValues(filename).Inc()
+		tftpServeFailuresMetric.WithLabelValues(string(file.stage)).Inc()
 		return 0, err
 	}
 
-	tftpServeSuccessMetric.WithLabelValues(filename).Inc()
+	tftpServeSuccessMetric.WithLabelValues(string(file.stage)).Inc()
 	return n, nil
 }
+
+// recordSession records the transfer in the boot session for the client.
+// TFTP requests have no MAC address so sessions are tracked by IP until
+// the client makes a request that includes its MAC, such as for a per
+// host boot loader configuration.
+func (h *TftpHandler) recordSession(filename, clientIP string, file *tftpFile, start time.Time, n int64, err error) {
+	if clientIP == "" {
+		return
+	}
+
+	e := StageEvent{
+		Stage:    file.stage,
+		Time:     start,
+		Duration: time.Since(start),
+		Bytes:    n,
+		Path:     filename,
+		ClientIP: clientIP,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	h.Sessions.Record(file.mac, file.distro, e)
+}
@@ -1,7 +1,7 @@
 package app
 
 import (
-	"os"
+	"io/fs"
 
 	"gopkg.in/yaml.v2"
 )
@@ -11,8 +11,8 @@ type VarsConfig struct {
 	ProductVars map[string]map[string]string `yaml:"product_vars"`
 }
 
-func LoadVarsConfigYaml(filename string) (*VarsConfig, error) {
-	fd, err := os.Open(filename)
+func LoadVarsConfigYaml(f fs.FS, path string) (*VarsConfig, error) {
+	fd, err := f.Open(path)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,96 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"code.crute.us/mcrute/netboot-server/netboxconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var (
+	writebackSuccessMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "netboot_netbox_writeback_success",
+		Help: "Successful writes of boot results to Netbox",
+	}, []string{"kind"})
+	writebackFailureMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "netboot_netbox_writeback_failure",
+		Help: "Failed writes of boot results to Netbox",
+	}, []string{"kind"})
+)
+
+const writebackTimeout = 30 * time.Second
+
+// NetboxWriteback records boot results on the Netbox device for a host.
+// Successful boots update the last_netboot_at, netboot_distro and
+// netboot_server custom fields, which must exist in Netbox. Failures are
+// optionally added to the device journal. Writes happen in the
+// background so they never delay a booting host. A nil NetboxWriteback
+// is valid and writes nothing.
+type NetboxWriteback struct {
+	Logger          *zap.Logger
+	Coordinator     *netboxconfig.ConfigCoordinator
+	Writer          *netboxconfig.NetboxWriter
+	ServerName      string
+	JournalFailures bool
+}
+
+func (n *NetboxWriteback) async(mac, kind string, fn func(context.Context, *netboxconfig.RawConfig) error) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), writebackTimeout)
+		defer cancel()
+
+		cfg, err := n.Coordinator.GetHost(ctx, mac)
+		if err != nil {
+			// Hosts that aren't in Netbox have nowhere to write to
+			return
+		}
+
+		if err := fn(ctx, cfg); err != nil {
+			writebackFailureMetric.WithLabelValues(kind).Inc()
+			n.Logger.Error("Error writing boot result to Netbox",
+				zap.String("mac", mac),
+				zap.String("kind", kind),
+				zap.Error(err),
+			)
+			return
+		}
+
+		writebackSuccessMetric.WithLabelValues(kind).Inc()
+	}()
+}
+
+// BootSucceeded records that a host was issued an overlay or checked in
+// after booting a distribution
+func (n *NetboxWriteback) BootSucceeded(mac, distro string) {
+	if n == nil {
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	n.async(mac, "custom_fields", func(ctx context.Context, cfg *netboxconfig.RawConfig) error {
+		fields := map[string]any{
+			"last_netboot_at": now,
+			"netboot_server":  n.ServerName,
+		}
+		if distro != "" {
+			fields["netboot_distro"] = distro
+		}
+		return n.Writer.UpdateDeviceCustomFields(ctx, cfg.ID, fields)
+	})
+}
+
+// BootFailed adds a journal entry describing a boot failure, if journal
+// entries for failures are enabled
+func (n *NetboxWriteback) BootFailed(mac, message string) {
+	if n == nil || !n.JournalFailures {
+		return
+	}
+
+	n.async(mac, "journal", func(ctx context.Context, cfg *netboxconfig.RawConfig) error {
+		return n.Writer.AddDeviceJournalEntry(ctx, cfg.ID, "warning",
+			"Netboot server "+n.ServerName+": "+message)
+	})
+}
@@ -18,6 +18,16 @@ set {{ $k }} {{ $v }}
 iseq ${product} {{ $prod }} && set {{ $k }} {{ $v }} ||
 {{ end -}}
 {{ end }}
+{{- with .NextBoot }}
+#
+# One-time boot override, falls through to the menu if the boot fails
+#
+echo Booting one-time override {{ .Slug }}
+imgfree
+{{- $path := .DistroPath }}
+kernel {{ $path }}/{{ .KernelName }} {{ .KernelCommandLine }} {{ range .Initrds }}&& initrd {{ $path }}/{{ . }} {{ end }}&& boot ||
+echo One-time boot override failed, continuing to menu
+{{ end }}
 
 #
 # Attempt to pick a boot menu based on machine architecture
@@ -35,10 +45,10 @@ menu Boot Menu
 item --gap Operating Systems
 
 {{ range .X86Distros }}
-item {{ .Slug }} ${space} {{ .Name }} {{ .FullVersion }} ({{ .Architecture }})
+item {{ .Slug }} ${space} {{ .DisplayName }}
 {{- end }}
 {{- range .ARM64Distros }}
-item {{ .Slug }} ${space} {{ .Name }} {{ .FullVersion }} ({{ .Architecture }})
+item {{ .Slug }} ${space} {{ .DisplayName }}
 {{- end }}
 
 item --gap Utilities
@@ -59,7 +69,7 @@ menu Boot Menu
 item --gap Operating Systems
 
 {{- range .ARM64Distros }}
-item {{ if .Default }}--default{{ end }} {{ .Slug }} ${space} {{ .Name }} {{ .FullVersion }} ({{ .Architecture }})
+item {{ if .Default }}--default{{ end }} {{ .Slug }} ${space} {{ .DisplayName }}
 {{- end }}
 
 item --gap Utilities
@@ -80,7 +90,7 @@ menu Boot Menu
 item --gap Operating Systems
 
 {{ range .X86Distros }}
-item {{ if .Default }}--default{{ end }} {{ .Slug }} ${space} {{ .Name }} {{ .FullVersion }} ({{ .Architecture }})
+item {{ if .Default }}--default{{ end }} {{ .Slug }} ${space} {{ .DisplayName }}
 {{- end }}
 
 item --gap Utilities
@@ -95,10 +105,16 @@ choose --timeout 10000 item && goto ${item}
 # x86_64 Distributions
 #
 {{ range .X86Distros }}
+{{- range .Aliases }}
+:{{ . }}
+{{- end }}
 :{{ .Slug }}
 imgfree
 kernel {{ .DistroPath }}/{{ .KernelName }} {{ .KernelCommandLine }}
-initrd {{ .DistroPath }}/{{ .InitrdName }}
+{{- $path := .DistroPath }}
+{{- range .Initrds }}
+initrd {{ $path }}/{{ . }}
+{{- end }}
 boot
 clear menu
 exit 0
@@ -108,10 +124,16 @@ exit 0
 # ARM64 Distributions
 #
 {{ range .ARM64Distros }}
+{{- range .Aliases }}
+:{{ . }}
+{{- end }}
 :{{ .Slug }}
 imgfree
 kernel {{ .DistroPath }}/{{ .KernelName }} {{ .KernelCommandLine }}
-initrd {{ .DistroPath }}/{{ .InitrdName }}
+{{- $path := .DistroPath }}
+{{- range .Initrds }}
+initrd {{ $path }}/{{ . }}
+{{- end }}
 boot
 clear menu
 exit 0
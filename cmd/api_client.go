@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"code.crute.us/mcrute/netboot-server/app"
+	"github.com/spf13/cobra"
+)
+
+// apiClient is a minimal client for the server JSON API used by the
+// management subcommands
+type apiClient struct {
+	Server string
+	Token  string
+	Client *http.Client
+}
+
+// addApiClientFlags adds the flags needed to reach the server API to a
+// subcommand. The token defaults to the NETBOOT_API_TOKEN environment
+// variable so that it does not need to be passed on the command line.
+func addApiClientFlags(c *cobra.Command) {
+	c.PersistentFlags().String("server", app.DefaultConfig.HttpServer, "HTTP/S URL to the netboot server")
+	c.PersistentFlags().String("token", os.Getenv("NETBOOT_API_TOKEN"), "API bearer token")
+}
+
+func newApiClient(c *cobra.Command) (*apiClient, error) {
+	server, err := c.Flags().GetString("server")
+	if err != nil {
+		return nil, err
+	}
+	if server == "" {
+		return nil, fmt.Errorf("--server is required")
+	}
+
+	token, err := c.Flags().GetString("token")
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiClient{
+		Server: strings.TrimSuffix(server, "/"),
+		Token:  token,
+		Client: http.DefaultClient,
+	}, nil
+}
+
+// Do sends a request to the API, encoding in as the JSON body if it is
+// not nil and decoding the response into out if it is not nil. Non-2xx
+// responses are returned as errors using the API error message.
+func (c *apiClient) Do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		buf := &bytes.Buffer{}
+		if err := json.NewEncoder(buf).Encode(in); err != nil {
+			return err
+		}
+		body = buf
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.Server+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	res, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(res.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("%s %s: %s: %s", method, path, res.Status, apiErr.Error)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, res.Status)
+	}
+
+	if out != nil && res.StatusCode != http.StatusNoContent {
+		return json.NewDecoder(res.Body).Decode(out)
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"code.crute.us/mcrute/netboot-server/app"
+	"code.crute.us/mcrute/netboot-server/importer"
+	"code.crute.us/mcrute/netboot-server/remotefs"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func NewImportCommand() *cobra.Command {
+	importCmd := &cobra.Command{
+		Use:   "import <tarball|iso|directory>",
+		Short: "Import a release into the distribution tree",
+		Long: fmt.Sprintf(`Import a release from a netboot tarball, ISO9660 image or directory
+into the distribution tree. Supported release layouts: %s.
+
+The version and architecture are detected from the release where
+possible. If the distribution has no distro.yaml one is created,
+otherwise it is checked against the imported files.`, strings.Join(importer.Layouts(), ", ")),
+		Args: cobra.ExactArgs(1),
+		RunE: importRelease,
+	}
+	importCmd.Flags().String("distro-files", app.DefaultConfig.DistroFilesPath, "Path to distribution file tree")
+	importCmd.Flags().String("distro", "", "Short name of the distribution to import into")
+	importCmd.Flags().String("arch", "", "Architecture of the release, detected if not set")
+	importCmd.Flags().String("version", "", "Version of the release, detected if not set")
+	importCmd.Flags().String("name", "", "Display name for a new distro.yaml")
+	importCmd.MarkFlagRequired("distro")
+
+	return importCmd
+}
+
+func importRelease(c *cobra.Command, args []string) error {
+	root, _ := c.Flags().GetString("distro-files")
+	distro, _ := c.Flags().GetString("distro")
+	arch, _ := c.Flags().GetString("arch")
+	version, _ := c.Flags().GetString("version")
+	name, _ := c.Flags().GetString("name")
+
+	if remotefs.IsRemote(root) {
+		return fmt.Errorf("distro-files must be a local path, not %s", root)
+	}
+
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		log.Fatalf("Error configuring zap logger: %s", err)
+	}
+	defer logger.Sync()
+
+	i := &importer.Importer{
+		Root:   root,
+		Logger: logger,
+	}
+
+	result, err := i.Import(importer.Options{
+		Source:       args[0],
+		Distro:       distro,
+		Architecture: arch,
+		Version:      version,
+		Name:         name,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.Println("Imported", result.Path, "using the", result.Layout, "layout")
+	c.Println("  kernel:", result.Kernel)
+	c.Println("  initrds:", strings.Join(result.Initrds, ", "))
+	if len(result.Extras) > 0 {
+		c.Println("  extras:", strings.Join(result.Extras, ", "))
+	}
+	if result.CreatedDistroYaml {
+		c.Println("Created", distro+"/distro.yaml, review it before rescanning the catalog")
+	}
+
+	return nil
+}
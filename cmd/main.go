@@ -10,12 +10,16 @@ import (
 	"path/filepath"
 	"sync"
 	"syscall"
+	"time"
 
 	"code.crute.us/mcrute/golib/cli"
 	"code.crute.us/mcrute/golib/clients/netbox/v4"
 	"code.crute.us/mcrute/golib/secrets"
 	"code.crute.us/mcrute/netboot-server/app"
 	"code.crute.us/mcrute/netboot-server/netboxconfig"
+	"code.crute.us/mcrute/netboot-server/remotefs"
+	"code.crute.us/mcrute/netboot-server/store"
+	"code.crute.us/mcrute/netboot-server/upstream"
 	"code.crute.us/mcrute/netboot-server/util"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
@@ -26,18 +30,25 @@ import (
 type App struct {
 	TftpBoot     fs.FS
 	IpxeTemplate string
+	GrubTemplate string
+	PxeTemplate  string
+	Web          fs.FS
 }
 
-func getNetboxKey(ctx context.Context, path string) (string, error) {
+func newVaultClient(ctx context.Context) (*secrets.VaultClient, error) {
 	vc, err := secrets.NewVaultClient(&secrets.VaultClientConfig{})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if err = vc.Authenticate(ctx); err != nil {
-		return "", err
+		return nil, err
 	}
 
+	return vc, nil
+}
+
+func getNetboxKey(ctx context.Context, vc *secrets.VaultClient, path string) (string, error) {
 	key := &secrets.ApiKey{}
 	if _, err := vc.Secret(ctx, path, &key); err != nil {
 		return "", err
@@ -73,15 +84,61 @@ func (a *App) Main(c *cobra.Command, args []string) {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT)
 	defer cancel()
 
+	//
+	// Setup State Store
+	//
+	var stateStore *store.Store
+	if appCfg.StateDir != "" {
+		if stateStore, err = store.Open(appCfg.StateDir, logger, store.Buckets...); err != nil {
+			logger.Fatal("Error opening state store", zap.Error(err))
+		}
+		stateStore.ManageAsync(ctx, wg)
+	}
+
+	//
+	// Setup Boot Session Tracker
+	//
+	overrides := &app.NextBootOverrides{
+		Logger: logger,
+		Store:  store.Typed[app.NextBoot](stateStore, store.Overrides),
+	}
+	if err := overrides.Load(); err != nil {
+		logger.Error("Error loading next boot overrides", zap.Error(err))
+	}
+
+	sessions := &app.SessionTracker{
+		Logger:    logger,
+		Overrides: overrides,
+		History:   store.Typed[app.BootSession](stateStore, store.BootHistory),
+	}
+	if err := sessions.Load(); err != nil {
+		logger.Error("Error loading boot history", zap.Error(err))
+	}
+
+	hostTokens := &app.HostTokens{
+		Logger:   logger,
+		Store:    store.Typed[store.Token](stateStore, store.Tokens),
+		Sessions: sessions,
+	}
+	if err := hostTokens.Load(); err != nil {
+		logger.Error("Error loading host tokens", zap.Error(err))
+	}
+
 	//
 	// Setup TFTP Server
 	//
+	tftpHandler := &app.TftpHandler{
+		Root:     util.MustSub(a.TftpBoot, "tftpboot"),
+		Sessions: sessions,
+	}
+	if appCfg.TftpDir != "" {
+		tftpHandler.Files = os.DirFS(appCfg.TftpDir)
+	}
+
 	tftpServer := &util.TftpServer{
-		Addr:   appCfg.BindTftp,
-		Logger: logger,
-		ReadHandler: &app.TftpHandler{
-			Root: util.MustSub(a.TftpBoot, "tftpboot"),
-		},
+		Addr:        appCfg.BindTftp,
+		Logger:      logger,
+		ReadHandler: tftpHandler,
 	}
 
 	//
@@ -98,61 +155,247 @@ func (a *App) Main(c *cobra.Command, args []string) {
 	// Setup Distribution Catalog
 	//
 	catalogErrors := make(chan error, 10)
-	catalog, err := app.LoadDistributionCatalog(os.DirFS(appCfg.DistroFilesPath), catalogErrors, logger)
+	distroFiles, err := remotefs.Open(appCfg.DistroFilesPath)
+	if err != nil {
+		logger.Fatal("Error opening distribution files", zap.Error(err))
+	}
+
+	catalog, err := app.LoadDistributionCatalog(distroFiles, catalogErrors, logger)
 	if err != nil {
 		logger.Fatal("Error creating initial distro catalog", zap.Error(err))
 	}
+	catalog.SetSnapshotGrace(time.Duration(appCfg.SnapshotGrace) * time.Minute)
 	catalog.ManageAsync(ctx, wg)
 
+	if remotefs.IsRemote(appCfg.DistroFilesPath) {
+		if appCfg.DistroFilesMode != "proxy" && appCfg.DistroFilesMode != "redirect" {
+			logger.Fatal("Invalid distro-files-mode, must be proxy or redirect", zap.String("mode", appCfg.DistroFilesMode))
+		}
+
+		var cache *remotefs.DiskCache
+		if appCfg.DistroCacheDir != "" {
+			if cache, err = remotefs.NewDiskCache(appCfg.DistroCacheDir, int64(appCfg.DistroCacheSize)<<20, logger); err != nil {
+				logger.Fatal("Error opening distribution file cache", zap.Error(err))
+			}
+		}
+		catalog.ServeRemote(appCfg.DistroFilesMode == "redirect", cache)
+	}
+
 	//
-	// Setup IPXE Render Handler
+	// Setup Upstream Sync
+	//
+	if appCfg.SyncInterval > 0 {
+		if remotefs.IsRemote(appCfg.DistroFilesPath) {
+			logger.Fatal("Upstream sync requires a local distro-files path")
+		}
+		syncer := &upstream.Syncer{
+			Root:                  appCfg.DistroFilesPath,
+			Logger:                logger,
+			InsecureSkipSignature: appCfg.InsecureSkipSignature,
+		}
+		syncUpstreamAsync(ctx, wg, syncer, catalog, time.Duration(appCfg.SyncInterval)*time.Hour)
+	}
+
+	//
+	// Setup Netbox Config Coordinator
 	//
-	varsCfg, err := app.LoadVarsConfigYaml(filepath.Join(appCfg.DistroFilesPath, appCfg.VarsConfigFile))
+	vc, err := newVaultClient(ctx)
+	if err != nil {
+		logger.Fatal("Error connecting to Vault", zap.Error(err))
+	}
+
+	netboxKey, err := getNetboxKey(ctx, vc, appCfg.VaultNetboxPath)
+	if err != nil {
+		logger.Fatal("Error getting Netbox key from Vault", zap.Error(err))
+	}
+
+	coordinator := &netboxconfig.ConfigCoordinator{
+		DefaultConfigId: appCfg.NetboxDefaultConfigId,
+		CheckinUrl:      appCfg.HttpServer,
+		Cache: &netboxconfig.OverlayCache{
+			MaxBytes: int64(appCfg.ApkovlCacheSize) << 20,
+		},
+		NetboxClient: &netbox.BasicNetboxClient{
+			NetboxHttpClient: netbox.MustNewNetboxHttpClient(netboxKey, appCfg.NetboxHost),
+		},
+		Secrets: func(ctx context.Context, path string, out any) error {
+			_, err := vc.Secret(ctx, path, out)
+			return err
+		},
+		NetboxCache: store.Typed[store.CachedResponse](stateStore, store.NetboxCache),
+	}
+
+	// Uploaded lbu backups must survive restarts so uploads are only
+	// accepted when there is a state directory
+	if appCfg.StateDir != "" {
+		if coordinator.Lbu, err = netboxconfig.OpenLbuStore(filepath.Join(appCfg.StateDir, "lbu")); err != nil {
+			logger.Fatal("Error opening lbu backup store", zap.Error(err))
+		}
+	}
+
+	//
+	// Setup Netbox Writeback
+	//
+	var writeback *app.NetboxWriteback
+	if appCfg.NetboxWriteback {
+		writeback = &app.NetboxWriteback{
+			Logger:      logger,
+			Coordinator: coordinator,
+			Writer: &netboxconfig.NetboxWriter{
+				Host: appCfg.NetboxHost,
+				Key:  netboxKey,
+			},
+			ServerName:      appCfg.HttpServer,
+			JournalFailures: appCfg.NetboxJournalFailures,
+		}
+	}
+	sessions.Writeback = writeback
+
+	//
+	// Setup Boot Menu
+	//
+	varsCfg, err := app.LoadVarsConfigYaml(distroFiles, appCfg.VarsConfigFile)
 	if err != nil {
 		logger.Fatal("Error loading variables configuration", zap.Error(err))
 	}
 
-	ipxeRendererHandler := &app.IpxeRendererHandler{
+	bootMenu := &app.BootMenu{
 		Logger:       logger,
-		VarsConfig:   varsCfg,
-		NtpServer:    appCfg.NtpServer,
-		HttpServer:   appCfg.HttpServer,
+		Coordinator:  coordinator,
+		Catalog:      catalog,
+		Overrides:    overrides,
 		CatalogWatch: make(chan app.DistroList, 1),
 	}
+	catalog.Watch(bootMenu.CatalogWatch)
+	bootMenu.WatchCatalogAsync(ctx, wg)
+
+	//
+	// Setup IPXE Render Handler
+	//
+	ipxeRendererHandler := &app.IpxeRendererHandler{
+		BootMenu:   bootMenu,
+		VarsConfig: varsCfg,
+		NtpServer:  appCfg.NtpServer,
+		HttpServer: appCfg.HttpServer,
+	}
 	if err := ipxeRendererHandler.ParseTemplate(a.IpxeTemplate); err != nil {
 		logger.Fatal("Error parsing IPXE template", zap.Error(err))
 	}
-	catalog.Watch(ipxeRendererHandler.CatalogWatch)
-	ipxeRendererHandler.WatchCatalogAsync(ctx, wg)
 
 	//
-	// Setup AKOVL Handler
+	// Setup GRUB Render Handler
 	//
-	netboxKey, err := getNetboxKey(ctx, appCfg.VaultNetboxPath)
-	if err != nil {
-		logger.Fatal("Error getting Netbox key from Vault", zap.Error(err))
+	grubRendererHandler := &app.GrubRendererHandler{
+		BootMenu:   bootMenu,
+		VarsConfig: varsCfg,
+		HttpServer: appCfg.HttpServer,
+	}
+	if err := grubRendererHandler.ParseTemplate(a.GrubTemplate); err != nil {
+		logger.Fatal("Error parsing GRUB template", zap.Error(err))
 	}
+	tftpHandler.Grub = grubRendererHandler
 
+	//
+	// Setup PXELINUX Render Handler
+	//
+	pxeRendererHandler := &app.PxeRendererHandler{
+		BootMenu:   bootMenu,
+		VarsConfig: varsCfg,
+		Sessions:   sessions,
+	}
+	if err := pxeRendererHandler.ParseTemplate(a.PxeTemplate); err != nil {
+		logger.Fatal("Error parsing PXELINUX template", zap.Error(err))
+	}
+	tftpHandler.Pxe = pxeRendererHandler
+	tftpHandler.Catalog = catalog
+	tftpHandler.Pi = &app.RaspberryPiHandler{
+		BootMenu:   bootMenu,
+		VarsConfig: varsCfg,
+	}
+
+	//
+	// Setup AKOVL Handler
+	//
 	apkOvlHandler := &app.ApkOvlHandler{
-		Logger: logger,
-		Coordinator: &netboxconfig.ConfigCoordinator{
-			DefaultConfigId: appCfg.NetboxDefaultConfigId,
-			NetboxClient: &netbox.BasicNetboxClient{
-				NetboxHttpClient: netbox.MustNewNetboxHttpClient(netboxKey, appCfg.NetboxHost),
-			},
-		},
+		Logger:      logger,
+		Coordinator: coordinator,
+		Sessions:    sessions,
+		Writeback:   writeback,
+	}
+
+	//
+	// Setup Kickstart and Preseed Handler
+	//
+	installConfigHandler := &app.InstallConfigHandler{
+		Logger:      logger,
+		Coordinator: coordinator,
+		Catalog:     catalog,
+		Sessions:    sessions,
+		HttpServer:  appCfg.HttpServer,
+	}
+
+	//
+	// Setup JSON API Handler
+	//
+	apiHandler := &app.ApiHandler{
+		Logger:      logger,
+		Catalog:     catalog,
+		Coordinator: coordinator,
+		Sessions:    sessions,
+		Overrides:   overrides,
+		Tokens:      hostTokens,
+	}
+
+	//
+	// Setup Dashboard Handler
+	//
+	dashboardHandler := &app.DashboardHandler{
+		Logger:      logger,
+		Catalog:     catalog,
+		Coordinator: coordinator,
+		Renderer:    ipxeRendererHandler,
+		Sessions:    sessions,
+		Files:       util.MustSub(a.Web, "web"),
+	}
+	if err := dashboardHandler.ParseTemplates(); err != nil {
+		logger.Fatal("Error parsing dashboard templates", zap.Error(err))
 	}
 
 	//
 	// Add HTTP Routes
 	//
 	mux.Handle("GET /metrics", promhttp.Handler())
-	mux.Handle("GET /boot.ipxe", &app.IpxeRedirectHandler{HttpServer: appCfg.HttpServer})
-	mux.Handle("GET /{mac}/boot.ipxe", ipxeRendererHandler)
-	mux.Handle("GET /{mac}/apkovl.tar.gz", apkOvlHandler)
-	mux.Handle("GET /distros/*", catalog)
-	mux.Handle("GET /tftpboot/*", http.FileServerFS(a.TftpBoot))
-	mux.Handle("GET /", &app.WebIndexHandler{})
+	mux.Handle("GET /boot.ipxe", sessions.TrackHttp(app.StageIpxeChain, &app.IpxeRedirectHandler{HttpServer: appCfg.HttpServer}))
+	mux.Handle("GET /{mac}/boot.ipxe", sessions.TrackHttp(app.StageIpxeScript, ipxeRendererHandler))
+	mux.Handle("GET /{mac}/apkovl.tar.gz", sessions.TrackHttp(app.StageApkovl, apkOvlHandler))
+	mux.Handle("GET /{mac}/cloud-init/{file}", sessions.TrackHttp(app.StageCloudInit, &app.CloudInitHandler{Logger: logger, Coordinator: coordinator}))
+	mux.Handle("GET /{mac}/ks.cfg", sessions.TrackHttp(app.StageInstallConfig, installConfigHandler))
+	mux.Handle("GET /{mac}/preseed.cfg", sessions.TrackHttp(app.StageInstallConfig, installConfigHandler))
+	mux.Handle("GET /{mac}/ignition.json", sessions.TrackHttp(app.StageIgnition, &app.IgnitionHandler{Logger: logger, Coordinator: coordinator}))
+	mux.Handle("GET /{mac}/alpine-answers", sessions.TrackHttp(app.StageAlpineAnswers, &app.AlpineAnswersHandler{Logger: logger, Coordinator: coordinator}))
+	mux.Handle("POST /{mac}/checkin", sessions.TrackHttp(app.StageCheckin, &app.CheckinHandler{Logger: logger, Sessions: sessions, Tokens: hostTokens, Writeback: writeback}))
+	mux.Handle("POST /{mac}/lbu", sessions.TrackHttp(app.StageLbuUpload, &app.LbuUploadHandler{Logger: logger, Store: coordinator.Lbu, Tokens: hostTokens}))
+	mux.HandleFunc("GET /api/v1/distros", apiHandler.ListDistros)
+	mux.HandleFunc("GET /api/v1/distros/{slug}", apiHandler.GetDistro)
+	mux.Handle("POST /api/v1/catalog/rescan", app.RequireToken(appCfg.ApiToken, http.HandlerFunc(apiHandler.Rescan)))
+	mux.Handle("GET /api/v1/hosts/{mac}", app.RequireToken(appCfg.ApiToken, http.HandlerFunc(apiHandler.GetHost)))
+	mux.Handle("GET /api/v1/hosts/{mac}/next-boot", app.RequireToken(appCfg.ApiToken, http.HandlerFunc(apiHandler.GetNextBoot)))
+	mux.Handle("PUT /api/v1/hosts/{mac}/next-boot", app.RequireToken(appCfg.ApiToken, http.HandlerFunc(apiHandler.SetNextBoot)))
+	mux.Handle("DELETE /api/v1/hosts/{mac}/next-boot", app.RequireToken(appCfg.ApiToken, http.HandlerFunc(apiHandler.ClearNextBoot)))
+	mux.Handle("DELETE /api/v1/hosts/{mac}/token", app.RequireToken(appCfg.ApiToken, http.HandlerFunc(apiHandler.ResetToken)))
+	mux.Handle("GET /ui/static/", dashboardHandler.Static())
+	mux.HandleFunc("GET /ui/hosts", dashboardHandler.HostSearch)
+	mux.Handle("GET /ui/hosts/{mac}", app.RequireToken(appCfg.ApiToken, http.HandlerFunc(dashboardHandler.Host)))
+	mux.HandleFunc("GET /{$}", dashboardHandler.Index)
+
+	// File trees and GRUB configs conflict with the per-MAC routes
+	// (/distros/boot.ipxe matches both) so they are served by a second mux
+	// that handles everything the first one does not match
+	files := http.NewServeMux()
+	files.Handle("GET /distros/", sessions.TrackDistroFiles(catalog, catalog))
+	files.Handle("GET /tftpboot/", http.FileServerFS(a.TftpBoot))
+	files.Handle("GET /grub/{file}", sessions.TrackHttp(app.StageGrubConfig, grubRendererHandler))
+	mux.Handle("GET /", files)
 
 	//
 	// Run Servers
@@ -179,10 +422,13 @@ func (a *App) Main(c *cobra.Command, args []string) {
 	}
 }
 
-func CmdMain(tftpboot fs.FS, ipxeTemplate string) {
+func CmdMain(tftpboot fs.FS, ipxeTemplate, grubTemplate, pxeTemplate string, web fs.FS) {
 	cmd := &App{
 		TftpBoot:     tftpboot,
 		IpxeTemplate: ipxeTemplate,
+		GrubTemplate: grubTemplate,
+		PxeTemplate:  pxeTemplate,
+		Web:          web,
 	}
 
 	rootCmd := &cobra.Command{
@@ -192,6 +438,10 @@ func CmdMain(tftpboot fs.FS, ipxeTemplate string) {
 	}
 	cli.AddFlags(rootCmd, &app.Config{}, app.DefaultConfig, "")
 
+	rootCmd.AddCommand(NewNextBootCommand())
+	rootCmd.AddCommand(NewSyncCommand())
+	rootCmd.AddCommand(NewImportCommand())
+
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatalf("Error running root command: %s", err)
 	}
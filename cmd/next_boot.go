@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"code.crute.us/mcrute/netboot-server/app"
+	"github.com/spf13/cobra"
+)
+
+func NewNextBootCommand() *cobra.Command {
+	nextBootCmd := &cobra.Command{
+		Use:   "next-boot",
+		Short: "Manage one-time next boot overrides for hosts",
+	}
+	addApiClientFlags(nextBootCmd)
+
+	showCmd := &cobra.Command{
+		Use:   "show <mac>",
+		Short: "Show the next boot override for a host",
+		Args:  cobra.ExactArgs(1),
+		RunE:  showNextBoot,
+	}
+
+	setCmd := &cobra.Command{
+		Use:   "set <mac> <distro>",
+		Short: "Boot a host into a distribution on its next boot only",
+		Args:  cobra.ExactArgs(2),
+		RunE:  setNextBoot,
+	}
+	setCmd.Flags().StringArray("arg", nil, "Extra kernel argument as key=value or key, may be repeated")
+	setCmd.Flags().Duration("expires", app.DefaultNextBootExpiry, "Time after which the override is discarded if unused")
+
+	clearCmd := &cobra.Command{
+		Use:   "clear <mac>",
+		Short: "Remove the next boot override for a host",
+		Args:  cobra.ExactArgs(1),
+		RunE:  clearNextBoot,
+	}
+
+	nextBootCmd.AddCommand(showCmd, setCmd, clearCmd)
+	return nextBootCmd
+}
+
+func nextBootPath(mac string) string {
+	return fmt.Sprintf("/api/v1/hosts/%s/next-boot", mac)
+}
+
+func printJson(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func showNextBoot(c *cobra.Command, args []string) error {
+	client, err := newApiClient(c)
+	if err != nil {
+		return err
+	}
+
+	var out map[string]any
+	if err := client.Do(c.Context(), http.MethodGet, nextBootPath(args[0]), nil, &out); err != nil {
+		return err
+	}
+	return printJson(out)
+}
+
+func setNextBoot(c *cobra.Command, args []string) error {
+	client, err := newApiClient(c)
+	if err != nil {
+		return err
+	}
+
+	rawArgs, err := c.Flags().GetStringArray("arg")
+	if err != nil {
+		return err
+	}
+
+	expires, err := c.Flags().GetDuration("expires")
+	if err != nil {
+		return err
+	}
+
+	kernelArgs := []app.KernelArgument{}
+	for _, a := range rawArgs {
+		key, value, _ := strings.Cut(a, "=")
+		kernelArgs = append(kernelArgs, app.KernelArgument{Key: key, Value: value})
+	}
+
+	req := map[string]any{
+		"slug":        args[1],
+		"kernel_args": kernelArgs,
+		"expires_in":  expires.Round(time.Second).String(),
+	}
+
+	var out map[string]any
+	if err := client.Do(c.Context(), http.MethodPut, nextBootPath(args[0]), req, &out); err != nil {
+		return err
+	}
+	return printJson(out)
+}
+
+func clearNextBoot(c *cobra.Command, args []string) error {
+	client, err := newApiClient(c)
+	if err != nil {
+		return err
+	}
+	return client.Do(c.Context(), http.MethodDelete, nextBootPath(args[0]), nil, nil)
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.crute.us/mcrute/netboot-server/app"
+	"code.crute.us/mcrute/netboot-server/remotefs"
+	"code.crute.us/mcrute/netboot-server/upstream"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func NewSyncCommand() *cobra.Command {
+	syncCmd := &cobra.Command{
+		Use:   "sync",
+		Short: "Download new upstream releases into the distribution tree",
+		Args:  cobra.NoArgs,
+		RunE:  syncUpstream,
+	}
+	addApiClientFlags(syncCmd)
+	syncCmd.Flags().String("distro-files", app.DefaultConfig.DistroFilesPath, "Path to distribution file tree")
+	syncCmd.Flags().String("distro", "", "Only sync the distribution with this short name")
+	syncCmd.Flags().Bool("rescan", false, "Ask the server to rescan the catalog if releases were added")
+	syncCmd.Flags().String("gpgv", "gpgv", "Path to gpgv for verifying release signatures")
+	syncCmd.Flags().Bool("insecure-skip-signature", app.DefaultConfig.InsecureSkipSignature, "Install releases of distributions without a keyring without verifying signatures")
+
+	return syncCmd
+}
+
+func syncUpstream(c *cobra.Command, args []string) error {
+	root, _ := c.Flags().GetString("distro-files")
+	only, _ := c.Flags().GetString("distro")
+	rescan, _ := c.Flags().GetBool("rescan")
+	gpgv, _ := c.Flags().GetString("gpgv")
+	insecure, _ := c.Flags().GetBool("insecure-skip-signature")
+
+	if remotefs.IsRemote(root) {
+		return fmt.Errorf("distro-files must be a local path, not %s", root)
+	}
+
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		log.Fatalf("Error configuring zap logger: %s", err)
+	}
+	defer logger.Sync()
+
+	syncer := &upstream.Syncer{
+		Root:                  root,
+		Logger:                logger,
+		Gpgv:                  gpgv,
+		InsecureSkipSignature: insecure,
+	}
+
+	added, syncErr := syncer.Sync(c.Context(), only)
+	for _, p := range added {
+		c.Println("Added", p)
+	}
+
+	if rescan && len(added) > 0 {
+		client, err := newApiClient(c)
+		if err != nil {
+			return err
+		}
+		if err := client.Do(c.Context(), http.MethodPost, "/api/v1/catalog/rescan", nil, nil); err != nil {
+			return err
+		}
+	}
+
+	return syncErr
+}
+
+// syncUpstreamAsync periodically syncs upstream releases and rescans the
+// catalog when new releases are added
+func syncUpstreamAsync(ctx context.Context, wg *sync.WaitGroup, syncer *upstream.Syncer, catalog *app.DistributionCatalog, interval time.Duration) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		syncer.Logger.Info("Starting upstream sync job", zap.Duration("interval", interval))
+
+		for {
+			added, err := syncer.Sync(ctx, "")
+			if err != nil {
+				syncer.Logger.Error("Error syncing upstream releases", zap.Error(err))
+			}
+			if len(added) > 0 {
+				catalog.RequestRescan()
+			}
+
+			select {
+			case <-ctx.Done():
+				syncer.Logger.Info("Shutting down upstream sync job")
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
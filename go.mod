@@ -12,7 +12,6 @@ require (
 	github.com/prometheus/client_golang v1.4.0
 	github.com/spf13/cobra v1.3.0
 	go.uber.org/zap v1.27.0
-	golang.org/x/mod v0.20.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
@@ -0,0 +1,84 @@
+#
+# Generated by the netboot server{{ with .Host.Mac }} for {{ . }}{{ end }}
+#
+set timeout=10
+set http_server={{ quote .HttpServer }}
+
+insmod http
+
+#
+# Default Variables
+#
+{{ range $k, $v := .DefaultVars }}
+set {{ $k }}={{ quote $v }}
+{{- end }}
+
+#
+# Product Specific Variables/Overrides
+#
+smbios --type 1 --get-string 5 --set product
+{{ range $prod, $vars := .ProductVars }}
+{{- range $k, $v := $vars -}}
+if [ "${product}" = {{ quote $prod }} ]; then set {{ $k }}={{ quote $v }}; fi
+{{ end -}}
+{{ end }}
+{{- with .NextBoot }}
+#
+# One-time boot override, falls back to the default entry if the boot
+# fails. Only offered on the architecture of the override.
+#
+if [ "${grub_cpu}" {{ if eq $.NextBootArch "aarch64" }}={{ else }}!={{ end }} "arm64" ]; then
+	menuentry {{ .Title }} --id next-boot {
+		echo "Booting one-time override {{ .ID }}"
+		linux {{ .Kernel }} {{ .Args }}
+		initrd {{ .Initrds }}
+	}
+	set default=next-boot
+	{{- with $.Fallback }}
+	set fallback={{ . }}
+	{{- end }}
+	set timeout=0
+fi
+{{ end }}
+
+#
+# Pick the menu entries based on machine architecture
+#
+if [ "${grub_cpu}" = "arm64" ]; then
+{{- range .ARM64Distros }}
+	menuentry {{ .Title }} --id {{ .ID }} {
+		linux {{ .Kernel }} {{ .Args }}
+		initrd {{ .Initrds }}
+	}
+	{{- if and .Default (ne $.NextBootArch "aarch64") }}
+	set default={{ .ID }}
+	{{- end }}
+{{- end }}
+else
+{{- range .X86Distros }}
+	menuentry {{ .Title }} --id {{ .ID }} {
+		linux {{ .Kernel }} {{ .Args }}
+		initrd {{ .Initrds }}
+	}
+	{{- if and .Default (ne $.NextBootArch "x86_64") }}
+	set default={{ .ID }}
+	{{- end }}
+{{- end }}
+fi
+
+#
+# Other Boot Utilities
+#
+if [ "${grub_platform}" = "efi" ]; then
+	menuentry 'UEFI Firmware Settings' --id fwsetup {
+		fwsetup
+	}
+fi
+
+menuentry 'Reboot system' --id reboot {
+	reboot
+}
+
+menuentry 'Power off system' --id poweroff {
+	halt
+}
@@ -0,0 +1,242 @@
+// Package importer imports distribution releases from tarballs, ISO9660
+// images or directories into the layout expected by the distribution
+// catalog.
+package importer
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"code.crute.us/mcrute/netboot-server/app"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+// StagingDir is the directory within the catalog root where imports are
+// prepared before being renamed into place
+const StagingDir = ".import-staging"
+
+type distroYamlArg struct {
+	Key      string `yaml:"key"`
+	Value    string `yaml:"value,omitempty"`
+	Template string `yaml:"template,omitempty"`
+}
+
+type distroYaml struct {
+	Name       string          `yaml:"name"`
+	Kernel     string          `yaml:"kernel"`
+	Initrd     string          `yaml:"initrd"`
+	KernelArgs []distroYamlArg `yaml:"kernel_args,omitempty"`
+}
+
+// Options describe a single import. Version and Architecture are
+// detected from the source if not set.
+type Options struct {
+	Source       string
+	Distro       string
+	Architecture string
+	Version      string
+	// Name is used for a new distro.yaml, defaults to the name of the
+	// detected layout
+	Name string
+}
+
+// Result describes a completed import
+type Result struct {
+	Path              string
+	Layout            string
+	Kernel            string
+	Initrds           []string
+	Extras            []string
+	CreatedDistroYaml bool
+}
+
+type Importer struct {
+	Root   string
+	Logger *zap.Logger
+}
+
+func (i *Importer) Import(opts Options) (*Result, error) {
+	if opts.Distro == "" || !filepath.IsLocal(opts.Distro) || filepath.Base(opts.Distro) != opts.Distro {
+		return nil, fmt.Errorf("import: invalid distribution name %q", opts.Distro)
+	}
+
+	stagingRoot := filepath.Join(i.Root, StagingDir)
+	if err := os.MkdirAll(stagingRoot, 0755); err != nil {
+		return nil, err
+	}
+
+	staging, err := os.MkdirTemp(stagingRoot, opts.Distro+"-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	scratch := filepath.Join(staging, "source")
+	if err := os.Mkdir(scratch, 0755); err != nil {
+		return nil, err
+	}
+
+	src, err := openSource(opts.Source, scratch)
+	if err != nil {
+		return nil, err
+	}
+	defer src.close()
+
+	m := detectLayout(src)
+	if m == nil {
+		return nil, fmt.Errorf("import: no known kernel and initrd layout found in %s", opts.Source)
+	}
+	i.Logger.Info("Detected release layout", zap.String("layout", m.layout.Name))
+
+	version, arch := m.layout.Detect(src)
+	if version == "" || arch == "" {
+		// Fall back to the file name, which works for upstream tarballs
+		nameVersion, nameArch := versionFromName(filepath.Base(opts.Source))
+		version = cmp.Or(version, nameVersion)
+		arch = cmp.Or(arch, nameArch)
+	}
+	if opts.Version != "" {
+		version = opts.Version
+	}
+	if opts.Architecture != "" {
+		if arch != "" && arch != opts.Architecture {
+			i.Logger.Warn("Architecture does not match detected architecture",
+				zap.String("architecture", opts.Architecture),
+				zap.String("detected", arch),
+			)
+		}
+		arch = opts.Architecture
+	}
+	if version == "" {
+		return nil, fmt.Errorf("import: unable to detect version, set it explicitly")
+	}
+	if arch == "" {
+		return nil, fmt.Errorf("import: unable to detect architecture, set it explicitly")
+	}
+	for _, p := range []string{version, arch} {
+		if !filepath.IsLocal(p) || filepath.Base(p) != p {
+			return nil, fmt.Errorf("import: invalid version or architecture %q", p)
+		}
+	}
+
+	result := &Result{
+		Path:   path.Join(opts.Distro, version, arch),
+		Layout: m.layout.Name,
+		Kernel: path.Base(m.kernel),
+	}
+
+	dest := filepath.Join(i.Root, opts.Distro, version, arch)
+	if _, err := os.Stat(dest); err == nil {
+		return nil, fmt.Errorf("import: %s already exists", result.Path)
+	}
+
+	distroYamlPath := filepath.Join(i.Root, opts.Distro, "distro.yaml")
+	newDistroYaml, err := i.checkDistroYaml(distroYamlPath, opts, m)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build the architecture directory in staging then rename it into
+	// place so the catalog never sees a partial import
+	files := filepath.Join(staging, "files")
+	if err := os.Mkdir(files, 0755); err != nil {
+		return nil, err
+	}
+
+	if err := copyFromFS(src, m.kernel, filepath.Join(files, m.dest(m.kernel, false))); err != nil {
+		return nil, err
+	}
+	for _, p := range m.initrds {
+		if err := copyFromFS(src, p, filepath.Join(files, m.dest(p, false))); err != nil {
+			return nil, err
+		}
+		result.Initrds = append(result.Initrds, m.dest(p, false))
+	}
+	for _, p := range m.extras {
+		if err := copyFromFS(src, p, filepath.Join(files, filepath.FromSlash(m.dest(p, true)))); err != nil {
+			return nil, err
+		}
+		result.Extras = append(result.Extras, m.dest(p, true))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(files, dest); err != nil {
+		return nil, err
+	}
+
+	if newDistroYaml != nil {
+		if err := writeDistroYaml(distroYamlPath, newDistroYaml); err != nil {
+			return nil, err
+		}
+		result.CreatedDistroYaml = true
+	}
+
+	return result, nil
+}
+
+// checkDistroYaml validates an existing distro.yaml against the files
+// being imported. If there is no distro.yaml it returns the one that
+// should be created.
+func (i *Importer) checkDistroYaml(p string, opts Options, m *match) (*distroYaml, error) {
+	if _, err := os.Stat(p); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		name := opts.Name
+		if name == "" {
+			name = m.layout.DisplayName
+		}
+
+		return &distroYaml{
+			Name:       name,
+			Kernel:     path.Base(m.kernel),
+			Initrd:     path.Base(m.initrds[0]),
+			KernelArgs: m.layout.KernelArgs(m),
+		}, nil
+	}
+
+	d, err := app.DistributionFromYaml(os.DirFS(filepath.Dir(p)), filepath.Base(p))
+	if err != nil {
+		return nil, fmt.Errorf("import: invalid %s: %w", p, err)
+	}
+
+	if d.KernelName != path.Base(m.kernel) {
+		return nil, fmt.Errorf("import: distro.yaml kernel is %q but the release kernel is %q", d.KernelName, path.Base(m.kernel))
+	}
+
+	found := false
+	for _, initrd := range m.initrds {
+		if d.InitrdName == path.Base(initrd) {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("import: distro.yaml initrd %q is not in the release", d.InitrdName)
+	}
+
+	return nil, nil
+}
+
+func writeDistroYaml(p string, d *distroYaml) error {
+	data, err := yaml.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, 0644)
+}
+
+// Layouts returns the names of the supported release layouts
+func Layouts() []string {
+	out := []string{}
+	for _, l := range layouts {
+		out = append(out, l.Name)
+	}
+	return out
+}
@@ -0,0 +1,181 @@
+package importer
+
+import (
+	"bufio"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// versionArchPattern matches the version and architecture in Alpine
+// release names, ex: alpine-netboot-3.20.3-x86_64.tar.gz
+var versionArchPattern = regexp.MustCompile(`(\d+\.\d+(?:\.\d+)?(?:_rc\d+)?)-(x86_64|aarch64|armv7|armhf|x86|ppc64le|s390x|riscv64)`)
+
+// Layout describes where a family of distributions keeps its boot files
+// within a release tarball, ISO image or directory
+type Layout struct {
+	Name        string
+	DisplayName string
+	// Patterns for fs.Glob. Kernel must match exactly one file and the
+	// first match of Initrds is the primary initrd.
+	Kernel  string
+	Initrds []string
+	// Extras are additional artifacts such as modloops, device trees
+	// and installer images. They are optional and may be directories.
+	Extras []string
+	// Flatten places every file at the top of the architecture
+	// directory, otherwise extras keep their path within the source.
+	// The kernel and initrds are always at the top.
+	Flatten bool
+	// KernelArgs returns the arguments used when creating a new
+	// distro.yaml for the matched files
+	KernelArgs func(m *match) []distroYamlArg
+	// Detect returns the version and architecture of the release from
+	// its contents, or empty strings if they can not be found
+	Detect func(fsys fs.FS) (version, arch string)
+}
+
+var layouts = []Layout{
+	{
+		Name:        "alpine",
+		DisplayName: "Alpine Linux",
+		Kernel:      "boot/vmlinuz-*",
+		Initrds:     []string{"boot/initramfs-*"},
+		Extras:      []string{"boot/modloop-*", "boot/dtbs-*", "boot/config-*", "boot/System.map-*"},
+		Flatten:     true,
+		KernelArgs:  alpineKernelArgs,
+		Detect:      detectAlpine,
+	},
+	{
+		Name:        "fedora",
+		DisplayName: "Fedora",
+		Kernel:      "images/pxeboot/vmlinuz",
+		Initrds:     []string{"images/pxeboot/initrd.img"},
+		Extras:      []string{"images/install.img", "LiveOS/squashfs.img"},
+		KernelArgs: func(*match) []distroYamlArg {
+			return []distroYamlArg{
+				{Key: "inst.stage2", Template: "${http_server}/{{ .DistroPath }}"},
+				{Key: "ip", Value: "dhcp"},
+			}
+		},
+		Detect: detectTreeinfo,
+	},
+}
+
+func alpineKernelArgs(m *match) []distroYamlArg {
+	args := []distroYamlArg{
+		{Key: "apkovl", Template: "${http_server}/${net0/mac}/apkovl.tar.gz"},
+	}
+	for _, e := range m.extras {
+		if strings.HasPrefix(path.Base(e), "modloop-") {
+			args = append(args, distroYamlArg{
+				Key:      "modloop",
+				Template: "${http_server}/{{ .DistroPath }}/" + path.Base(e),
+			})
+			break
+		}
+	}
+	return args
+}
+
+// detectAlpine reads the version from .alpine-release, which contains
+// the release name, ex: alpine-standard-3.20.3-x86_64 240906
+func detectAlpine(fsys fs.FS) (string, string) {
+	data, err := fs.ReadFile(fsys, ".alpine-release")
+	if err != nil {
+		return "", ""
+	}
+	return versionFromName(string(data))
+}
+
+// versionFromName finds the version and architecture in a release file
+// name
+func versionFromName(name string) (string, string) {
+	m := versionArchPattern.FindStringSubmatch(name)
+	if m == nil {
+		return "", ""
+	}
+	return m[1], m[2]
+}
+
+// detectTreeinfo reads the version and architecture from the .treeinfo
+// INI file used by Fedora and Red Hat derived distributions
+func detectTreeinfo(fsys fs.FS) (string, string) {
+	fd, err := fsys.Open(".treeinfo")
+	if err != nil {
+		return "", ""
+	}
+	defer fd.Close()
+
+	values := map[string]string{}
+	section := ""
+	s := bufio.NewScanner(fd)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line[1 : len(line)-1]
+			continue
+		}
+		if k, v, ok := strings.Cut(line, "="); ok {
+			values[section+"."+strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+
+	version := values["release.version"]
+	if version == "" {
+		version = values["general.version"]
+	}
+	arch := values["tree.arch"]
+	if arch == "" {
+		arch = values["general.arch"]
+	}
+	return version, arch
+}
+
+// match is the set of files a layout matched in a source
+type match struct {
+	layout  *Layout
+	kernel  string
+	initrds []string
+	extras  []string
+}
+
+// dest returns the path of a source file within the architecture
+// directory
+func (m *match) dest(src string, isExtra bool) string {
+	if !isExtra || m.layout.Flatten {
+		return path.Base(src)
+	}
+	return src
+}
+
+// detectLayout finds the first layout whose kernel and primary initrd
+// exist in the source
+func detectLayout(fsys fs.FS) *match {
+	for i := range layouts {
+		l := &layouts[i]
+
+		kernels, _ := fs.Glob(fsys, l.Kernel)
+		if len(kernels) != 1 {
+			continue
+		}
+
+		m := &match{layout: l, kernel: kernels[0]}
+		for _, p := range l.Initrds {
+			found, _ := fs.Glob(fsys, p)
+			m.initrds = append(m.initrds, found...)
+		}
+		if len(m.initrds) == 0 {
+			continue
+		}
+
+		for _, p := range l.Extras {
+			found, _ := fs.Glob(fsys, p)
+			m.extras = append(m.extras, found...)
+		}
+
+		return m
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package importer
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"code.crute.us/mcrute/netboot-server/iso9660"
+)
+
+// source is an opened import source
+type source struct {
+	fs.FS
+	close func() error
+}
+
+// openSource opens a directory, ISO9660 image or tarball as a file
+// system. Tarballs are extracted to scratch, which must be an empty
+// directory.
+func openSource(name, scratch string) (*source, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return &source{os.DirFS(name), func() error { return nil }}, nil
+	}
+
+	fd, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if iso9660.IsISO9660(fd) {
+		isoFs, err := iso9660.Open(fd)
+		if err != nil {
+			fd.Close()
+			return nil, err
+		}
+		return &source{isoFs, fd.Close}, nil
+	}
+	defer fd.Close()
+
+	br := bufio.NewReader(fd)
+	var r io.Reader = br
+
+	magic, _ := br.Peek(2)
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	if err := extractTar(r, scratch); err != nil {
+		return nil, fmt.Errorf("%s is not a directory, ISO9660 image or tarball: %w", name, err)
+	}
+
+	return &source{os.DirFS(scratch), func() error { return nil }}, nil
+}
+
+// extractTar extracts regular files, directories and symlinks that stay
+// within dest
+func extractTar(r io.Reader, dest string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if !filepath.IsLocal(name) {
+			continue
+		}
+		target := filepath.Join(dest, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := copyToFile(target, tr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if !filepath.IsLocal(filepath.Join(filepath.Dir(name), hdr.Linkname)) {
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func copyToFile(target string, r io.Reader) error {
+	fd, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	if _, err := io.Copy(fd, r); err != nil {
+		return err
+	}
+	return fd.Close()
+}
+
+// copyFromFS copies a file or directory tree from a file system to dest
+func copyFromFS(fsys fs.FS, src, dest string) error {
+	return fs.WalkDir(fsys, src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, _ := strings.CutPrefix(p, src)
+		target := filepath.Join(dest, filepath.FromSlash(strings.TrimPrefix(rel, "/")))
+
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !d.Type().IsRegular() {
+			return nil // Symlinks in directory sources are skipped
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		fd, err := fsys.Open(p)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+
+		return copyToFile(target, fd)
+	})
+}
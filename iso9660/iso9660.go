@@ -0,0 +1,504 @@
+// Package iso9660 is a read-only io/fs implementation for ISO9660 disc
+// images. Rock Ridge names are used when present, then Joliet names,
+// otherwise ISO9660 names are lower cased and stripped of their version
+// suffix.
+//
+// Files are read directly from the image without buffering so a file
+// system backed by an *os.File can serve large images cheaply.
+package iso9660
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	SectorSize = 2048
+
+	// Volume descriptors start at sector 16, after the system area
+	volumeDescriptorStart = 16
+
+	vdTypePrimary       = 1
+	vdTypeSupplementary = 2
+	vdTypeTerminator    = 255
+
+	flagDirectory = 1 << 1
+
+	// maxDirSize limits the size of a directory that is read into memory,
+	// real directories are a few sectors
+	maxDirSize = 16 << 20
+)
+
+var ErrNotISO9660 = errors.New("iso9660: not an ISO9660 image")
+
+// IsISO9660 returns true if the image has an ISO9660 volume descriptor
+func IsISO9660(r io.ReaderAt) bool {
+	id := make([]byte, 5)
+	if _, err := r.ReadAt(id, volumeDescriptorStart*SectorSize+1); err != nil {
+		return false
+	}
+	return string(id) == "CD001"
+}
+
+// entry is a parsed directory record
+type entry struct {
+	name    string
+	extent  int64 // Byte offset of the data
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (e *entry) Name() string               { return e.name }
+func (e *entry) Size() int64                { return e.size }
+func (e *entry) ModTime() time.Time         { return e.modTime }
+func (e *entry) IsDir() bool                { return e.dir }
+func (e *entry) Sys() any                   { return nil }
+func (e *entry) Type() fs.FileMode          { return e.Mode().Type() }
+func (e *entry) Info() (fs.FileInfo, error) { return e, nil }
+
+func (e *entry) Mode() fs.FileMode {
+	if e.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// FS is an ISO9660 file system. Parsed directories are cached so it is
+// cheap to resolve paths repeatedly. An FS is safe for concurrent use.
+type FS struct {
+	r          io.ReaderAt
+	size       int64 // Size of the image, or -1 if it is not known
+	root       *entry
+	rockRidge  bool
+	joliet     bool
+	susp       int // Bytes to skip at the start of each system use area
+	VolumeName string
+
+	dirs   map[int64][]*entry // Directory extent -> entries
+	dirsMu sync.Mutex
+}
+
+// imageSize returns the size of an image if the reader can report it,
+// such as an *os.File, fs.File or *io.SectionReader, otherwise -1
+func imageSize(r io.ReaderAt) int64 {
+	switch r := r.(type) {
+	case interface{ Size() int64 }:
+		return r.Size()
+	case interface{ Stat() (fs.FileInfo, error) }:
+		if info, err := r.Stat(); err == nil {
+			return info.Size()
+		}
+	}
+	return -1
+}
+
+// isJoliet returns true if a supplementary volume descriptor has one of
+// the Joliet UCS-2 escape sequences
+func isJoliet(vd []byte) bool {
+	esc := string(vd[88:91])
+	return esc == "%/@" || esc == "%/C" || esc == "%/E"
+}
+
+// jolietName decodes a big endian UCS-2 Joliet name
+func jolietName(raw []byte) string {
+	units := make([]uint16, len(raw)/2)
+	for i := range units {
+		units[i] = binary.BigEndian.Uint16(raw[i*2:])
+	}
+	name := string(utf16.Decode(units))
+	if i := strings.IndexByte(name, ';'); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+var (
+	_ fs.FS        = (*FS)(nil)
+	_ fs.ReadDirFS = (*FS)(nil)
+	_ fs.StatFS    = (*FS)(nil)
+)
+
+// Open reads the volume descriptors of an image and returns a file
+// system for it
+func Open(r io.ReaderAt) (*FS, error) {
+	if !IsISO9660(r) {
+		return nil, ErrNotISO9660
+	}
+
+	f := &FS{r: r, size: imageSize(r), dirs: map[int64][]*entry{}}
+	vd := make([]byte, SectorSize)
+	var jolietRoot *entry
+
+	for sector := int64(volumeDescriptorStart); ; sector++ {
+		if _, err := r.ReadAt(vd, sector*SectorSize); err != nil {
+			return nil, fmt.Errorf("iso9660: reading volume descriptor: %w", err)
+		}
+		if string(vd[1:6]) != "CD001" {
+			return nil, ErrNotISO9660
+		}
+
+		switch vd[0] {
+		case vdTypePrimary:
+			f.VolumeName = strings.TrimSpace(string(vd[40:72]))
+			root, _, err := f.parseRecord(vd[156:190])
+			if err != nil {
+				return nil, err
+			}
+			f.root = root
+		case vdTypeSupplementary:
+			if !isJoliet(vd) {
+				continue
+			}
+			root, _, err := f.parseRecord(vd[156:190])
+			if err != nil {
+				return nil, err
+			}
+			jolietRoot = root
+		case vdTypeTerminator:
+			if f.root == nil {
+				return nil, fmt.Errorf("iso9660: no primary volume descriptor")
+			}
+			f.detectRockRidge()
+			// Rock Ridge names are preferred because they are not length
+			// limited and carry POSIX semantics
+			if !f.rockRidge && jolietRoot != nil {
+				f.root = jolietRoot
+				f.joliet = true
+			}
+			return f, nil
+		}
+	}
+}
+
+// detectRockRidge checks the "." record of the root directory for the
+// SUSP indicator which signals that Rock Ridge extensions are in use
+func (f *FS) detectRockRidge() {
+	buf := make([]byte, SectorSize)
+	if _, err := f.r.ReadAt(buf, f.root.extent); err != nil {
+		return
+	}
+
+	recLen := int(buf[0])
+	nameLen := int(buf[32])
+	if recLen == 0 || recLen > len(buf) {
+		return
+	}
+
+	su := systemUse(buf[:recLen], nameLen)
+	if len(su) >= 7 && string(su[0:2]) == "SP" && su[4] == 0xbe && su[5] == 0xef {
+		f.rockRidge = true
+		f.susp = int(su[6])
+	}
+}
+
+// systemUse returns the system use area of a directory record
+func systemUse(rec []byte, nameLen int) []byte {
+	start := 33 + nameLen
+	if nameLen%2 == 0 {
+		start++ // Padding byte
+	}
+	if start >= len(rec) {
+		return nil
+	}
+	return rec[start:]
+}
+
+// rockRidgeName returns the NM name from a system use area, if any
+func rockRidgeName(su []byte) (string, bool) {
+	var name []byte
+	found := false
+
+	for len(su) >= 4 {
+		sig, l := string(su[0:2]), int(su[2])
+		if l < 4 || l > len(su) {
+			break
+		}
+		if sig == "NM" && l >= 5 {
+			flags := su[4]
+			// Current and parent directory flags, not real names
+			if flags&0x06 == 0 {
+				name = append(name, su[5:l]...)
+				found = true
+			}
+		}
+		if sig == "ST" {
+			break
+		}
+		su = su[l:]
+	}
+
+	return string(name), found
+}
+
+func isoName(raw []byte) string {
+	name := string(raw)
+	if i := strings.IndexByte(name, ';'); i >= 0 {
+		name = name[:i]
+	}
+	name = strings.TrimSuffix(name, ".")
+	return strings.ToLower(name)
+}
+
+func recordTime(b []byte) time.Time {
+	if len(b) < 7 {
+		return time.Time{}
+	}
+	offset := time.Duration(int8(b[6])) * 15 * time.Minute
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]),
+		int(b[3]), int(b[4]), int(b[5]), 0,
+		time.FixedZone("", int(offset.Seconds())))
+}
+
+// parseRecord parses a directory record and returns the entry and the
+// raw identifier bytes
+func (f *FS) parseRecord(rec []byte) (*entry, []byte, error) {
+	if len(rec) < 34 || int(rec[0]) > len(rec) {
+		return nil, nil, fmt.Errorf("iso9660: short directory record")
+	}
+
+	nameLen := int(rec[32])
+	if 33+nameLen > len(rec) {
+		return nil, nil, fmt.Errorf("iso9660: invalid directory record name length")
+	}
+	rawName := rec[33 : 33+nameLen]
+
+	e := &entry{
+		extent:  int64(binary.LittleEndian.Uint32(rec[2:6])) * SectorSize,
+		size:    int64(binary.LittleEndian.Uint32(rec[10:14])),
+		dir:     rec[25]&flagDirectory != 0,
+		modTime: recordTime(rec[18:25]),
+	}
+
+	if f.rockRidge {
+		su := systemUse(rec, nameLen)
+		if len(su) > f.susp {
+			if name, ok := rockRidgeName(su[f.susp:]); ok {
+				e.name = name
+			}
+		}
+	}
+	if e.name == "" && f.joliet {
+		e.name = jolietName(rawName)
+	}
+	if e.name == "" {
+		e.name = isoName(rawName)
+	}
+
+	return e, rawName, nil
+}
+
+// readDir returns the entries of a directory, excluding . and .., from
+// the cache or by parsing it. The returned slice is shared and must not
+// be modified.
+func (f *FS) readDir(dir *entry) ([]*entry, error) {
+	f.dirsMu.Lock()
+	entries, ok := f.dirs[dir.extent]
+	f.dirsMu.Unlock()
+	if ok {
+		return entries, nil
+	}
+
+	entries, err := f.parseDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	f.dirsMu.Lock()
+	f.dirs[dir.extent] = entries
+	f.dirsMu.Unlock()
+
+	return entries, nil
+}
+
+// parseDir reads and parses the records of a directory. The size is
+// checked against the image before it is allocated because it comes
+// from the image.
+func (f *FS) parseDir(dir *entry) ([]*entry, error) {
+	if dir.size > maxDirSize {
+		return nil, fmt.Errorf("iso9660: directory of %d bytes is too large", dir.size)
+	}
+	if f.size >= 0 && dir.extent+dir.size > f.size {
+		return nil, fmt.Errorf("iso9660: directory extends past the end of the image")
+	}
+
+	data := make([]byte, dir.size)
+	if _, err := f.r.ReadAt(data, dir.extent); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	out := []*entry{}
+	for off := 0; off < len(data); {
+		recLen := int(data[off])
+		if recLen == 0 {
+			// Records do not cross sectors, the rest of this sector is padding
+			off = (off/SectorSize + 1) * SectorSize
+			continue
+		}
+		if off+recLen > len(data) {
+			return nil, fmt.Errorf("iso9660: directory record overruns directory")
+		}
+
+		e, rawName, err := f.parseRecord(data[off : off+recLen])
+		if err != nil {
+			return nil, err
+		}
+		off += recLen
+
+		if len(rawName) == 1 && (rawName[0] == 0 || rawName[0] == 1) {
+			continue
+		}
+		out = append(out, e)
+	}
+
+	return out, nil
+}
+
+// lookup resolves a slash separated path to an entry
+func (f *FS) lookup(op, name string) (*entry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	cur := f.root
+	if name == "." {
+		return cur, nil
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if !cur.dir {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+
+		entries, err := f.readDir(cur)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+
+		var next *entry
+		for _, e := range entries {
+			if e.name == part {
+				next = e
+				break
+			}
+		}
+		if next == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		cur = next
+	}
+
+	return cur, nil
+}
+
+func (f *FS) Open(name string) (fs.File, error) {
+	e, err := f.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.dir {
+		return &dirFile{fs: f, entry: e, name: path.Base(name)}, nil
+	}
+	return &file{entry: e, SectionReader: io.NewSectionReader(f.r, e.extent, e.size)}, nil
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	e, err := f.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := f.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	entries, err := f.readDir(e)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	out := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		out = append(out, e)
+	}
+	sortDirEntries(out)
+	return out, nil
+}
+
+// file is an open regular file. The embedded SectionReader provides
+// Read, ReadAt and Seek so files can serve HTTP range requests.
+type file struct {
+	entry *entry
+	*io.SectionReader
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.entry, nil }
+func (f *file) Close() error               { return nil }
+
+// dirFile is an open directory
+type dirFile struct {
+	fs      *FS
+	entry   *entry
+	name    string
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.entry, nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fs.readDir(d.entry)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			d.entries = append(d.entries, e)
+		}
+		sortDirEntries(d.entries)
+		d.read = true
+	}
+
+	if n <= 0 {
+		out := d.entries
+		d.entries = nil
+		return out, nil
+	}
+
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	n = min(n, len(d.entries))
+	out := d.entries[:n]
+	d.entries = d.entries[n:]
+	return out, nil
+}
+
+func sortDirEntries(entries []fs.DirEntry) {
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+}
@@ -0,0 +1,179 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+// testRecord builds an ISO9660 directory record
+func testRecord(name string, sector, size int, dir bool) []byte {
+	l := 33 + len(name)
+	if l%2 == 1 {
+		l++
+	}
+
+	rec := make([]byte, l)
+	rec[0] = byte(l)
+	binary.LittleEndian.PutUint32(rec[2:], uint32(sector))
+	binary.BigEndian.PutUint32(rec[6:], uint32(sector))
+	binary.LittleEndian.PutUint32(rec[10:], uint32(size))
+	binary.BigEndian.PutUint32(rec[14:], uint32(size))
+	copy(rec[18:25], []byte{124, 1, 2, 3, 4, 5, 0})
+	if dir {
+		rec[25] = flagDirectory
+	}
+	rec[32] = byte(len(name))
+	copy(rec[33:], name)
+	return rec
+}
+
+// testImage builds an image with the primary volume descriptor in
+// sector 16, the root directory in sector 18 and a boot directory in
+// sector 19. dirSize overrides the size of the boot directory.
+func testImage(dirSize int) []byte {
+	const (
+		rootSector   = 18
+		bootSector   = 19
+		kernelSector = 20
+		readmeSector = 21
+		sectors      = 22
+	)
+	kernel, readme := "kernel image", "read me"
+
+	img := make([]byte, sectors*SectorSize)
+	put := func(sector int, data ...[]byte) {
+		off := sector * SectorSize
+		for _, d := range data {
+			off += copy(img[off:], d)
+		}
+	}
+
+	pvd := make([]byte, SectorSize)
+	pvd[0] = vdTypePrimary
+	copy(pvd[1:], "CD001")
+	pvd[6] = 1
+	copy(pvd[40:72], bytes.Repeat([]byte(" "), 32))
+	copy(pvd[40:], "TEST_VOLUME")
+	copy(pvd[156:], testRecord("\x00", rootSector, SectorSize, true))
+	put(16, pvd)
+
+	term := make([]byte, SectorSize)
+	term[0] = vdTypeTerminator
+	copy(term[1:], "CD001")
+	put(17, term)
+
+	put(rootSector,
+		testRecord("\x00", rootSector, SectorSize, true),
+		testRecord("\x01", rootSector, SectorSize, true),
+		testRecord("BOOT", bootSector, dirSize, true),
+		testRecord("README.TXT;1", readmeSector, len(readme), false),
+	)
+	put(bootSector,
+		testRecord("\x00", bootSector, SectorSize, true),
+		testRecord("\x01", rootSector, SectorSize, true),
+		testRecord("VMLINUZ.;1", kernelSector, len(kernel), false),
+	)
+	put(kernelSector, []byte(kernel))
+	put(readmeSector, []byte(readme))
+
+	return img
+}
+
+func TestOpen(t *testing.T) {
+	fsys, err := Open(bytes.NewReader(testImage(SectorSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fsys.VolumeName != "TEST_VOLUME" {
+		t.Errorf("VolumeName = %q", fsys.VolumeName)
+	}
+
+	if err := fstest.TestFS(fsys, "boot/vmlinuz", "readme.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	fsys, err := Open(bytes.NewReader(testImage(SectorSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		want    string
+		wantErr error
+	}{
+		{"boot/vmlinuz", "kernel image", nil},
+		{"readme.txt", "read me", nil},
+		{"README.TXT", "", fs.ErrNotExist},
+		{"boot/missing", "", fs.ErrNotExist},
+		{"readme.txt/child", "", fs.ErrNotExist},
+		{"../readme.txt", "", fs.ErrInvalid},
+		{"/readme.txt", "", fs.ErrInvalid},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := fs.ReadFile(fsys, test.name)
+			if !errors.Is(err, test.wantErr) || string(got) != test.want {
+				t.Errorf("ReadFile() = %q, %v, want %q, %v", got, err, test.want, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestInvalidImages(t *testing.T) {
+	tests := []struct {
+		name    string
+		image   []byte
+		path    string
+		wantErr error
+	}{
+		{
+			name:    "not an image",
+			image:   make([]byte, 20*SectorSize),
+			wantErr: ErrNotISO9660,
+		},
+		{
+			name:    "truncated",
+			image:   testImage(SectorSize)[:16*SectorSize+10],
+			wantErr: io.EOF,
+		},
+		{
+			name:  "directory past end of image",
+			image: testImage(4 * SectorSize),
+			path:  "boot",
+		},
+		{
+			name:  "directory too large",
+			image: testImage(maxDirSize + 1),
+			path:  "boot",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fsys, err := Open(bytes.NewReader(test.image))
+			if test.path == "" {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("Open() = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := fs.ReadDir(fsys, test.path); err == nil {
+				t.Errorf("ReadDir(%q) succeeded", test.path)
+			}
+		})
+	}
+}
@@ -17,6 +17,15 @@ var tftpboot embed.FS
 //go:embed boot.ipxe.tpl
 var ipxeTemplate string
 
+//go:embed grub.cfg.tpl
+var grubTemplate string
+
+//go:embed pxelinux.cfg.tpl
+var pxeTemplate string
+
+//go:embed web
+var web embed.FS
+
 func main() {
-	cmd.CmdMain(tftpboot, ipxeTemplate)
+	cmd.CmdMain(tftpboot, ipxeTemplate, grubTemplate, pxeTemplate, web)
 }
@@ -0,0 +1,113 @@
+package netboxconfig
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+)
+
+// alpineAnswersConfig is the alpine_answers key of the config context.
+// Every field has a default so the key is optional.
+type alpineAnswersConfig struct {
+	Keymap     string   `json:"keymap"`      // Layout and variant, default "us us"
+	Timezone   string   `json:"timezone"`    // Default UTC
+	Proxy      string   `json:"proxy"`       // Default none
+	Ssh        string   `json:"ssh"`         // openssh, dropbear or none, default openssh
+	Ntp        string   `json:"ntp"`         // chrony, openntpd, busybox or none, default chrony
+	DnsDomain  string   `json:"dns_domain"`  // Default the site base FQDN
+	DnsServers []string `json:"dns_servers"` // Default from DHCP
+	DiskMode   string   `json:"disk_mode"`   // sys, data, lvm, lvmsys or lvmdata, default none
+	Disks      []string `json:"disks"`       // Target disks, ex: /dev/sda
+	EraseDisks bool     `json:"erase_disks"` // Skip the confirmation to erase the disks
+}
+
+// shellQuote quotes a string for the answer file, which setup-alpine
+// sources as a shell script
+func shellQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+	return `"` + r.Replace(s) + `"`
+}
+
+func withDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// RenderAlpineAnswers renders an answer file for setup-alpine -f for a
+// device. The hostname, interfaces, repositories and root SSH keys are
+// what the hostname, ifupdown_ng, alpine_repos and root_ssh_keys plugins
+// would put in an APKOVL, so a host installed to disk comes up
+// configured the same way as a diskless boot. Everything else comes from
+// the alpine_answers key of the config context.
+func RenderAlpineAnswers(ctx context.Context, cfg *RawConfig) ([]byte, error) {
+	var config alpineAnswersConfig
+	if err := cfg.contextValue("alpine_answers", &config); err != nil {
+		return nil, err
+	}
+
+	files, err := pluginFiles(ctx, cfg, []string{"ifupdown_ng", "alpine_repos", "root_ssh_keys"})
+	if err != nil {
+		return nil, err
+	}
+
+	generated := map[string]string{}
+	for _, f := range files {
+		generated[f.Name] = string(f.Contents)
+	}
+
+	interfaces := generated["etc/network/interfaces"]
+	if strings.TrimSpace(interfaces) == "" {
+		interfaces = fmt.Sprintf("auto lo\niface lo inet loopback\n\nauto eth0\niface eth0 inet dhcp\n    hostname %s\n", cfg.Name)
+	}
+
+	repos := "-1"
+	if r := strings.Fields(generated["etc/apk/repositories"]); len(r) > 0 {
+		repos = strings.Join(r, " ")
+	}
+
+	dns := []string{}
+	if domain := withDefault(config.DnsDomain, cfg.Site.CustomFields.BaseFqdn); domain != "" {
+		dns = append(dns, "-d", domain)
+	}
+	dns = append(dns, config.DnsServers...)
+
+	disks := "none"
+	if config.DiskMode != "" && len(config.Disks) > 0 {
+		disks = fmt.Sprintf("-m %s %s", config.DiskMode, strings.Join(config.Disks, " "))
+	}
+
+	rootKeys := withDefault(strings.TrimSpace(generated["root/.ssh/authorized_keys"]), "none")
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "# Generated by the netboot server for %s\n", cfg.Fqdn())
+	for _, opt := range [][2]string{
+		{"KEYMAPOPTS", withDefault(config.Keymap, "us us")},
+		{"HOSTNAMEOPTS", cfg.Name},
+		{"DEVDOPTS", "mdev"},
+		{"INTERFACESOPTS", interfaces},
+		{"DNSOPTS", strings.Join(dns, " ")},
+		{"TIMEZONEOPTS", withDefault(config.Timezone, "UTC")},
+		{"PROXYOPTS", withDefault(config.Proxy, "none")},
+		{"APKREPOSOPTS", repos},
+		{"USEROPTS", "none"},
+		{"SSHDOPTS", withDefault(config.Ssh, "openssh")},
+		{"ROOTSSHKEY", rootKeys},
+		{"NTPOPTS", withDefault(config.Ntp, "chrony")},
+		{"DISKOPTS", disks},
+		{"LBUOPTS", "none"},
+		{"APKCACHEOPTS", "none"},
+	} {
+		fmt.Fprintf(buf, "%s=%s\n", opt[0], shellQuote(opt[1]))
+	}
+
+	// setup-disk asks before erasing disks unless they are listed in the
+	// environment
+	if config.EraseDisks && disks != "none" {
+		fmt.Fprintf(buf, "export ERASE_DISKS=%s\n", shellQuote(strings.Join(config.Disks, " ")))
+	}
+
+	return buf.Bytes(), nil
+}
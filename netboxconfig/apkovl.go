@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -14,10 +15,53 @@ import (
 
 const defaultMaxSize = 1_000_000_000
 
+// APKOVLEntry describes a single entry in a generated APKOVL
+type APKOVLEntry struct {
+	Name      string
+	Linkname  string
+	Mode      int64
+	Size      int64
+	Symlink   bool
+	Hardlink  bool
+	Directory bool
+}
+
+// ListAPKOVL reads a gzipped APKOVL and returns its entries in the order
+// that they appear in the archive
+func ListAPKOVL(in io.Reader) ([]APKOVLEntry, error) {
+	gr, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+
+	out := []APKOVLEntry{}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, APKOVLEntry{
+			Name:      hdr.Name,
+			Linkname:  hdr.Linkname,
+			Mode:      hdr.Mode,
+			Size:      hdr.Size,
+			Symlink:   hdr.Typeflag == tar.TypeSymlink,
+			Hardlink:  hdr.Typeflag == tar.TypeLink,
+			Directory: hdr.Typeflag == tar.TypeDir,
+		})
+	}
+}
+
 type APKOVL struct {
 	MaxHTTPFileSize int64
 	gzipWriter      *gzip.Writer
 	tarWriter       *tar.Writer
+	names           map[string]bool
 }
 
 func NewAPKOVLFromWriter(out io.Writer) *APKOVL {
@@ -25,9 +69,17 @@ func NewAPKOVLFromWriter(out io.Writer) *APKOVL {
 	return &APKOVL{
 		gzipWriter: gw,
 		tarWriter:  tar.NewWriter(gw),
+		names:      map[string]bool{},
 	}
 }
 
+// writeHeader writes an entry header and records the entry name so that
+// merged archives do not replace generated entries
+func (a *APKOVL) writeHeader(hdr *tar.Header) error {
+	a.names[path.Clean(hdr.Name)] = true
+	return a.tarWriter.WriteHeader(hdr)
+}
+
 func (a *APKOVL) Close() {
 	a.tarWriter.Close()
 	a.gzipWriter.Close()
@@ -35,7 +87,7 @@ func (a *APKOVL) Close() {
 
 // AddEmptyFile adds an empty file
 func (a *APKOVL) AddEmptyFile(name string, mode int64) error {
-	return a.tarWriter.WriteHeader(&tar.Header{
+	return a.writeHeader(&tar.Header{
 		Typeflag: tar.TypeReg,
 		Name:     name,
 		Size:     0,
@@ -46,21 +98,46 @@ func (a *APKOVL) AddEmptyFile(name string, mode int64) error {
 	})
 }
 
+// AddDirectory adds a directory, such as a mount point that must exist
+// before anything is mounted on it
+func (a *APKOVL) AddDirectory(name string, mode int64) error {
+	return a.AddOwnedDirectory(name, mode, 0, 0)
+}
+
+// AddOwnedDirectory adds a directory owned by a uid and gid, such as a
+// home directory. Only numeric IDs are recorded because the names may
+// not exist when the APKOVL is extracted.
+func (a *APKOVL) AddOwnedDirectory(name string, mode int64, uid, gid int) error {
+	return a.writeHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     strings.TrimSuffix(name, "/") + "/",
+		Mode:     mode,
+		Uid:      uid,
+		Gid:      gid,
+		ModTime:  time.Now(),
+	})
+}
+
 // AddStringFile adds a string to a file and appends a newline
 // terminator if one isn't passed in contents
 func (a *APKOVL) AddStringFile(contents, name string, mode int64) error {
+	return a.AddOwnedStringFile(contents, name, mode, 0, 0)
+}
+
+// AddOwnedStringFile is AddStringFile for a file owned by a uid and gid
+func (a *APKOVL) AddOwnedStringFile(contents, name string, mode int64, uid, gid int) error {
 	newlineLen := 0
 	if !strings.HasSuffix(contents, "\n") {
 		newlineLen = 1
 	}
 
-	if err := a.tarWriter.WriteHeader(&tar.Header{
+	if err := a.writeHeader(&tar.Header{
 		Typeflag: tar.TypeReg,
 		Name:     name,
 		Size:     int64(len(contents) + newlineLen),
 		Mode:     mode,
-		Uid:      0,
-		Gid:      0,
+		Uid:      uid,
+		Gid:      gid,
 		ModTime:  time.Now(),
 	}); err != nil {
 		return err
@@ -82,7 +159,7 @@ func (a *APKOVL) AddStringFile(contents, name string, mode int64) error {
 // AddRCLink creates a link from a service in /etc/init.d to a named
 // runlevel
 func (a *APKOVL) AddRCLink(service, runlevel string) error {
-	return a.tarWriter.WriteHeader(&tar.Header{
+	return a.writeHeader(&tar.Header{
 		Typeflag: tar.TypeSymlink,
 		Name:     filepath.Join("etc/runlevels", runlevel, service),
 		Linkname: filepath.Join("/etc/init.d", service),
@@ -135,7 +212,7 @@ func (a *APKOVL) AddHTTPFile(ctx context.Context, url, name string, mode int64)
 		return err
 	}
 
-	if err := a.tarWriter.WriteHeader(&tar.Header{
+	if err := a.writeHeader(&tar.Header{
 		Typeflag: tar.TypeReg,
 		Name:     name,
 		Size:     int64(len(contents)),
@@ -150,3 +227,107 @@ func (a *APKOVL) AddHTTPFile(ctx context.Context, url, name string, mode int64)
 	_, err = a.tarWriter.Write(contents)
 	return err
 }
+
+// mergeExcludedPaths are the paths that MergeAPKOVL never copies, even
+// if they are allowed by the operator. Backups are uploaded by the host
+// so they must not be able to add services, scripts that run at boot or
+// as root, or credentials. The account files are excluded so that users
+// managed in Netbox are always rebuilt from the base system, otherwise a
+// persisted copy would keep old password hashes and removed users.
+var mergeExcludedPaths = []string{
+	"etc/init.d",
+	"etc/local.d",
+	"etc/runlevels",
+	"etc/crontabs",
+	"etc/periodic",
+	"etc/doas.d",
+	"etc/doas.conf",
+	"etc/sudoers",
+	"etc/sudoers.d",
+	"etc/profile",
+	"etc/profile.d",
+	"etc/ssh",
+	"etc/passwd",
+	"etc/passwd-",
+	"etc/shadow",
+	"etc/shadow-",
+	"etc/group",
+	"etc/group-",
+	"root/.ssh",
+}
+
+// underPath returns true if name is p or is inside of p
+func underPath(name, p string) bool {
+	return p == "." || name == p || strings.HasPrefix(name, p+"/")
+}
+
+// MergeAllowed returns true if an entry of a merged APKOVL is within one
+// of the allowed paths and not within mergeExcludedPaths. Allowed paths
+// may be absolute or relative to the root.
+func MergeAllowed(name string, allowed []string) bool {
+	for _, p := range mergeExcludedPaths {
+		if underPath(name, p) {
+			return false
+		}
+	}
+	for _, p := range allowed {
+		if underPath(name, path.Clean(strings.TrimLeft(p, "/"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeAPKOVL copies the entries of another gzipped APKOVL, such as an
+// lbu backup, that were not already added. Only files and directories
+// within the allowed paths are copied, see MergeAllowed. Entries that
+// would be extracted outside of the root are skipped.
+func (a *APKOVL) MergeAPKOVL(in io.Reader, allowed []string) error {
+	gr, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == "." || name == ".." || strings.HasPrefix(name, "../") || a.names[name] || !MergeAllowed(name, allowed) {
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeDir:
+		default:
+			continue
+		}
+
+		if err := a.writeHeader(&tar.Header{
+			Typeflag: hdr.Typeflag,
+			Name:     hdr.Name,
+			Size:     hdr.Size,
+			Mode:     hdr.Mode,
+			Uid:      hdr.Uid,
+			Gid:      hdr.Gid,
+			Uname:    hdr.Uname,
+			Gname:    hdr.Gname,
+			ModTime:  hdr.ModTime,
+		}); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := io.Copy(a.tarWriter, tr); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package netboxconfig
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"slices"
+	"testing"
+)
+
+type testTarEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+}
+
+func testTarGz(t *testing.T, entries []testTarEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Typeflag: e.typeflag,
+			Name:     e.name,
+			Linkname: e.linkname,
+			Mode:     0644,
+			Size:     int64(len(e.body)),
+		}
+		if e.typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+var testBackup = []testTarEntry{
+	{name: "etc/motd", typeflag: tar.TypeReg, body: "backup"},
+	{name: "etc/hostname", typeflag: tar.TypeReg, body: "host"},
+	{name: "etc/nginx/", typeflag: tar.TypeDir},
+	{name: "etc/nginx/nginx.conf", typeflag: tar.TypeReg, body: "conf"},
+	{name: "etc/nginx/link", typeflag: tar.TypeSymlink, linkname: "/etc/shadow"},
+	{name: "etc/nginx/hard", typeflag: tar.TypeLink, linkname: "etc/shadow"},
+	{name: "etc/crontabs/root", typeflag: tar.TypeReg, body: "* * * * * id"},
+	{name: "etc/periodic/daily/job", typeflag: tar.TypeReg, body: "id"},
+	{name: "etc/doas.d/doas.conf", typeflag: tar.TypeReg, body: "permit nopass"},
+	{name: "etc/sudoers.d/all", typeflag: tar.TypeReg, body: "ALL"},
+	{name: "etc/profile.d/x.sh", typeflag: tar.TypeReg, body: "id"},
+	{name: "etc/ssh/sshd_config", typeflag: tar.TypeReg, body: "PermitRootLogin yes"},
+	{name: "etc/shadow", typeflag: tar.TypeReg, body: "root::"},
+	{name: "etc/init.d/evil", typeflag: tar.TypeReg, body: "id"},
+	{name: "root/.ssh/authorized_keys", typeflag: tar.TypeReg, body: "ssh-ed25519"},
+	{name: "root/notes/todo.txt", typeflag: tar.TypeReg, body: "todo"},
+	{name: "root/notes-old/todo.txt", typeflag: tar.TypeReg, body: "todo"},
+	{name: "../escape", typeflag: tar.TypeReg, body: "x"},
+	{name: "/abs", typeflag: tar.TypeReg, body: "x"},
+}
+
+func TestMergeAPKOVL(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		want    []string
+	}{
+		{
+			name: "nothing allowed",
+			want: []string{"etc/motd"},
+		},
+		{
+			name:    "allowed directories",
+			allowed: []string{"/etc/nginx", "/root/notes"},
+			want:    []string{"etc/motd", "etc/nginx/", "etc/nginx/nginx.conf", "root/notes/todo.txt"},
+		},
+		{
+			name:    "relative allowed path",
+			allowed: []string{"etc/hostname"},
+			want:    []string{"etc/motd", "etc/hostname"},
+		},
+		{
+			name:    "generated files win",
+			allowed: []string{"/etc/motd"},
+			want:    []string{"etc/motd"},
+		},
+		{
+			name:    "excluded paths inside allowed paths",
+			allowed: []string{"/etc", "/root"},
+			want:    []string{"etc/motd", "etc/hostname", "etc/nginx/", "etc/nginx/nginx.conf", "root/notes/todo.txt", "root/notes-old/todo.txt"},
+		},
+		{
+			name:    "excluded paths allowed explicitly",
+			allowed: []string{"/etc/crontabs", "/etc/ssh", "/root/.ssh", "/etc/shadow"},
+			want:    []string{"etc/motd"},
+		},
+		{
+			name:    "everything allowed",
+			allowed: []string{"/"},
+			want:    []string{"etc/motd", "etc/hostname", "etc/nginx/", "etc/nginx/nginx.conf", "root/notes/todo.txt", "root/notes-old/todo.txt"},
+		},
+	}
+
+	backup := testTarGz(t, testBackup)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			ovl := NewAPKOVLFromWriter(&buf)
+			if err := ovl.AddStringFile("generated", "etc/motd", 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := ovl.MergeAPKOVL(bytes.NewReader(backup), test.allowed); err != nil {
+				t.Fatal(err)
+			}
+			ovl.Close()
+
+			entries, err := ListAPKOVL(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := []string{}
+			for _, e := range entries {
+				got = append(got, e.Name)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("merged %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLbuStoreSave(t *testing.T) {
+	tests := []struct {
+		name    string
+		backup  []byte
+		wantErr error
+	}{
+		{
+			name: "files and directories",
+			backup: testTarGz(t, []testTarEntry{
+				{name: "etc/nginx/", typeflag: tar.TypeDir},
+				{name: "etc/nginx/nginx.conf", typeflag: tar.TypeReg, body: "conf"},
+			}),
+		},
+		{
+			name: "symlink",
+			backup: testTarGz(t, []testTarEntry{
+				{name: "etc/nginx/link", typeflag: tar.TypeSymlink, linkname: "/etc/shadow"},
+			}),
+			wantErr: ErrInvalidLbuBackup,
+		},
+		{
+			name: "hardlink",
+			backup: testTarGz(t, []testTarEntry{
+				{name: "etc/nginx/hard", typeflag: tar.TypeLink, linkname: "etc/shadow"},
+			}),
+			wantErr: ErrInvalidLbuBackup,
+		},
+		{
+			name:    "not an archive",
+			backup:  []byte("not an archive"),
+			wantErr: ErrInvalidLbuBackup,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := OpenLbuStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = s.Save("00:11:22:33:44:55", bytes.NewReader(test.backup))
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Save() = %v, want %v", err, test.wantErr)
+			}
+
+			latest, err := s.Latest("00-11-22-33-44-55")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if saved := latest != nil; saved != (test.wantErr == nil) {
+				t.Errorf("backup saved = %v", saved)
+			}
+		})
+	}
+}
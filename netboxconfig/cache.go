@@ -0,0 +1,219 @@
+package netboxconfig
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	apkovlCacheHitMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_apkovl_cache_hits",
+		Help: "APKOVL requests served from the overlay cache",
+	})
+	apkovlCacheMissMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_apkovl_cache_misses",
+		Help: "APKOVL requests that required generating an overlay",
+	})
+	apkovlCacheEvictionMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_apkovl_cache_evictions",
+		Help: "Overlays evicted from the overlay cache",
+	})
+	apkovlCacheBytesMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "netboot_apkovl_cache_bytes",
+		Help: "Size of the overlays held in the overlay cache",
+	})
+)
+
+const DefaultOverlayCacheMaxAge = time.Hour
+
+// versionedPlugin may be implemented by config plugins to report a
+// version that is included in overlay cache keys. Bumping the version
+// invalidates cached overlays generated by older versions of the plugin.
+type versionedPlugin interface {
+	Version() string
+}
+
+func pluginVersion(name string) string {
+	if v, ok := configPlugins[name].(versionedPlugin); ok {
+		return v.Version()
+	}
+	return ""
+}
+
+// overlayCacheKey hashes every input to overlay generation. The config
+// is marshaled to JSON which sorts map keys so that the key is stable.
+// backup is the digest of the lbu backup merged into the overlay, if any.
+// mac is empty for overlays that do not depend on the host.
+func overlayCacheKey(kind, mac, distro, checkinUrl, backup string, plugins []string, cfg any) (string, error) {
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+
+	versions := map[string]string{}
+	for _, p := range plugins {
+		versions[p] = pluginVersion(p)
+	}
+
+	for _, v := range []any{kind, mac, distro, checkinUrl, backup, versions, cfg} {
+		if err := enc.Encode(v); err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type overlayCacheEntry struct {
+	key     string
+	data    []byte
+	created time.Time
+}
+
+type overlayCall struct {
+	wg   sync.WaitGroup
+	data []byte
+	err  error
+}
+
+// OverlayCache is a size limited LRU cache of generated overlays keyed
+// by a hash of their inputs. Concurrent requests for the same key
+// share a single generation. Entries also expire after MaxAge so that
+// content fetched from outside of Netbox, such as keys fetched by the
+// alpine_keys plugin, is eventually refreshed. A nil OverlayCache is
+// valid and caches nothing.
+type OverlayCache struct {
+	MaxBytes int64
+	MaxAge   time.Duration
+	size     int64
+	lru      *list.List // Most recently used first
+	entries  map[string]*list.Element
+	inflight map[string]*overlayCall
+	sync.Mutex
+}
+
+func (c *OverlayCache) maxAge() time.Duration {
+	if c.MaxAge <= 0 {
+		return DefaultOverlayCacheMaxAge
+	}
+	return c.MaxAge
+}
+
+func (c *OverlayCache) init() {
+	if c.entries == nil {
+		c.lru = list.New()
+		c.entries = map[string]*list.Element{}
+		c.inflight = map[string]*overlayCall{}
+	}
+}
+
+// Purge removes all cached overlays
+func (c *OverlayCache) Purge() {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.init()
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove removes an entry, must be called with the lock held
+func (c *OverlayCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*overlayCacheEntry)
+	delete(c.entries, e.key)
+	c.size -= int64(len(e.data))
+	apkovlCacheBytesMetric.Set(float64(c.size))
+}
+
+func (c *OverlayCache) get(key string) ([]byte, bool) {
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	e := el.Value.(*overlayCacheEntry)
+	if time.Since(e.created) > c.maxAge() {
+		c.remove(el)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+	return e.data, true
+}
+
+func (c *OverlayCache) put(key string, data []byte) {
+	// Overlays larger than the cache would evict everything else
+	if int64(len(data)) > c.MaxBytes {
+		return
+	}
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+
+	for c.size+int64(len(data)) > c.MaxBytes && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+		apkovlCacheEvictionMetric.Inc()
+	}
+
+	c.entries[key] = c.lru.PushFront(&overlayCacheEntry{key, data, time.Now()})
+	c.size += int64(len(data))
+	apkovlCacheBytesMetric.Set(float64(c.size))
+}
+
+// Get returns the overlay for key, calling generate to build it if it
+// is not cached. Failed generations and overlays that generate reports
+// as not cacheable are shared with concurrent requests but not cached.
+func (c *OverlayCache) Get(key string, generate func() ([]byte, bool, error)) ([]byte, error) {
+	if c == nil || c.MaxBytes <= 0 {
+		data, _, err := generate()
+		return data, err
+	}
+
+	c.Lock()
+	c.init()
+
+	if data, ok := c.get(key); ok {
+		c.Unlock()
+		apkovlCacheHitMetric.Inc()
+		return data, nil
+	}
+
+	if call, ok := c.inflight[key]; ok {
+		c.Unlock()
+		call.wg.Wait()
+		if call.err == nil {
+			apkovlCacheHitMetric.Inc()
+		}
+		return call.data, call.err
+	}
+
+	call := &overlayCall{}
+	call.wg.Add(1)
+	c.inflight[key] = call
+	c.Unlock()
+
+	apkovlCacheMissMetric.Inc()
+	var cacheable bool
+	call.data, cacheable, call.err = generate()
+
+	c.Lock()
+	delete(c.inflight, key)
+	if call.err == nil && cacheable {
+		c.put(key, call.data)
+	}
+	c.Unlock()
+
+	call.wg.Done()
+	return call.data, call.err
+}
@@ -0,0 +1,59 @@
+package netboxconfig
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// HostTokenFile is where the check-in script keeps the token that
+// authenticates the host to this server until it next boots. It is on a
+// tmpfs so it is never saved by lbu.
+const HostTokenFile = "/run/netboot/token"
+
+const checkinScriptTemplate = `#!/bin/sh
+# Generated by the netboot server. Reports that the host has reached the
+# default runlevel so the server can detect hosts that fail to boot. The
+# first check-in after a boot registers a random token that authenticates
+# later requests from this host until it boots again.
+(
+	. /etc/os-release
+	umask 077
+	mkdir -p %[1]s
+	[ -s %[2]s ] || head -c 32 /dev/urandom | od -An -tx1 | tr -d ' \n' > %[2]s
+	mac=%[5]s
+	wget -q -O /dev/null \
+		--header "Authorization: Bearer $(cat %[2]s)" \
+		--post-data "distro=%[3]s&kernel=$(uname -r)&uptime=$(cut -d' ' -f1 /proc/uptime)&os_release=${ID}-${VERSION_ID}" \
+		"%[4]s/${mac}/checkin"
+) >/dev/null 2>&1 &
+`
+
+// checkinMacFromCmdline finds the MAC address in the path of the apkovl
+// URL that the host booted with, which is the same spelling the server
+// recorded the host's session under
+const checkinMacFromCmdline = `$(sed -n 's|.*apkovl=[^ ]*/\([^/ ]*\)/apkovl\.tar\.gz.*|\1|p' /proc/cmdline)`
+
+// addCheckinScript adds a local.d script that calls the check-in
+// endpoint once the default runlevel has been reached and enables the
+// local service which runs it. distro is the slug of the distribution
+// being booted, if known. If mac is empty the script reads it from the
+// apkovl URL on the kernel command line so that the overlay can be
+// shared by many hosts.
+func (c *ConfigCoordinator) addCheckinScript(ovl *APKOVL, mac, distro string) error {
+	if c.CheckinUrl == "" {
+		return nil
+	}
+
+	if mac == "" {
+		mac = checkinMacFromCmdline
+	}
+
+	script := fmt.Sprintf(checkinScriptTemplate,
+		"/run/netboot", HostTokenFile, url.QueryEscape(distro), strings.TrimSuffix(c.CheckinUrl, "/"), mac)
+	if err := ovl.AddStringFile(script, "etc/local.d/netboot-checkin.start", 0755); err != nil {
+		return err
+	}
+
+	return ovl.AddRCLink("local", "default")
+}
@@ -0,0 +1,215 @@
+package netboxconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/netip"
+
+	mapset "github.com/deckarep/golang-set/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// Files of the cloud-init NoCloud datasource
+const (
+	CloudInitMetaData      = "meta-data"
+	CloudInitUserData      = "user-data"
+	CloudInitNetworkConfig = "network-config"
+	CloudInitVendorData    = "vendor-data"
+)
+
+const cloudConfigHeader = "#cloud-config\n"
+
+// cloudInitConfig is the cloud_init key of the config context. It is
+// not a plugin so it is ignored when generating an APKOVL.
+type cloudInitConfig struct {
+	Packages   json.RawMessage `json:"packages"`    // Grouped like alpine_packages
+	VendorData map[string]any  `json:"vendor_data"` // Rendered as cloud-config
+}
+
+// ifupdownNgConfig is the subset of the ifupdown_ng plugin config that
+// also applies to netplan
+type ifupdownNgConfig struct {
+	ForcePrimaryDhcp bool `json:"force_primary_dhcp"`
+}
+
+type netplanMatch struct {
+	MacAddress string `yaml:"macaddress"`
+}
+
+type netplanRoute struct {
+	To  string `yaml:"to"`
+	Via string `yaml:"via"`
+}
+
+type netplanEthernet struct {
+	Match     *netplanMatch  `yaml:"match,omitempty"`
+	SetName   string         `yaml:"set-name,omitempty"`
+	Dhcp4     bool           `yaml:"dhcp4"`
+	AcceptRA  bool           `yaml:"accept-ra"`
+	Addresses []string       `yaml:"addresses,omitempty"`
+	Routes    []netplanRoute `yaml:"routes,omitempty"`
+}
+
+// contextValue unmarshals a key of the config context into out. Missing
+// keys leave out unchanged.
+func (c *RawConfig) contextValue(key string, out any) error {
+	raw, ok := c.ConfigContext[key]
+	if !ok || len(raw) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return fmt.Errorf("config context %s: %w", key, err)
+	}
+	return nil
+}
+
+// RenderCloudInit renders a file of the cloud-init NoCloud datasource for
+// a device. The files are built from the same parts of the device record
+// and config context as the APKOVL plugins:
+//
+//	meta-data       instance ID and hostname
+//	user-data       hostname and FQDN like hostname, SSH keys from
+//	                root_ssh_keys and packages from cloud_init
+//	network-config  netplan v2 from the device interfaces like ifupdown_ng
+//	vendor-data     vendor_data from cloud_init
+//
+// Devices without interfaces have no network-config and get
+// fs.ErrNotExist so that cloud-init falls back to DHCP.
+func RenderCloudInit(cfg *RawConfig, name string) ([]byte, error) {
+	switch name {
+	case CloudInitMetaData:
+		return yaml.Marshal(map[string]string{
+			"instance-id":    "netbox-" + cfg.ID,
+			"local-hostname": cfg.Name,
+		})
+	case CloudInitUserData:
+		return cloudInitUserData(cfg)
+	case CloudInitNetworkConfig:
+		return cloudInitNetworkConfig(cfg)
+	case CloudInitVendorData:
+		var config cloudInitConfig
+		if err := cfg.contextValue("cloud_init", &config); err != nil {
+			return nil, err
+		}
+		if config.VendorData == nil {
+			return []byte(cloudConfigHeader), nil
+		}
+		return cloudConfig(config.VendorData)
+	}
+	return nil, fs.ErrNotExist
+}
+
+func cloudConfig(v any) ([]byte, error) {
+	out, err := yaml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(cloudConfigHeader), out...), nil
+}
+
+func cloudInitUserData(cfg *RawConfig) ([]byte, error) {
+	var config cloudInitConfig
+	if err := cfg.contextValue("cloud_init", &config); err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	if err := cfg.contextValue("root_ssh_keys", &keys); err != nil {
+		return nil, err
+	}
+
+	packages := mapset.NewSet[string]()
+	if len(config.Packages) > 0 {
+		groups, err := CollectGroups(config.Packages)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			var groupCfg []string
+			if err := json.Unmarshal(g, &groupCfg); err != nil {
+				return nil, err
+			}
+			for _, pkg := range groupCfg {
+				packages.Add(pkg)
+			}
+		}
+	}
+
+	userData := yaml.MapSlice{
+		{Key: "hostname", Value: cfg.Name},
+		{Key: "fqdn", Value: cfg.Fqdn()},
+		{Key: "manage_etc_hosts", Value: true},
+	}
+	if len(keys) > 0 {
+		userData = append(userData,
+			yaml.MapItem{Key: "disable_root", Value: false},
+			yaml.MapItem{Key: "ssh_authorized_keys", Value: keys},
+		)
+	}
+	if packages.Cardinality() > 0 {
+		userData = append(userData, yaml.MapItem{Key: "packages", Value: mapset.Sorted(packages)})
+	}
+
+	return cloudConfig(userData)
+}
+
+func cloudInitNetworkConfig(cfg *RawConfig) ([]byte, error) {
+	if len(cfg.Interfaces) == 0 {
+		return nil, fs.ErrNotExist
+	}
+
+	var config ifupdownNgConfig
+	if err := cfg.contextValue("ifupdown_ng", &config); err != nil {
+		return nil, err
+	}
+
+	ethernets := map[string]netplanEthernet{}
+	for i, iface := range cfg.Interfaces {
+		eth := netplanEthernet{AcceptRA: true}
+
+		// Interface names in Netbox are rarely the names the kernel gives
+		// a cloud image, so match by MAC address and rename when possible
+		if hw, err := net.ParseMAC(iface.MacAddress); err == nil {
+			eth.Match = &netplanMatch{MacAddress: hw.String()}
+			eth.SetName = iface.Name
+		}
+
+		if i == 0 && config.ForcePrimaryDhcp {
+			eth.Dhcp4 = true
+		} else {
+			haveGateway4, haveGateway6 := false, false
+			for _, address := range iface.IPAddresses {
+				prefix, err := netip.ParsePrefix(address.Address)
+				if err != nil {
+					return nil, err
+				}
+
+				// Same gateway assumption as ifupdown_ng, the first host
+				// address in the network of the first address of each
+				// family
+				haveGateway := &haveGateway4
+				if !prefix.Addr().Is4() {
+					haveGateway = &haveGateway6
+				}
+				if !*haveGateway {
+					gateway := prefix.Masked().Addr().Next()
+					eth.Routes = append(eth.Routes, netplanRoute{To: "default", Via: gateway.String()})
+					*haveGateway = true
+				}
+
+				eth.Addresses = append(eth.Addresses, address.Address)
+			}
+		}
+
+		ethernets[iface.Name] = eth
+	}
+
+	return yaml.Marshal(yaml.MapSlice{
+		{Key: "network", Value: yaml.MapSlice{
+			{Key: "version", Value: 2},
+			{Key: "ethernets", Value: ethernets},
+		}},
+	})
+}
@@ -1,13 +1,19 @@
 package netboxconfig
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"slices"
+	"time"
 
 	"code.crute.us/mcrute/golib/clients/netbox/v4"
+	"code.crute.us/mcrute/netboot-server/store"
 )
 
 type (
@@ -52,9 +58,90 @@ func RegisterConfigFunc(name string, handler handlerFunc) {
 	RegisterConfigPlugin(name, configAdapter{handlerFunc: handler})
 }
 
+// pluginFile is a file or symlink written by a plugin
+type pluginFile struct {
+	APKOVLEntry
+	Contents []byte
+}
+
+// pluginFiles runs plugins into an in-memory APKOVL and returns the
+// entries they wrote, so that formats other than APKOVL can reuse the
+// plugins. Plugins run with their own config context key and are
+// skipped if the device has no config for them, except hostname which
+// needs none.
+func pluginFiles(ctx context.Context, cfg *RawConfig, names []string) ([]pluginFile, error) {
+	buf := &bytes.Buffer{}
+	ovl := NewAPKOVLFromWriter(buf)
+
+	for _, name := range names {
+		plugin, ok := configPlugins[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown plugin %s", name)
+		}
+		pluginCfg, ok := cfg.ConfigContext[name]
+		if !ok && name != "hostname" {
+			continue
+		}
+		if err := plugin.Generate(ctx, ovl, pluginCfg, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	ovl.Close()
+
+	gr, err := gzip.NewReader(buf)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+
+	out := []pluginFile{}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		contents, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, pluginFile{
+			APKOVLEntry: APKOVLEntry{
+				Name:      hdr.Name,
+				Linkname:  hdr.Linkname,
+				Mode:      hdr.Mode,
+				Size:      hdr.Size,
+				Symlink:   hdr.Typeflag == tar.TypeSymlink,
+				Directory: hdr.Typeflag == tar.TypeDir,
+			},
+			Contents: contents,
+		})
+	}
+}
+
 type ConfigCoordinator struct {
 	NetboxClient    *netbox.BasicNetboxClient
 	DefaultConfigId int
+	// CheckinUrl is the base URL of this server. If set, a script that
+	// checks in with the server after boot is added to every APKOVL.
+	CheckinUrl string
+	// Cache holds generated APKOVLs so that repeat requests with the
+	// same inputs are not regenerated. Optional.
+	Cache *OverlayCache
+	// Lbu holds lbu backups uploaded by hosts which are merged into
+	// their next APKOVL. Optional, uploads are disabled if not set.
+	Lbu *LbuStore
+	// Secrets reads secrets, such as password hashes, from Vault for
+	// plugins. Optional, plugins that need secrets fail if not set.
+	Secrets SecretReader
+	// NetboxCache holds the last Netbox response for each host and the
+	// default config context, which are used if Netbox fails. Optional.
+	NetboxCache *store.Bucket[store.CachedResponse]
 }
 
 func (c *ConfigCoordinator) MacExists(ctx context.Context, mac string) (bool, error) {
@@ -62,56 +149,198 @@ func (c *ConfigCoordinator) MacExists(ctx context.Context, mac string) (bool, er
 	return count == 1, err
 }
 
-func (c *ConfigCoordinator) GenerateDefault(ctx context.Context, out io.Writer) error {
-	cfg, err := netboxGetConfigContext(ctx, c.NetboxClient, c.DefaultConfigId)
+// Ping checks that Netbox is reachable and that the API key is valid
+func (c *ConfigCoordinator) Ping(ctx context.Context) error {
+	return netboxGetStatus(ctx, c.NetboxClient)
+}
+
+// GetHost returns the Netbox device record for a MAC address. If no
+// device has the MAC address then the error wraps ErrHostNotFound.
+func (c *ConfigCoordinator) GetHost(ctx context.Context, mac string) (*RawConfig, error) {
+	return netboxCached(c.NetboxCache, "host/"+mac, ErrHostNotFound, func() (*RawConfig, error) {
+		return netboxGetHost(ctx, c.NetboxClient, mac)
+	})
+}
+
+// GetHostBySerial returns the Netbox device record for a serial number.
+// If no device has the serial number then the error wraps
+// ErrSerialNotFound.
+func (c *ConfigCoordinator) GetHostBySerial(ctx context.Context, serial string) (*RawConfig, error) {
+	return netboxCached(c.NetboxCache, "serial/"+serial, ErrSerialNotFound, func() (*RawConfig, error) {
+		return netboxGetHostBySerial(ctx, c.NetboxClient, serial)
+	})
+}
+
+// getDefaultConfig returns the default config context for hosts that are
+// not in Netbox
+func (c *ConfigCoordinator) getDefaultConfig(ctx context.Context) (map[string]json.RawMessage, error) {
+	return netboxCached(c.NetboxCache, fmt.Sprintf("config_context/%d", c.DefaultConfigId), nil, func() (map[string]json.RawMessage, error) {
+		return netboxGetConfigContext(ctx, c.NetboxClient, c.DefaultConfigId)
+	})
+}
+
+// PluginsForHost returns the sorted names of the plugins that would run
+// when generating an APKOVL for the host.
+func (c *ConfigCoordinator) PluginsForHost(cfg *RawConfig) []string {
+	out := []string{"hostname"}
+	for k := range cfg.ConfigContext {
+		if _, pluginExists := configPlugins[k]; pluginExists && k != "hostname" {
+			out = append(out, k)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+// overlayBuildTimeout limits how long a single overlay generation can
+// take, including fetching files for plugins
+const overlayBuildTimeout = 2 * time.Minute
+
+// generate runs the cache lookup for an overlay and writes it to out.
+// The build is shared with concurrent requests for the same overlay so
+// it runs with a context detached from the request that started it,
+// which keeps the context values, otherwise one client disconnecting
+// would fail the generation for every request waiting on it.
+func (c *ConfigCoordinator) generate(ctx context.Context, key string, out io.Writer, build func(context.Context, io.Writer) error) error {
+	data, err := c.Cache.Get(key, func() ([]byte, bool, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), overlayBuildTimeout)
+		defer cancel()
+
+		ctx, secretsRead := trackSecretReads(ctx)
+
+		buf := &bytes.Buffer{}
+		if err := build(ctx, buf); err != nil {
+			return nil, false, err
+		}
+		return buf.Bytes(), !secretsRead.Load(), nil
+	})
 	if err != nil {
 		return err
 	}
 
-	ovl := NewAPKOVLFromWriter(out)
-	defer ovl.Close()
+	_, err = out.Write(data)
+	return err
+}
 
-	for k, v := range cfg {
-		plugin, pluginExists := configPlugins[k]
-		if pluginExists {
-			// Note that not all plugins can work here because there is no
-			// RawConfig, only a default config. This will fail with an error if
-			// anyone configures the default to have a plugin that requires a
-			// RawConfig.
-			if err := plugin.Generate(ctx, ovl, v, nil); err != nil {
-				return err
-			}
+// GenerateDefault generates an APKOVL from the default config context
+// for a host that is not in Netbox. distro is the slug of the
+// distribution the host is booting, if known, which is reported by the
+// check-in script.
+func (c *ConfigCoordinator) GenerateDefault(ctx context.Context, mac, distro string, out io.Writer) error {
+	ctx = withSecretReader(ctx, c.Secrets)
+
+	cfg, err := c.getDefaultConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	plugins := []string{}
+	for k := range cfg {
+		if _, pluginExists := configPlugins[k]; pluginExists {
+			plugins = append(plugins, k)
 		}
 	}
 
-	return nil
+	// The default overlay is shared by every host that is not in Netbox,
+	// the check-in script finds the MAC address when it runs
+	key, err := overlayCacheKey("default", "", distro, c.CheckinUrl, "", plugins, cfg)
+	if err != nil {
+		return err
+	}
+
+	return c.generate(ctx, key, out, func(ctx context.Context, out io.Writer) error {
+		ovl := NewAPKOVLFromWriter(out)
+		defer ovl.Close()
+
+		if err := c.addCheckinScript(ovl, "", distro); err != nil {
+			return err
+		}
+
+		for k, v := range cfg {
+			plugin, pluginExists := configPlugins[k]
+			if pluginExists {
+				// Note that not all plugins can work here because there is no
+				// RawConfig, only a default config. This will fail with an error if
+				// anyone configures the default to have a plugin that requires a
+				// RawConfig.
+				if err := plugin.Generate(ctx, ovl, v, nil); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
 }
 
-// TODO: Chainload into a fully working system (mount data drives, start jobs)
-func (c *ConfigCoordinator) GenerateForMac(ctx context.Context, mac string, out io.Writer) error {
-	cfg, err := netboxGetHost(ctx, c.NetboxClient, mac)
+// GenerateForMac generates an APKOVL for a host in Netbox. distro is the
+// slug of the distribution the host is booting, if known.
+//
+// TODO: Chainload into a fully working system (start jobs). Data drives
+// are mounted by the storage plugin.
+func (c *ConfigCoordinator) GenerateForMac(ctx context.Context, mac, distro string, out io.Writer) error {
+	ctx = withSecretReader(ctx, c.Secrets)
+
+	cfg, err := c.GetHost(ctx, mac)
 	if err != nil {
 		return err
 	}
 
-	ovl := NewAPKOVLFromWriter(out)
-	defer ovl.Close()
+	uploadLbu, mergePaths, err := c.lbuUploadConfig(cfg)
+	if err != nil {
+		return err
+	}
 
-	hostnamePlugin := configPlugins["hostname"]
-	if err := hostnamePlugin.Generate(ctx, ovl, nil, cfg); err != nil {
+	var backup []byte
+	if uploadLbu {
+		if backup, err = c.Lbu.Latest(mac); err != nil {
+			return err
+		}
+	}
+
+	key, err := overlayCacheKey("host", mac, distro, c.CheckinUrl, lbuBackupDigest(backup), c.PluginsForHost(cfg), cfg)
+	if err != nil {
 		return err
 	}
 
-	for k, v := range cfg.ConfigContext {
-		// Ignores plugins that don't exist because config_context can be used
-		// for many other things.
-		plugin, pluginExists := configPlugins[k]
-		if pluginExists {
-			if err := plugin.Generate(ctx, ovl, v, cfg); err != nil {
+	return c.generate(ctx, key, out, func(ctx context.Context, out io.Writer) error {
+		ovl := NewAPKOVLFromWriter(out)
+		defer ovl.Close()
+
+		if err := c.addCheckinScript(ovl, mac, distro); err != nil {
+			return err
+		}
+
+		hostnamePlugin := configPlugins["hostname"]
+		if err := hostnamePlugin.Generate(ctx, ovl, nil, cfg); err != nil {
+			return err
+		}
+
+		for k, v := range cfg.ConfigContext {
+			// Ignores plugins that don't exist because config_context can be used
+			// for many other things.
+			plugin, pluginExists := configPlugins[k]
+			if pluginExists {
+				if err := plugin.Generate(ctx, ovl, v, cfg); err != nil {
+					return err
+				}
+			}
+		}
+
+		if uploadLbu {
+			if err := c.addLbuUploadScript(ovl, mac); err != nil {
+				return err
+			}
+		}
+
+		// Local changes from the last backup are merged last so that
+		// generated files always win
+		if backup != nil {
+			if err := ovl.MergeAPKOVL(bytes.NewReader(backup), mergePaths); err != nil {
 				return err
 			}
 		}
-	}
 
-	return nil
+		return nil
+	})
 }
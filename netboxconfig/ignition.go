@@ -0,0 +1,465 @@
+package netboxconfig
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+)
+
+// IgnitionVersion is the Ignition spec version of generated configs.
+// 3.3.0 is supported by both Fedora CoreOS and Flatcar.
+const IgnitionVersion = "3.3.0"
+
+// ErrInvalidIgnition is wrapped by validation errors for generated
+// Ignition configs
+var ErrInvalidIgnition = errors.New("invalid Ignition config")
+
+type IgnitionConfig struct {
+	Ignition struct {
+		Version string `json:"version"`
+	} `json:"ignition"`
+	Passwd  IgnitionPasswd  `json:"passwd"`
+	Storage IgnitionStorage `json:"storage"`
+	Systemd IgnitionSystemd `json:"systemd"`
+}
+
+type IgnitionPasswd struct {
+	Users []IgnitionUser `json:"users,omitempty"`
+}
+
+type IgnitionUser struct {
+	Name              string   `json:"name"`
+	Groups            []string `json:"groups,omitempty"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty"`
+}
+
+type IgnitionStorage struct {
+	Directories []IgnitionDirectory `json:"directories,omitempty"`
+	Files       []IgnitionFile      `json:"files,omitempty"`
+	Links       []IgnitionLink      `json:"links,omitempty"`
+}
+
+type IgnitionDirectory struct {
+	Path      string `json:"path"`
+	Overwrite bool   `json:"overwrite"`
+	Mode      int    `json:"mode"`
+}
+
+type IgnitionFile struct {
+	Path      string `json:"path"`
+	Overwrite bool   `json:"overwrite"`
+	Mode      int    `json:"mode"`
+	Contents  struct {
+		Source string `json:"source"`
+	} `json:"contents"`
+}
+
+type IgnitionLink struct {
+	Path      string `json:"path"`
+	Overwrite bool   `json:"overwrite"`
+	Target    string `json:"target"`
+}
+
+type IgnitionSystemd struct {
+	Units []IgnitionUnit `json:"units,omitempty"`
+}
+
+type IgnitionUnit struct {
+	Name     string           `json:"name"`
+	Enabled  *bool            `json:"enabled,omitempty"`
+	Mask     bool             `json:"mask,omitempty"`
+	Contents string           `json:"contents,omitempty"`
+	Dropins  []IgnitionDropin `json:"dropins,omitempty"`
+}
+
+type IgnitionDropin struct {
+	Name     string `json:"name"`
+	Contents string `json:"contents"`
+}
+
+// ignitionHostConfig is the ignition key of the config context. Files,
+// units and users support config grouping, each group is a list.
+type ignitionHostConfig struct {
+	Plugins []string        `json:"plugins"`
+	Files   json.RawMessage `json:"files"`
+	Units   json.RawMessage `json:"units"`
+	Users   json.RawMessage `json:"users"`
+}
+
+type ignitionFileConfig struct {
+	Path     string `json:"path"`
+	Contents string `json:"contents"`
+	Url      string `json:"url"`
+	Mode     *int   `json:"mode"`
+}
+
+// ignitionSources are the URL schemes Ignition can fetch contents from
+var ignitionSources = []string{"data", "http", "https", "tftp", "s3", "gs", "arn"}
+
+// ignitionUnitTypes are the systemd unit suffixes Ignition accepts
+var ignitionUnitTypes = []string{
+	".service", ".socket", ".device", ".mount", ".automount", ".swap",
+	".target", ".path", ".timer", ".slice", ".scope",
+}
+
+func dataUrl(contents []byte) string {
+	return "data:;base64," + base64.StdEncoding.EncodeToString(contents)
+}
+
+// collectGroupLists decodes a grouped config where each group is a list
+// and concatenates the groups in order
+func collectGroupLists[T any](grouped json.RawMessage) ([]T, error) {
+	out := []T{}
+	if len(grouped) == 0 {
+		return out, nil
+	}
+
+	groups, err := CollectGroups(grouped)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, g := range groups {
+		var items []T
+		if err := json.Unmarshal(g, &items); err != nil {
+			return nil, err
+		}
+		out = append(out, items...)
+	}
+
+	return out, nil
+}
+
+// GenerateIgnition generates an Ignition config for a host and validates
+// it against the spec before returning it. If no device has the MAC
+// address then the error wraps ErrHostNotFound.
+func (c *ConfigCoordinator) GenerateIgnition(ctx context.Context, mac string) ([]byte, error) {
+	ctx = withSecretReader(ctx, c.Secrets)
+
+	cfg, err := c.GetHost(ctx, mac)
+	if err != nil {
+		return nil, err
+	}
+
+	ign, err := BuildIgnition(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ign.Validate(); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(ign)
+}
+
+// BuildIgnition builds an Ignition config from a device record and its
+// config context. Plugins are reused where their output applies to any
+// distribution:
+//
+//   - hostname always runs and the plugins in the plugins list of the
+//     ignition key run with their own config context keys. The files and
+//     links they write become storage files and links.
+//   - root_ssh_keys become the SSH keys of the root user
+//   - the device interfaces become NetworkManager keyfiles with the same
+//     addressing as ifupdown_ng
+//   - files, units and users from the ignition key are added last and
+//     replace generated files with the same path
+func BuildIgnition(ctx context.Context, cfg *RawConfig) (*IgnitionConfig, error) {
+	var hostCfg ignitionHostConfig
+	if err := cfg.contextValue("ignition", &hostCfg); err != nil {
+		return nil, err
+	}
+
+	ign := &IgnitionConfig{}
+	ign.Ignition.Version = IgnitionVersion
+
+	if err := ign.addPluginFiles(ctx, cfg, hostCfg.Plugins); err != nil {
+		return nil, err
+	}
+
+	if err := ign.addNetworkManager(cfg); err != nil {
+		return nil, err
+	}
+
+	files, err := collectGroupLists[ignitionFileConfig](hostCfg.Files)
+	if err != nil {
+		return nil, fmt.Errorf("ignition files: %w", err)
+	}
+	for _, f := range files {
+		source := f.Url
+		if source == "" {
+			source = dataUrl([]byte(f.Contents))
+		}
+		mode := 0644
+		if f.Mode != nil {
+			mode = *f.Mode
+		}
+		ign.setFile(f.Path, mode, source)
+	}
+
+	units, err := collectGroupLists[IgnitionUnit](hostCfg.Units)
+	if err != nil {
+		return nil, fmt.Errorf("ignition units: %w", err)
+	}
+	ign.Systemd.Units = append(ign.Systemd.Units, units...)
+
+	var rootKeys []string
+	if err := cfg.contextValue("root_ssh_keys", &rootKeys); err != nil {
+		return nil, err
+	}
+	if len(rootKeys) > 0 {
+		ign.addUser(IgnitionUser{Name: "root", SSHAuthorizedKeys: rootKeys})
+	}
+
+	users, err := collectGroupLists[IgnitionUser](hostCfg.Users)
+	if err != nil {
+		return nil, fmt.Errorf("ignition users: %w", err)
+	}
+	for _, u := range users {
+		ign.addUser(u)
+	}
+
+	return ign, nil
+}
+
+// addUser adds a user, merging the groups and keys of a user that is
+// listed more than once
+func (c *IgnitionConfig) addUser(user IgnitionUser) {
+	for i := range c.Passwd.Users {
+		if u := &c.Passwd.Users[i]; u.Name == user.Name {
+			u.Groups = append(u.Groups, user.Groups...)
+			u.SSHAuthorizedKeys = append(u.SSHAuthorizedKeys, user.SSHAuthorizedKeys...)
+			return
+		}
+	}
+	c.Passwd.Users = append(c.Passwd.Users, user)
+}
+
+// setFile adds a file, replacing any file or link with the same path
+func (c *IgnitionConfig) setFile(name string, mode int, source string) {
+	f := IgnitionFile{Path: name, Overwrite: true, Mode: mode}
+	f.Contents.Source = source
+
+	c.Storage.Links = slices.DeleteFunc(c.Storage.Links, func(l IgnitionLink) bool { return l.Path == name })
+	for i := range c.Storage.Files {
+		if c.Storage.Files[i].Path == name {
+			c.Storage.Files[i] = f
+			return
+		}
+	}
+	c.Storage.Files = append(c.Storage.Files, f)
+}
+
+// ignitionPlugins are the plugins whose output applies to any
+// distribution. The other plugins write Alpine configs or OpenRC
+// services.
+var ignitionPlugins = map[string]bool{
+	"hostname":            true,
+	"load_kernel_modules": true,
+	"root_ssh_keys":       true,
+}
+
+// ignitionPluginAlternatives are what to use instead of plugins that
+// can not be used with Ignition
+var ignitionPluginAlternatives = map[string]string{
+	"ifupdown_ng": "interfaces are configured with NetworkManager",
+	"users":       "use the users key of the ignition config",
+}
+
+// addPluginFiles runs the hostname plugin and the named plugins and
+// converts the files and links they write into storage files and links
+func (c *IgnitionConfig) addPluginFiles(ctx context.Context, cfg *RawConfig, plugins []string) error {
+	for _, name := range plugins {
+		if _, ok := configPlugins[name]; !ok {
+			return fmt.Errorf("%w: unknown plugin %s", ErrInvalidIgnition, name)
+		}
+		if !ignitionPlugins[name] {
+			if alternative, ok := ignitionPluginAlternatives[name]; ok {
+				return fmt.Errorf("%w: plugin %s can not be used with Ignition, %s", ErrInvalidIgnition, name, alternative)
+			}
+			return fmt.Errorf("%w: plugin %s can not be used with Ignition", ErrInvalidIgnition, name)
+		}
+	}
+
+	files, err := pluginFiles(ctx, cfg, append([]string{"hostname"}, plugins...))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		name := "/" + strings.TrimPrefix(f.Name, "/")
+		switch {
+		case f.Directory:
+			name = strings.TrimSuffix(name, "/")
+			c.Storage.Directories = append(c.Storage.Directories, IgnitionDirectory{Path: name, Overwrite: true, Mode: int(f.Mode)})
+		case f.Symlink:
+			c.Storage.Links = append(c.Storage.Links, IgnitionLink{Path: name, Overwrite: true, Target: f.Linkname})
+		default:
+			c.setFile(name, int(f.Mode), dataUrl(f.Contents))
+		}
+	}
+
+	return nil
+}
+
+// addNetworkManager adds a NetworkManager keyfile for each interface of
+// the device. Addressing follows ifupdown_ng: the first interface uses
+// DHCP if force_primary_dhcp is set, otherwise the Netbox addresses are
+// static with the gateway of the first address, and IPv6 router
+// advertisements are always accepted.
+func (c *IgnitionConfig) addNetworkManager(cfg *RawConfig) error {
+	var config ifupdownNgConfig
+	if err := cfg.contextValue("ifupdown_ng", &config); err != nil {
+		return err
+	}
+
+	for i, iface := range cfg.Interfaces {
+		buf := &bytes.Buffer{}
+		fmt.Fprintf(buf, "[connection]\nid=%s\ntype=ethernet\n", iface.Name)
+
+		// Match by MAC address when possible because CoreOS does not name
+		// interfaces the way Netbox does
+		if hw, err := net.ParseMAC(iface.MacAddress); err == nil {
+			fmt.Fprintf(buf, "\n[ethernet]\nmac-address=%s\n", strings.ToUpper(hw.String()))
+		} else {
+			fmt.Fprintf(buf, "interface-name=%s\n", iface.Name)
+		}
+
+		v4, v6 := []string{}, []string{}
+		if !(i == 0 && config.ForcePrimaryDhcp) {
+			for _, address := range iface.IPAddresses {
+				prefix, err := netip.ParsePrefix(address.Address)
+				if err != nil {
+					return err
+				}
+
+				// Assumes the gateway is the first host address in the
+				// network of the first address of each family, same as
+				// ifupdown_ng
+				entry := address.Address
+				addrs := &v4
+				if !prefix.Addr().Is4() {
+					addrs = &v6
+				}
+				if len(*addrs) == 0 {
+					entry += "," + prefix.Masked().Addr().Next().String()
+				}
+				*addrs = append(*addrs, entry)
+			}
+		}
+
+		switch {
+		case i == 0 && config.ForcePrimaryDhcp:
+			fmt.Fprint(buf, "\n[ipv4]\nmethod=auto\n")
+		case len(v4) > 0:
+			fmt.Fprint(buf, "\n[ipv4]\nmethod=manual\n")
+		default:
+			fmt.Fprint(buf, "\n[ipv4]\nmethod=disabled\n")
+		}
+		for n, a := range v4 {
+			fmt.Fprintf(buf, "address%d=%s\n", n+1, a)
+		}
+
+		fmt.Fprint(buf, "\n[ipv6]\nmethod=auto\n")
+		for n, a := range v6 {
+			fmt.Fprintf(buf, "address%d=%s\n", n+1, a)
+		}
+
+		name := path.Join("/etc/NetworkManager/system-connections", iface.Name+".nmconnection")
+		c.setFile(name, 0600, dataUrl(buf.Bytes()))
+	}
+
+	return nil
+}
+
+// Validate checks the config against the rules of the Ignition spec that
+// generated configs can break, which Ignition would otherwise only
+// report on the host when it fails to boot
+func (c *IgnitionConfig) Validate() error {
+	if c.Ignition.Version != IgnitionVersion {
+		return fmt.Errorf("%w: unsupported version %q", ErrInvalidIgnition, c.Ignition.Version)
+	}
+
+	paths := map[string]bool{}
+	checkPath := func(p string) error {
+		if !path.IsAbs(p) || path.Clean(p) != p {
+			return fmt.Errorf("%w: path %q must be absolute and clean", ErrInvalidIgnition, p)
+		}
+		if paths[p] {
+			return fmt.Errorf("%w: duplicate path %s", ErrInvalidIgnition, p)
+		}
+		paths[p] = true
+		return nil
+	}
+
+	for _, f := range c.Storage.Files {
+		if err := checkPath(f.Path); err != nil {
+			return err
+		}
+		if f.Mode < 0 || f.Mode > 07777 {
+			return fmt.Errorf("%w: invalid mode %o for %s", ErrInvalidIgnition, f.Mode, f.Path)
+		}
+		u, err := url.Parse(f.Contents.Source)
+		if err != nil || !slices.Contains(ignitionSources, u.Scheme) {
+			return fmt.Errorf("%w: invalid contents source for %s", ErrInvalidIgnition, f.Path)
+		}
+	}
+
+	for _, d := range c.Storage.Directories {
+		if err := checkPath(d.Path); err != nil {
+			return err
+		}
+		if d.Mode < 0 || d.Mode > 07777 {
+			return fmt.Errorf("%w: invalid mode %o for %s", ErrInvalidIgnition, d.Mode, d.Path)
+		}
+	}
+
+	for _, l := range c.Storage.Links {
+		if err := checkPath(l.Path); err != nil {
+			return err
+		}
+		if l.Target == "" {
+			return fmt.Errorf("%w: link %s has no target", ErrInvalidIgnition, l.Path)
+		}
+	}
+
+	units := map[string]bool{}
+	for _, u := range c.Systemd.Units {
+		if strings.Contains(u.Name, "/") || !slices.Contains(ignitionUnitTypes, path.Ext(u.Name)) {
+			return fmt.Errorf("%w: invalid unit name %q", ErrInvalidIgnition, u.Name)
+		}
+		if units[u.Name] {
+			return fmt.Errorf("%w: duplicate unit %s", ErrInvalidIgnition, u.Name)
+		}
+		units[u.Name] = true
+
+		for _, d := range u.Dropins {
+			if strings.Contains(d.Name, "/") || path.Ext(d.Name) != ".conf" {
+				return fmt.Errorf("%w: invalid dropin name %q for %s", ErrInvalidIgnition, d.Name, u.Name)
+			}
+		}
+	}
+
+	users := map[string]bool{}
+	for _, u := range c.Passwd.Users {
+		if u.Name == "" {
+			return fmt.Errorf("%w: user with no name", ErrInvalidIgnition)
+		}
+		if users[u.Name] {
+			return fmt.Errorf("%w: duplicate user %s", ErrInvalidIgnition, u.Name)
+		}
+		users[u.Name] = true
+	}
+
+	return nil
+}
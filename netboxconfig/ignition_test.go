@@ -0,0 +1,45 @@
+package netboxconfig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func init() {
+	// The plugins package registers the real plugins but imports this
+	// package so stand-ins are registered for the tests
+	for _, name := range []string{"hostname", "load_kernel_modules", "alpine_repos", "ifupdown_ng", "users"} {
+		RegisterSimpleConfigFunc(name, func(ovl *APKOVL, cfg json.RawMessage) error {
+			return nil
+		})
+	}
+}
+
+func TestIgnitionPlugins(t *testing.T) {
+	tests := []struct {
+		name    string
+		plugins []string
+		wantErr bool
+	}{
+		{name: "no plugins"},
+		{name: "supported plugin", plugins: []string{"load_kernel_modules"}},
+		{name: "alpine plugin", plugins: []string{"alpine_repos"}, wantErr: true},
+		{name: "network plugin", plugins: []string{"ifupdown_ng"}, wantErr: true},
+		{name: "users plugin", plugins: []string{"users"}, wantErr: true},
+		{name: "unknown plugin", plugins: []string{"missing"}, wantErr: true},
+		{name: "mixed plugins", plugins: []string{"load_kernel_modules", "alpine_repos"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &RawConfig{Name: "host", ConfigContext: map[string]json.RawMessage{}}
+
+			err := (&IgnitionConfig{}).addPluginFiles(context.Background(), cfg, test.plugins)
+			if test.wantErr != errors.Is(err, ErrInvalidIgnition) {
+				t.Errorf("addPluginFiles(%v) = %v, want error %v", test.plugins, err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package netboxconfig
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MaxLbuBackupSize is the largest lbu backup that can be uploaded
+const MaxLbuBackupSize = 64 << 20
+
+// ErrLbuBackupTooLarge is returned when an uploaded backup is larger than
+// MaxLbuBackupSize
+var ErrLbuBackupTooLarge = errors.New("lbu backup too large")
+
+// ErrInvalidLbuBackup is returned when an uploaded backup is not a
+// readable APKOVL or contains links
+var ErrInvalidLbuBackup = errors.New("invalid lbu backup")
+
+const lbuUploadScriptTemplate = `#!/bin/sh
+# Generated by the netboot server. Packages the local changes tracked by
+# lbu and uploads them to the netboot server, which merges them into the
+# overlay for the next boot.
+set -e
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+lbu package "$tmp/backup.apkovl.tar.gz"
+wget -q -O /dev/null \
+	--header "Authorization: Bearer $(cat %s)" \
+	--header "Content-Type: application/gzip" \
+	--post-file "$tmp/backup.apkovl.tar.gz" \
+	"%s/%s/lbu"
+`
+
+// lbuUploadStopScript uploads a backup when the local service stops,
+// which is when the host is shut down or rebooted cleanly
+const lbuUploadStopScript = `#!/bin/sh
+# Generated by the netboot server. Uploads local changes on shutdown.
+/usr/local/sbin/netboot-lbu-upload >/dev/null 2>&1
+`
+
+// LbuStore holds the latest lbu backup uploaded by each host
+type LbuStore struct {
+	dir string
+}
+
+// OpenLbuStore opens the backup store in a directory, creating the
+// directory if it does not exist
+func OpenLbuStore(dir string) (*LbuStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &LbuStore{dir: dir}, nil
+}
+
+// path returns the backup file for a host. The MAC address is normalized
+// so that every spelling of it refers to the same backup.
+func (s *LbuStore) path(mac string) string {
+	if hw, err := net.ParseMAC(mac); err == nil {
+		mac = hw.String()
+	}
+	return filepath.Join(s.dir, strings.ReplaceAll(mac, ":", "")+".apkovl.tar.gz")
+}
+
+// Save replaces the latest backup for a host. The backup must be a
+// readable APKOVL no larger than MaxLbuBackupSize without symlinks or
+// hardlinks, which could point outside of the merged paths. It is
+// written to a
+// temporary file and renamed into place so that a failed upload never
+// replaces a good backup.
+func (s *LbuStore) Save(mac string, in io.Reader) error {
+	data, err := io.ReadAll(&io.LimitedReader{R: in, N: MaxLbuBackupSize + 1})
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxLbuBackupSize {
+		return ErrLbuBackupTooLarge
+	}
+
+	entries, err := ListAPKOVL(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidLbuBackup, err)
+	}
+	for _, e := range entries {
+		if e.Symlink || e.Hardlink {
+			return fmt.Errorf("%w: %s is a link", ErrInvalidLbuBackup, e.Name)
+		}
+	}
+
+	tmp, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path(mac))
+}
+
+// Latest returns the latest backup for a host, or nil if the host has
+// not uploaded one
+func (s *LbuStore) Latest(mac string) ([]byte, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(s.path(mac))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// lbuUploadConfig returns true if the host opted in to uploading lbu
+// backups with the upload key of its alpine_lbu config and the server
+// can accept them. The merge_paths key lists the paths of the backup
+// that are merged into the host's APKOVL.
+func (c *ConfigCoordinator) lbuUploadConfig(cfg *RawConfig) (bool, []string, error) {
+	if c.Lbu == nil || c.CheckinUrl == "" {
+		return false, nil, nil
+	}
+
+	var config struct {
+		Upload     bool     `json:"upload"`
+		MergePaths []string `json:"merge_paths"`
+	}
+	if err := cfg.contextValue("alpine_lbu", &config); err != nil {
+		return false, nil, err
+	}
+	return config.Upload, config.MergePaths, nil
+}
+
+// addLbuUploadScript adds a script that uploads lbu backups to this
+// server and runs it when the host shuts down. The upload is
+// authenticated with the host token registered by the check-in script.
+// The local service which runs it is enabled by the check-in script,
+// which is always added when the server URL is known.
+func (c *ConfigCoordinator) addLbuUploadScript(ovl *APKOVL, mac string) error {
+	script := fmt.Sprintf(lbuUploadScriptTemplate, HostTokenFile, strings.TrimSuffix(c.CheckinUrl, "/"), mac)
+	if err := ovl.AddStringFile(script, "usr/local/sbin/netboot-lbu-upload", 0755); err != nil {
+		return err
+	}
+	return ovl.AddStringFile(lbuUploadStopScript, "etc/local.d/netboot-lbu.stop", 0755)
+}
+
+// lbuBackupDigest returns a digest of a backup for overlay cache keys
+func lbuBackupDigest(backup []byte) string {
+	if backup == nil {
+		return ""
+	}
+	sum := sha256.Sum256(backup)
+	return hex.EncodeToString(sum[:])
+}
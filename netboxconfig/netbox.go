@@ -3,20 +3,30 @@ package netboxconfig
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"regexp"
 
 	"code.crute.us/mcrute/golib/clients/netbox/v4"
 )
 
-const hostQuery = `query {
-  interface_list(filters: {mac_address: "%s"}) {
-    device {
+// deviceFields are the fields of a device record that are queried
+const deviceFields = `
+      id
       name
+      serial
       config_context
       custom_fields
+      primary_ip4 {
+        address
+      }
+      primary_ip6 {
+        address
+      }
       interfaces {
         name
+        mac_address
         ip_addresses {
           address
         }
@@ -24,11 +34,30 @@ const hostQuery = `query {
       site {
         name
         custom_fields
-      }
+      }`
+
+const hostQuery = `query {
+  interface_list(filters: {mac_address: "%s"}) {
+    device {` + deviceFields + `
     }
   }
 }`
 
+const serialQuery = `query {
+  device_list(filters: {serial: "%s"}) {` + deviceFields + `
+  }
+}`
+
+var serialRegexp = regexp.MustCompile(`^[0-9a-zA-Z-]+$`)
+
+// ErrHostNotFound is returned when no device in Netbox has an
+// interface with the requested MAC address.
+var ErrHostNotFound = errors.New("No devices found for mac")
+
+// ErrSerialNotFound is returned when no device in Netbox has the
+// requested serial number.
+var ErrSerialNotFound = errors.New("No devices found for serial")
+
 type rawConfigEnvelope struct {
 	Data struct {
 		InterfaceList []struct {
@@ -37,14 +66,29 @@ type rawConfigEnvelope struct {
 	} `json:"data"`
 }
 
+type serialEnvelope struct {
+	Data struct {
+		DeviceList []*RawConfig `json:"device_list"`
+	} `json:"data"`
+}
+
 type RawConfig struct {
+	ID            string                     `json:"id"`
 	Name          string                     `json:"name"`
+	Serial        string                     `json:"serial"`
 	ConfigContext map[string]json.RawMessage `json:"config_context"`
 	CustomFields  struct {
 		RootVaultPath string `json:"root_vault_path"`
 	} `json:"custom_fields"`
+	PrimaryIP4 *struct {
+		Address string `json:"address"`
+	} `json:"primary_ip4"`
+	PrimaryIP6 *struct {
+		Address string `json:"address"`
+	} `json:"primary_ip6"`
 	Interfaces []struct {
 		Name        string `json:"name"`
+		MacAddress  string `json:"mac_address"`
 		IPAddresses []struct {
 			Address string `json:"address"`
 		} `json:"ip_addresses"`
@@ -57,6 +101,32 @@ type RawConfig struct {
 	} `json:"site"`
 }
 
+// Fqdn returns the fully qualified domain name of the device, which is
+// the device name within the base FQDN of its site.
+func (c *RawConfig) Fqdn() string {
+	return fmt.Sprintf("%s.%s", c.Name, c.Site.CustomFields.BaseFqdn)
+}
+
+// MacAddress returns the MAC address of the device's eth0 interface or of
+// its first interface with a MAC address if it has no eth0. It is empty
+// if no interface has a MAC address.
+func (c *RawConfig) MacAddress() string {
+	mac := ""
+	for _, iface := range c.Interfaces {
+		hw, err := net.ParseMAC(iface.MacAddress)
+		if err != nil {
+			continue
+		}
+		if iface.Name == "eth0" {
+			return hw.String()
+		}
+		if mac == "" {
+			mac = hw.String()
+		}
+	}
+	return mac
+}
+
 func netboxGetHost(ctx context.Context, client *netbox.BasicNetboxClient, mac string) (*RawConfig, error) {
 	_, err := net.ParseMAC(mac)
 	if err != nil {
@@ -71,12 +141,31 @@ func netboxGetHost(ctx context.Context, client *netbox.BasicNetboxClient, mac st
 	}
 
 	if len(m.Data.InterfaceList) != 1 {
-		return nil, fmt.Errorf("No devices found for mac %s", mac)
+		return nil, fmt.Errorf("%w %s", ErrHostNotFound, mac)
 	}
 
 	return m.Data.InterfaceList[0].Device, nil
 }
 
+func netboxGetHostBySerial(ctx context.Context, client *netbox.BasicNetboxClient, serial string) (*RawConfig, error) {
+	if !serialRegexp.MatchString(serial) {
+		return nil, fmt.Errorf("Invalid serial number format: %q", serial)
+	}
+
+	var m serialEnvelope
+	if err := client.Do(ctx, &netbox.NetboxGraphQLRequest{
+		Query: fmt.Sprintf(serialQuery, serial),
+	}, &m); err != nil {
+		return nil, err
+	}
+
+	if len(m.Data.DeviceList) != 1 {
+		return nil, fmt.Errorf("%w %s", ErrSerialNotFound, serial)
+	}
+
+	return m.Data.DeviceList[0], nil
+}
+
 func netboxGetInterfaceCountForMac(ctx context.Context, client *netbox.BasicNetboxClient, mac string) (int, error) {
 	q := netbox.NewNetboxGetRequest("/api/dcim/interfaces/")
 	q.Add("mac_address", mac)
@@ -101,3 +190,8 @@ func netboxGetConfigContext(ctx context.Context, client *netbox.BasicNetboxClien
 	}
 	return out.Data, nil
 }
+
+func netboxGetStatus(ctx context.Context, client *netbox.BasicNetboxClient) error {
+	out := map[string]any{}
+	return client.Do(ctx, netbox.NewNetboxGetRequest("/api/status/"), &out)
+}
@@ -0,0 +1,70 @@
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"code.crute.us/mcrute/netboot-server/netboxconfig"
+)
+
+func init() {
+	netboxconfig.RegisterSimpleConfigFunc("alpine_lbu", generateAlpineLbu)
+}
+
+type lbuConfig struct {
+	Media       string   `json:"media"`        // LBU_MEDIA, ex: usb
+	BackupDir   string   `json:"backup_dir"`   // LBU_BACKUPDIR, used instead of media
+	Cipher      string   `json:"cipher"`       // DEFAULT_CIPHER, ex: aes-256-cbc
+	BackupLimit *int     `json:"backup_limit"` // BACKUP_LIMIT
+	Include     []string `json:"include"`
+	Exclude     []string `json:"exclude"`
+	// Upload and MergePaths are read by the coordinator, which adds the
+	// upload script when the server accepts backups
+	Upload     bool     `json:"upload"`
+	MergePaths []string `json:"merge_paths"`
+}
+
+func generateAlpineLbu(ovl *netboxconfig.APKOVL, cfg json.RawMessage) error {
+	var config lbuConfig
+	if err := json.Unmarshal(cfg, &config); err != nil {
+		return err
+	}
+
+	if config.Media != "" && config.BackupDir != "" {
+		return fmt.Errorf("alpine_lbu: only one of media or backup_dir can be set")
+	}
+
+	conf := []string{"# Generated by the netboot server"}
+	if config.Media != "" {
+		conf = append(conf, fmt.Sprintf("LBU_MEDIA=%s", config.Media))
+	}
+	if config.BackupDir != "" {
+		conf = append(conf, fmt.Sprintf("LBU_BACKUPDIR=%s", config.BackupDir))
+	}
+	if config.Cipher != "" {
+		conf = append(conf, fmt.Sprintf("DEFAULT_CIPHER=%s", config.Cipher))
+	}
+	if config.BackupLimit != nil {
+		conf = append(conf, fmt.Sprintf("BACKUP_LIMIT=%d", *config.BackupLimit))
+	}
+
+	if err := ovl.AddStringListFile(conf, "etc/lbu/lbu.conf", 0644); err != nil {
+		return err
+	}
+
+	if len(config.Include) == 0 && len(config.Exclude) == 0 {
+		return nil
+	}
+
+	// This is the file that lbu include and lbu exclude maintain
+	paths := []string{}
+	for _, p := range config.Include {
+		paths = append(paths, "+"+strings.TrimPrefix(p, "/"))
+	}
+	for _, p := range config.Exclude {
+		paths = append(paths, "-"+strings.TrimPrefix(p, "/"))
+	}
+
+	return ovl.AddStringListFile(paths, "etc/apk/protected_paths.d/lbu.list", 0644)
+}
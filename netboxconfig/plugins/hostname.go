@@ -17,7 +17,7 @@ func generateHostname(_ context.Context, ovl *netboxconfig.APKOVL, _ json.RawMes
 		return err
 	}
 
-	fqdn := fmt.Sprintf("%s.%s", cfg.Name, cfg.Site.CustomFields.BaseFqdn)
+	fqdn := cfg.Fqdn()
 
 	hostEntries := []string{
 		fmt.Sprintf("127.0.0.1       %s %s localhost localhost.localdomain", fqdn, cfg.Name),
@@ -0,0 +1,237 @@
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"code.crute.us/mcrute/netboot-server/netboxconfig"
+)
+
+func init() {
+	netboxconfig.RegisterSimpleConfigFunc("storage", generateStorage)
+}
+
+var (
+	zfsPoolRegexp   = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.:-]*$`)
+	mdadmUuidRegexp = regexp.MustCompile(`^[0-9A-Fa-f]{8}(:[0-9A-Fa-f]{8}){3}$`)
+	fsTypeRegexp    = regexp.MustCompile(`^[A-Za-z0-9_.+-]+$`)
+)
+
+type storageMount struct {
+	Path      string   `json:"path"`
+	Label     string   `json:"label"`
+	Uuid      string   `json:"uuid"`
+	Serial    string   `json:"serial"`    // Name in /dev/disk/by-id, which contains the serial
+	Partition int      `json:"partition"` // Partition of the serial disk, if any
+	Device    string   `json:"device"`    // Any other device, ex: /dev/md0 or /dev/vg0/data
+	Type      string   `json:"type"`
+	Options   []string `json:"options"`
+	Required  bool     `json:"required"` // Fail the boot if the mount fails
+	Pass      int      `json:"pass"`
+}
+
+type storageArray struct {
+	Device string `json:"device"`
+	Uuid   string `json:"uuid"`
+}
+
+type storageConfig struct {
+	Mounts   []storageMount `json:"mounts"`
+	Arrays   []storageArray `json:"mdadm"`
+	Lvm      bool           `json:"lvm"`
+	ZfsPools []string       `json:"zfs_pools"`
+}
+
+// fstabEscape escapes the characters that separate fstab fields and
+// lines
+func fstabEscape(s string) string {
+	return strings.NewReplacer(`\`, `\134`, " ", `\040`, "\t", `\011`, "\n", `\012`).Replace(s)
+}
+
+// validate returns an error if an array can not be written to
+// mdadm.conf, which is split on whitespace
+func (a storageArray) validate() error {
+	if !path.IsAbs(a.Device) || strings.ContainsAny(a.Device, " \t\n") {
+		return fmt.Errorf("mdadm device %q must be an absolute path without spaces", a.Device)
+	}
+	if !mdadmUuidRegexp.MatchString(a.Uuid) {
+		return fmt.Errorf("mdadm array %s has invalid uuid %q", a.Device, a.Uuid)
+	}
+	return nil
+}
+
+func (m storageMount) source() (string, error) {
+	sources := []string{}
+	if m.Label != "" {
+		sources = append(sources, "LABEL="+m.Label)
+	}
+	if m.Uuid != "" {
+		sources = append(sources, "UUID="+m.Uuid)
+	}
+	if m.Serial != "" {
+		if strings.Contains(m.Serial, "/") || m.Serial == "." || m.Serial == ".." {
+			return "", fmt.Errorf("mount %s has invalid serial %q", m.Path, m.Serial)
+		}
+		dev := path.Join("/dev/disk/by-id", m.Serial)
+		if m.Partition > 0 {
+			dev = fmt.Sprintf("%s-part%d", dev, m.Partition)
+		}
+		sources = append(sources, dev)
+	}
+	if m.Device != "" {
+		if !path.IsAbs(m.Device) {
+			return "", fmt.Errorf("mount %s device %q must be an absolute path", m.Path, m.Device)
+		}
+		sources = append(sources, m.Device)
+	}
+
+	if len(sources) != 1 {
+		return "", fmt.Errorf("mount %s must have exactly one of label, uuid, serial or device", m.Path)
+	}
+	return sources[0], nil
+}
+
+func (m storageMount) fstabLine() (string, error) {
+	if !path.IsAbs(m.Path) || path.Clean(m.Path) == "/" {
+		return "", fmt.Errorf("mount path %q must be absolute and not /", m.Path)
+	}
+
+	source, err := m.source()
+	if err != nil {
+		return "", err
+	}
+
+	fsType := m.Type
+	if fsType == "" {
+		fsType = "auto"
+	}
+	if !fsTypeRegexp.MatchString(fsType) {
+		return "", fmt.Errorf("mount %s has invalid type %q", m.Path, m.Type)
+	}
+
+	for _, o := range m.Options {
+		if o == "" || strings.ContainsAny(o, ", \t\n") {
+			return "", fmt.Errorf("mount %s has invalid option %q", m.Path, o)
+		}
+	}
+
+	options := slices.Clone(m.Options)
+	if len(options) == 0 {
+		options = []string{"defaults"}
+	}
+	// A missing data disk should not stop the host from booting far
+	// enough to be fixed remotely
+	if !m.Required {
+		options = append(options, "nofail")
+	}
+
+	return fmt.Sprintf("%s %s %s %s 0 %d",
+		fstabEscape(source), fstabEscape(path.Clean(m.Path)), fsType, strings.Join(options, ","), m.Pass), nil
+}
+
+const zfsImportScript = `#!/sbin/openrc-run
+
+description="Import ZFS pools configured in Netbox"
+
+depend() {
+	need sysfs
+	after modules mdadm-raid lvm
+	before localmount
+}
+
+start() {
+	ebegin "Importing ZFS pools"
+	modprobe zfs
+	for pool in %s; do
+		if ! zpool list "$pool" >/dev/null 2>&1; then
+			zpool import -N "$pool" || ewarn "Unable to import ZFS pool $pool"
+		fi
+	done
+	zfs mount -a
+	eend 0
+}
+`
+
+func generateStorage(ovl *netboxconfig.APKOVL, cfg json.RawMessage) error {
+	groups, err := netboxconfig.CollectGroups(cfg)
+	if err != nil {
+		return err
+	}
+
+	var config storageConfig
+	for _, g := range groups {
+		var groupCfg storageConfig
+		if err := json.Unmarshal(g, &groupCfg); err != nil {
+			return err
+		}
+
+		config.Mounts = append(config.Mounts, groupCfg.Mounts...)
+		config.Arrays = append(config.Arrays, groupCfg.Arrays...)
+		config.Lvm = config.Lvm || groupCfg.Lvm
+		config.ZfsPools = append(config.ZfsPools, groupCfg.ZfsPools...)
+	}
+
+	if len(config.Arrays) > 0 {
+		lines := []string{"DEVICE partitions"}
+		for _, a := range config.Arrays {
+			if err := a.validate(); err != nil {
+				return err
+			}
+			lines = append(lines, fmt.Sprintf("ARRAY %s UUID=%s", a.Device, a.Uuid))
+		}
+		if err := ovl.AddStringListFile(lines, "etc/mdadm.conf", 0644); err != nil {
+			return err
+		}
+		if err := ovl.AddRCLink("mdadm-raid", "boot"); err != nil {
+			return err
+		}
+	}
+
+	if config.Lvm {
+		if err := ovl.AddRCLink("lvm", "boot"); err != nil {
+			return err
+		}
+	}
+
+	if len(config.ZfsPools) > 0 {
+		for _, pool := range config.ZfsPools {
+			if !zfsPoolRegexp.MatchString(pool) {
+				return fmt.Errorf("invalid ZFS pool name %q", pool)
+			}
+		}
+		script := fmt.Sprintf(zfsImportScript, strings.Join(config.ZfsPools, " "))
+		if err := ovl.AddStringFile(script, "etc/init.d/netboot-zfs-import", 0755); err != nil {
+			return err
+		}
+		if err := ovl.AddRCLink("netboot-zfs-import", "boot"); err != nil {
+			return err
+		}
+	}
+
+	if len(config.Mounts) > 0 {
+		lines := []string{}
+		for _, m := range config.Mounts {
+			line, err := m.fstabLine()
+			if err != nil {
+				return err
+			}
+			lines = append(lines, line)
+
+			if err := ovl.AddDirectory(strings.TrimPrefix(path.Clean(m.Path), "/"), 0755); err != nil {
+				return err
+			}
+		}
+		if err := ovl.AddStringListFile(lines, "etc/fstab", 0644); err != nil {
+			return err
+		}
+		if err := ovl.AddRCLink("localmount", "boot"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,250 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"code.crute.us/mcrute/netboot-server/netboxconfig"
+)
+
+func init() {
+	netboxconfig.RegisterConfigFunc("users", generateUsers)
+}
+
+var userNameRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+type userConfig struct {
+	Uid          int      `json:"uid"`
+	Gid          *int     `json:"gid"` // Default a personal group with the uid as gid
+	Gecos        string   `json:"gecos"`
+	Home         string   `json:"home"`  // Default /home/<name>
+	Shell        string   `json:"shell"` // Default /bin/ash
+	Groups       []string `json:"groups"`
+	SSHKeys      []string `json:"ssh_keys"`
+	PasswordPath string   `json:"password_vault_path"` // Vault secret with a hash key
+	Doas         bool     `json:"doas"`
+	DoasNopass   bool     `json:"doas_nopass"` // Allow doas without a password
+}
+
+type usersGroupConfig struct {
+	Users  map[string]userConfig `json:"users"`
+	Groups map[string]int        `json:"groups"`
+}
+
+// passwordSecret is the Vault secret that holds a crypt(3) password hash
+// for a user, such as the output of mkpasswd
+type passwordSecret struct {
+	Hash string `json:"hash"`
+}
+
+const usersInitScript = `#!/sbin/openrc-run
+
+description="Add users and groups configured in Netbox"
+
+depend() {
+	before sshd local
+}
+
+# merge appends the entries in a generated file whose name is not already
+# in the system file
+merge() {
+	[ -f "$1" ] || return 0
+	new=$(awk -F: 'NR == FNR { seen[$1] = 1; next } !($1 in seen)' "$2" "$1")
+	[ -z "$new" ] || echo "$new" >> "$2"
+}
+
+start() {
+	ebegin "Adding users and groups"
+	merge /etc/netboot/users/group /etc/group
+	merge /etc/netboot/users/passwd /etc/passwd
+	merge /etc/netboot/users/shadow /etc/shadow
+	if [ -f /etc/netboot/users/members ]; then
+		while read -r group user; do
+			addgroup "$user" "$group" >/dev/null 2>&1 || true
+		done < /etc/netboot/users/members
+	fi
+	eend 0
+}
+`
+
+// validPasswdField returns true if a value can be written to a field of
+// /etc/passwd without corrupting it
+func validPasswdField(s string) bool {
+	return !strings.ContainsAny(s, ":\n")
+}
+
+// userPasswordHash reads the password hash for a user from Vault. Users
+// without a secret can only log in with an SSH key.
+func userPasswordHash(ctx context.Context, name string, u userConfig) (string, error) {
+	if u.PasswordPath == "" {
+		return "*", nil
+	}
+
+	var secret passwordSecret
+	if err := netboxconfig.ReadSecret(ctx, u.PasswordPath, &secret); err != nil {
+		return "", fmt.Errorf("users: reading password for %s: %w", name, err)
+	}
+	if secret.Hash == "" || !validPasswdField(secret.Hash) {
+		return "", fmt.Errorf("users: invalid password hash for %s in %s", name, u.PasswordPath)
+	}
+	return secret.Hash, nil
+}
+
+func generateUsers(ctx context.Context, ovl *netboxconfig.APKOVL, cfg json.RawMessage, _ *netboxconfig.RawConfig) error {
+	groups, err := netboxconfig.CollectGroups(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Later groups override earlier ones, the same as other grouped
+	// config
+	users := map[string]userConfig{}
+	groupIds := map[string]int{}
+	for _, g := range groups {
+		var groupCfg usersGroupConfig
+		if err := json.Unmarshal(g, &groupCfg); err != nil {
+			return err
+		}
+		for name, u := range groupCfg.Users {
+			users[name] = u
+		}
+		for name, gid := range groupCfg.Groups {
+			groupIds[name] = gid
+		}
+	}
+
+	if len(users) == 0 && len(groupIds) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	passwd, shadow, members, doas := []string{}, []string{}, []string{}, []string{}
+	for _, name := range names {
+		u := users[name]
+
+		if !userNameRegexp.MatchString(name) {
+			return fmt.Errorf("users: invalid user name %q", name)
+		}
+		if u.Uid <= 0 {
+			return fmt.Errorf("users: user %s must have a uid greater than 0", name)
+		}
+
+		gid := u.Uid
+		if u.Gid != nil {
+			gid = *u.Gid
+		} else if _, ok := groupIds[name]; !ok {
+			groupIds[name] = u.Uid
+		}
+
+		home := u.Home
+		if home == "" {
+			home = path.Join("/home", name)
+		}
+		if !path.IsAbs(home) || path.Clean(home) == "/" {
+			return fmt.Errorf("users: home of %s must be absolute and not /", name)
+		}
+		home = path.Clean(home)
+
+		shell := u.Shell
+		if shell == "" {
+			shell = "/bin/ash"
+		}
+
+		if !validPasswdField(u.Gecos) || !validPasswdField(home) || !validPasswdField(shell) {
+			return fmt.Errorf("users: fields of %s can not contain colons or newlines", name)
+		}
+
+		hash, err := userPasswordHash(ctx, name, u)
+		if err != nil {
+			return err
+		}
+
+		passwd = append(passwd, fmt.Sprintf("%s:x:%d:%d:%s:%s:%s", name, u.Uid, gid, u.Gecos, home, shell))
+		shadow = append(shadow, fmt.Sprintf("%s:%s:::::::", name, hash))
+
+		for _, g := range u.Groups {
+			if !userNameRegexp.MatchString(g) {
+				return fmt.Errorf("users: invalid group name %q for %s", g, name)
+			}
+			members = append(members, fmt.Sprintf("%s %s", g, name))
+		}
+
+		// Users without a password can not authenticate to doas so
+		// passwordless root must be asked for explicitly
+		if u.DoasNopass {
+			doas = append(doas, fmt.Sprintf("permit nopass %s", name))
+		} else if u.Doas {
+			if hash == "*" {
+				return fmt.Errorf("users: doas for %s requires a password or doas_nopass", name)
+			}
+			doas = append(doas, fmt.Sprintf("permit persist %s", name))
+		}
+
+		homeDir := strings.TrimPrefix(home, "/")
+		if err := ovl.AddOwnedDirectory(homeDir, 0755, u.Uid, gid); err != nil {
+			return err
+		}
+		if len(u.SSHKeys) > 0 {
+			if err := ovl.AddOwnedDirectory(path.Join(homeDir, ".ssh"), 0700, u.Uid, gid); err != nil {
+				return err
+			}
+			keys := strings.Join(u.SSHKeys, "\n")
+			if err := ovl.AddOwnedStringFile(keys, path.Join(homeDir, ".ssh/authorized_keys"), 0600, u.Uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+
+	groupNames := make([]string, 0, len(groupIds))
+	for name := range groupIds {
+		if !userNameRegexp.MatchString(name) {
+			return fmt.Errorf("users: invalid group name %q", name)
+		}
+		groupNames = append(groupNames, name)
+	}
+	slices.Sort(groupNames)
+
+	group := make([]string, len(groupNames))
+	for i, name := range groupNames {
+		group[i] = fmt.Sprintf("%s:x:%d:", name, groupIds[name])
+	}
+
+	for _, f := range []struct {
+		lines []string
+		name  string
+		mode  int64
+	}{
+		{group, "etc/netboot/users/group", 0644},
+		{passwd, "etc/netboot/users/passwd", 0644},
+		{shadow, "etc/netboot/users/shadow", 0600},
+		{members, "etc/netboot/users/members", 0644},
+	} {
+		if len(f.lines) == 0 {
+			continue
+		}
+		if err := ovl.AddStringListFile(f.lines, f.name, f.mode); err != nil {
+			return err
+		}
+	}
+
+	if len(doas) > 0 {
+		if err := ovl.AddStringListFile(doas, "etc/doas.d/users.conf", 0644); err != nil {
+			return err
+		}
+	}
+
+	if err := ovl.AddStringFile(usersInitScript, "etc/init.d/netboot-users", 0755); err != nil {
+		return err
+	}
+	return ovl.AddRCLink("netboot-users", "boot")
+}
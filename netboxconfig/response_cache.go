@@ -0,0 +1,82 @@
+package netboxconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"code.crute.us/mcrute/netboot-server/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	netboxCacheFallbackMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_netbox_cache_fallbacks",
+		Help: "Netbox lookups answered from the state store because Netbox failed",
+	})
+	netboxCacheWriteFailureMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_netbox_cache_write_failures",
+		Help: "Netbox responses that could not be saved to the state store",
+	})
+)
+
+// netboxCacheRefresh is how often an unchanged response is rewritten to
+// the store, which keeps it from expiring while Netbox is reachable
+// without writing every lookup to the store
+const netboxCacheRefresh = time.Hour
+
+// netboxCached runs a Netbox lookup, saving successful responses to the
+// cache under key. If the lookup fails for any reason other than
+// notFound the cached response is returned instead so that hosts can
+// boot while Netbox is unavailable. Responses for records that were
+// removed from Netbox are dropped. A nil cache only runs the lookup.
+func netboxCached[T any](cache *store.Bucket[store.CachedResponse], key string, notFound error, lookup func() (T, error)) (T, error) {
+	value, err := lookup()
+	if err == nil {
+		saveNetboxResponse(cache, key, value)
+		return value, nil
+	}
+
+	if notFound != nil && errors.Is(err, notFound) {
+		if cerr := cache.Delete(key); cerr != nil {
+			netboxCacheWriteFailureMetric.Inc()
+		}
+		return value, err
+	}
+
+	cached, ok, cerr := cache.Get(key)
+	if !ok || cerr != nil {
+		return value, err
+	}
+
+	var out T
+	if json.Unmarshal(cached.Body, &out) != nil {
+		return value, err
+	}
+
+	netboxCacheFallbackMetric.Inc()
+	return out, nil
+}
+
+func saveNetboxResponse(cache *store.Bucket[store.CachedResponse], key string, value any) {
+	if cache == nil {
+		return
+	}
+
+	body, err := json.Marshal(value)
+	if err != nil {
+		netboxCacheWriteFailureMetric.Inc()
+		return
+	}
+
+	now := time.Now()
+	if cached, ok, _ := cache.Get(key); ok && bytes.Equal(cached.Body, body) && now.Sub(cached.Fetched) < netboxCacheRefresh {
+		return
+	}
+
+	if err := cache.Put(key, store.CachedResponse{Fetched: now, Body: body}); err != nil {
+		netboxCacheWriteFailureMetric.Inc()
+	}
+}
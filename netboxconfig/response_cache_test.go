@@ -0,0 +1,92 @@
+package netboxconfig
+
+import (
+	"errors"
+	"testing"
+
+	"code.crute.us/mcrute/netboot-server/store"
+	"go.uber.org/zap"
+)
+
+func TestNetboxCached(t *testing.T) {
+	errOutage := errors.New("connection refused")
+
+	tests := []struct {
+		name    string
+		cached  string
+		value   string
+		err     error
+		want    string
+		wantErr error
+		wantKey bool
+	}{
+		{
+			name:    "lookup saved",
+			value:   "fresh",
+			want:    "fresh",
+			wantKey: true,
+		},
+		{
+			name:    "lookup replaces cached",
+			cached:  "stale",
+			value:   "fresh",
+			want:    "fresh",
+			wantKey: true,
+		},
+		{
+			name:    "outage uses cached",
+			cached:  "stale",
+			err:     errOutage,
+			want:    "stale",
+			wantKey: true,
+		},
+		{
+			name:    "outage without cached",
+			err:     errOutage,
+			wantErr: errOutage,
+		},
+		{
+			name:    "not found drops cached",
+			cached:  "stale",
+			err:     ErrHostNotFound,
+			wantErr: ErrHostNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := store.Open(t.TempDir(), zap.NewNop(), store.NetboxCache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			cache := store.Typed[store.CachedResponse](s, store.NetboxCache)
+			if test.cached != "" {
+				saveNetboxResponse(cache, "key", test.cached)
+			}
+
+			got, err := netboxCached(cache, "key", ErrHostNotFound, func() (string, error) {
+				return test.value, test.err
+			})
+			if !errors.Is(err, test.wantErr) || got != test.want {
+				t.Errorf("netboxCached() = %q, %v, want %q, %v", got, err, test.want, test.wantErr)
+			}
+
+			if _, ok, _ := cache.Get("key"); ok != test.wantKey {
+				t.Errorf("response cached = %v, want %v", ok, test.wantKey)
+			}
+		})
+	}
+}
+
+func TestNetboxCachedWithoutStore(t *testing.T) {
+	errOutage := errors.New("connection refused")
+
+	got, err := netboxCached(nil, "key", ErrHostNotFound, func() (string, error) {
+		return "", errOutage
+	})
+	if got != "" || !errors.Is(err, errOutage) {
+		t.Errorf("netboxCached() = %q, %v, want the lookup error", got, err)
+	}
+}
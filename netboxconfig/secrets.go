@@ -0,0 +1,50 @@
+package netboxconfig
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrNoSecretReader is returned by ReadSecret when the coordinator has no
+// secret reader
+var ErrNoSecretReader = errors.New("no secret reader configured")
+
+// SecretReader reads the secret at a path in Vault and decodes it into
+// out
+type SecretReader func(ctx context.Context, path string, out any) error
+
+type secretReaderKey struct{}
+
+type secretsReadKey struct{}
+
+// withSecretReader returns a context that plugins can read secrets with.
+// A nil reader leaves the context unchanged.
+func withSecretReader(ctx context.Context, r SecretReader) context.Context {
+	if r == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, secretReaderKey{}, r)
+}
+
+// ReadSecret reads a secret from Vault for a plugin. The context must be
+// the one passed to the plugin by the coordinator. If the coordinator
+// has no secret reader the error is ErrNoSecretReader.
+func ReadSecret(ctx context.Context, path string, out any) error {
+	r, ok := ctx.Value(secretReaderKey{}).(SecretReader)
+	if !ok {
+		return ErrNoSecretReader
+	}
+	if read, ok := ctx.Value(secretsReadKey{}).(*atomic.Bool); ok {
+		read.Store(true)
+	}
+	return r(ctx, path, out)
+}
+
+// trackSecretReads returns a context that records whether any plugin
+// read a secret with it. Overlays containing secrets are not cached
+// because a change to a secret in Vault would not change the cache key.
+func trackSecretReads(ctx context.Context) (context.Context, *atomic.Bool) {
+	read := &atomic.Bool{}
+	return context.WithValue(ctx, secretsReadKey{}, read), read
+}
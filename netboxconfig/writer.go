@@ -0,0 +1,74 @@
+package netboxconfig
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// NetboxWriter makes changes to Netbox through the REST API. The Netbox
+// client only supports read requests so writes are made directly with
+// the same host and API key.
+type NetboxWriter struct {
+	Host   string
+	Key    string
+	Client *http.Client
+}
+
+func (w *NetboxWriter) do(ctx context.Context, method, path string, body any) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimSuffix(w.Host, "/") + path
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Token %s", w.Key))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := io.ReadAll(&io.LimitedReader{R: res.Body, N: 1024})
+		return fmt.Errorf("Invalid status code from Netbox %d: %s", res.StatusCode, msg)
+	}
+
+	return nil
+}
+
+// UpdateDeviceCustomFields sets custom fields on a device. Fields that
+// are not passed are left unchanged.
+func (w *NetboxWriter) UpdateDeviceCustomFields(ctx context.Context, deviceId string, fields map[string]any) error {
+	return w.do(ctx, http.MethodPatch, fmt.Sprintf("/api/dcim/devices/%s/", deviceId), map[string]any{
+		"custom_fields": fields,
+	})
+}
+
+// AddDeviceJournalEntry adds a journal entry to a device. Kind must be
+// one of the Netbox journal entry kinds (info, success, warning or
+// danger).
+func (w *NetboxWriter) AddDeviceJournalEntry(ctx context.Context, deviceId, kind, comments string) error {
+	return w.do(ctx, http.MethodPost, "/api/extras/journal-entries/", map[string]any{
+		"assigned_object_type": "dcim.device",
+		"assigned_object_id":   deviceId,
+		"kind":                 kind,
+		"comments":             comments,
+	})
+}
@@ -0,0 +1,50 @@
+#
+# Generated by the netboot server{{ with .Host.Mac }} for {{ . }}{{ end }}
+#
+menu title Boot Menu
+timeout 100
+{{- with .NextBoot }}
+
+#
+# One-time boot override, booted without prompting
+#
+prompt 0
+default next-boot
+
+label next-boot
+	menu label {{ .Title }} [one-time boot]
+	kernel {{ .Kernel }}
+	initrd {{ .Initrds }}
+	{{- with .Fdt }}
+	fdt {{ . }}
+	{{- end }}
+	{{- with .FdtDir }}
+	fdtdir {{ . }}
+	{{- end }}
+	append {{ .Args }}
+	ipappend 2
+{{- else }}
+prompt 1
+{{- with .Default }}
+default {{ . }}
+{{- end }}
+{{- end }}
+
+#
+# Distributions
+#
+{{- range .Distros }}
+
+label {{ .Label }}
+	menu label {{ .Title }}
+	kernel {{ .Kernel }}
+	initrd {{ .Initrds }}
+	{{- with .Fdt }}
+	fdt {{ . }}
+	{{- end }}
+	{{- with .FdtDir }}
+	fdtdir {{ . }}
+	{{- end }}
+	append {{ .Args }}
+	ipappend 2
+{{- end }}
@@ -0,0 +1,283 @@
+package remotefs
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var (
+	diskCacheHitMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_distro_cache_hits",
+		Help: "Distribution file requests served from the disk cache",
+	})
+	diskCacheMissMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_distro_cache_misses",
+		Help: "Distribution file requests proxied from the remote tree",
+	})
+	diskCacheEvictionMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_distro_cache_evictions",
+		Help: "Files evicted from the distribution disk cache",
+	})
+	diskCacheFillFailureMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_distro_cache_fill_failures",
+		Help: "Failures copying a remote file into the distribution disk cache",
+	})
+	diskCacheBytesMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "netboot_distro_cache_bytes",
+		Help: "Size of the files held in the distribution disk cache",
+	})
+)
+
+const diskCacheTempPrefix = ".fill-"
+
+type diskCacheEntry struct {
+	key  string
+	size int64
+}
+
+// DiskCache is a read-through cache of files on local disk, limited in
+// size by evicting the least recently used files. Files are keyed by
+// their path, size and modification time so a changed file is fetched
+// again and the stale copy ages out.
+//
+// A request that misses the cache is served directly from the wrapped
+// file system, including any range requested, while the whole file is
+// copied into the cache in the background. Files larger than the cache
+// are never cached. A nil DiskCache does no caching.
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+	logger   *zap.Logger
+	entries  map[string]*list.Element
+	lru      *list.List
+	size     int64
+	inflight map[string]bool
+	sync.Mutex
+}
+
+// NewDiskCache opens a cache in dir, creating it if needed. Files left
+// from a previous run are kept with their access order restored from
+// their modification times.
+func NewDiskCache(dir string, maxBytes int64, logger *zap.Logger) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type existing struct {
+		key  string
+		size int64
+		used time.Time
+	}
+	found := []existing{}
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(f.Name(), diskCacheTempPrefix) {
+			os.Remove(filepath.Join(dir, f.Name())) // Interrupted fill
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		found = append(found, existing{f.Name(), info.Size(), info.ModTime()})
+	}
+
+	slices.SortFunc(found, func(a, b existing) int { return a.used.Compare(b.used) })
+
+	c := &DiskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		logger:   logger,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+		inflight: map[string]bool{},
+	}
+
+	c.Lock()
+	for _, e := range found {
+		c.entries[e.key] = c.lru.PushFront(&diskCacheEntry{e.key, e.size})
+		c.size += e.size
+	}
+	c.evict()
+	c.Unlock()
+
+	return c, nil
+}
+
+// Wrap returns a file system that serves files from fsys through the
+// cache
+func (c *DiskCache) Wrap(fsys fs.FS) fs.FS {
+	if c == nil {
+		return fsys
+	}
+	return &cachedFS{fsys, c}
+}
+
+func cacheKey(name string, info fs.FileInfo) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d", name, info.Size(), info.ModTime().UnixNano())))
+	return hex.EncodeToString(sum[:])
+}
+
+// open returns the cached copy of a file and marks it as recently used
+func (c *DiskCache) open(key string) (*os.File, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	p := filepath.Join(c.dir, key)
+	fd, err := os.Open(p)
+	if err != nil {
+		c.remove(el)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+	now := time.Now()
+	os.Chtimes(p, now, now)
+
+	return fd, true
+}
+
+// fill copies a file into the cache in the background unless it is
+// already being copied or would not fit
+func (c *DiskCache) fill(fsys fs.FS, name, key string, size int64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.inflight[key] || size > c.maxBytes {
+		return
+	}
+	c.inflight[key] = true
+
+	go func() {
+		err := c.copyIn(fsys, name, key, size)
+
+		c.Lock()
+		delete(c.inflight, key)
+		if err == nil {
+			c.entries[key] = c.lru.PushFront(&diskCacheEntry{key, size})
+			c.size += size
+			c.evict()
+		}
+		c.Unlock()
+
+		if err != nil {
+			diskCacheFillFailureMetric.Inc()
+			c.logger.Warn("Error filling distribution cache", zap.String("path", name), zap.Error(err))
+		}
+	}()
+}
+
+func (c *DiskCache) copyIn(fsys fs.FS, name, key string, size int64) error {
+	src, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(c.dir, diskCacheTempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op after the rename
+
+	n, err := io.Copy(tmp, src)
+	if err == nil && n != size {
+		err = fmt.Errorf("copied %d bytes, expected %d", n, size)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(c.dir, key))
+}
+
+// evict removes least recently used files until the cache fits in its
+// size limit. Files that are open continue to be readable until closed.
+// Must be called with the lock held.
+func (c *DiskCache) evict() {
+	for c.size > c.maxBytes && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+		diskCacheEvictionMetric.Inc()
+	}
+	diskCacheBytesMetric.Set(float64(c.size))
+}
+
+// remove drops an entry and its file. Must be called with the lock held.
+func (c *DiskCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*diskCacheEntry)
+	delete(c.entries, e.key)
+	c.size -= e.size
+	os.Remove(filepath.Join(c.dir, e.key))
+}
+
+// cachedFS serves regular files from the cache and everything else from
+// the wrapped file system
+type cachedFS struct {
+	fs.FS
+	cache *DiskCache
+}
+
+func (f *cachedFS) Open(name string) (fs.File, error) {
+	fd, err := f.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := fd.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return fd, err
+	}
+
+	key := cacheKey(name, info)
+	if cached, ok := f.cache.open(key); ok {
+		fd.Close()
+		diskCacheHitMetric.Inc()
+		return &cachedFile{cached, info}, nil
+	}
+
+	diskCacheMissMetric.Inc()
+	f.cache.fill(f.FS, name, key, info.Size())
+	return fd, nil
+}
+
+// cachedFile is a cached copy of a file that reports the info of the
+// original so that names and modification times are unchanged
+type cachedFile struct {
+	*os.File
+	info fs.FileInfo
+}
+
+func (f *cachedFile) Stat() (fs.FileInfo, error) { return f.info, nil }
@@ -0,0 +1,228 @@
+package remotefs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// maxIndexSize limits the size of directory listings that are parsed
+const maxIndexSize = 8 << 20
+
+var hrefRegexp = regexp.MustCompile(`(?i)<a\s[^>]*href\s*=\s*["']([^"']+)["']`)
+
+// HttpFS is a file system for a tree on an HTTP server that produces
+// HTML directory listings, such as nginx with autoindex or Apache with
+// mod_autoindex. Listings are parsed for relative links to files and
+// subdirectories, subdirectories being links that end in a slash. The
+// server must support range requests for ISO images to be usable.
+type HttpFS struct {
+	Base   *url.URL // Must end in a slash
+	Client *http.Client
+}
+
+var (
+	_ fs.ReadDirFS = (*HttpFS)(nil)
+	_ fs.StatFS    = (*HttpFS)(nil)
+	_ Redirector   = (*HttpFS)(nil)
+)
+
+func (h *HttpFS) client() *http.Client {
+	if h.Client == nil {
+		return DefaultClient
+	}
+	return h.Client
+}
+
+func (h *HttpFS) url(name string, dir bool) string {
+	if name == "." {
+		return h.Base.String()
+	}
+
+	p := name
+	if dir {
+		p += "/"
+	}
+	return h.Base.ResolveReference(&url.URL{Path: p}).String()
+}
+
+// head returns the info for a file or directory. Servers redirect
+// requests for directories without a trailing slash so a response from
+// a URL ending in a slash is a directory.
+func (h *HttpFS) head(name string, dir bool) (*fileInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, h.url(name, dir), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := do(h.client(), req, "http")
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, statusError(res)
+	}
+
+	if dir || strings.HasSuffix(res.Request.URL.Path, "/") {
+		return dirInfo(name), nil
+	}
+
+	if res.ContentLength < 0 {
+		return nil, errors.New("server did not return a content length")
+	}
+
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return &fileInfo{
+		name:    path.Base(name),
+		size:    res.ContentLength,
+		modTime: modTime,
+	}, nil
+}
+
+func (h *HttpFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name == "." {
+		return dirInfo(name), nil
+	}
+
+	info, err := h.head(name, false)
+	if errors.Is(err, fs.ErrNotExist) {
+		info, err = h.head(name, true)
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return info, nil
+}
+
+func (h *HttpFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url(name, true), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := do(h.client(), req, "http")
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: statusError(res)}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxIndexSize))
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	seen := map[string]bool{}
+	entries := []fs.DirEntry{}
+
+	for _, m := range hrefRegexp.FindAllSubmatch(body, -1) {
+		ref, err := url.Parse(string(m[1]))
+		if err != nil || ref.IsAbs() || ref.Host != "" || ref.RawQuery != "" || ref.Path == "" {
+			continue // Sorting links, parent and absolute links
+		}
+
+		child, isDir := strings.CutSuffix(ref.Path, "/")
+		if child == "" || child == "." || child == ".." || strings.Contains(child, "/") || seen[child] {
+			continue
+		}
+		seen[child] = true
+
+		if isDir {
+			entries = append(entries, fs.FileInfoToDirEntry(dirInfo(child)))
+		} else {
+			entries = append(entries, &lazyEntry{fs: h, path: path.Join(name, child), name: child})
+		}
+	}
+
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+func (h *HttpFS) Open(name string) (fs.File, error) {
+	info, err := h.Stat(name)
+	if err != nil {
+		var pe *fs.PathError
+		if errors.As(err, &pe) {
+			pe.Op = "open"
+		}
+		return nil, err
+	}
+
+	if info.IsDir() {
+		entries, err := h.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &dirFile{path: name, entries: entries}, nil
+	}
+
+	u := h.url(name, false)
+	return &file{
+		path: name,
+		info: info.(*fileInfo),
+		fetch: func(off, length int64) (io.ReadCloser, error) {
+			return rangeRequest(h.client(), func(ctx context.Context) (*http.Request, error) {
+				return http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+			}, "http", off, length)
+		},
+	}, nil
+}
+
+// URL returns the URL of a file on the server
+func (h *HttpFS) URL(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "url", Path: name, Err: fs.ErrInvalid}
+	}
+	return h.url(name, false), nil
+}
+
+// lazyEntry is a file in a directory listing. Listings do not have a
+// parsable size or modification time so those are only fetched if they
+// are requested.
+type lazyEntry struct {
+	fs   *HttpFS
+	path string
+	name string
+
+	once sync.Once
+	info fs.FileInfo
+	err  error
+}
+
+func (e *lazyEntry) Name() string      { return e.name }
+func (e *lazyEntry) IsDir() bool       { return false }
+func (e *lazyEntry) Type() fs.FileMode { return 0 }
+
+func (e *lazyEntry) Info() (fs.FileInfo, error) {
+	e.once.Do(func() {
+		e.info, e.err = e.fs.Stat(e.path)
+	})
+	return e.info, e.err
+}
@@ -0,0 +1,377 @@
+// Package remotefs provides read-only file systems for distribution
+// trees that are stored in an S3 compatible bucket or on an HTTP server
+// with directory listings, and a disk cache for serving files from them.
+package remotefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	remoteRequestMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "netboot_remote_requests",
+		Help: "Requests made to remote distribution trees",
+	}, []string{"backend", "method"})
+	remoteFailureMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "netboot_remote_request_failures",
+		Help: "Failed requests to remote distribution trees, excluding not found",
+	}, []string{"backend"})
+)
+
+// requestTimeout limits requests for metadata, listings and the blocks
+// read by ReadAt, and how long any request waits for response headers.
+// Streamed file bodies can be large so they have no overall deadline.
+const requestTimeout = 30 * time.Second
+
+// DefaultClient is used by remote file systems without a Client. Unlike
+// http.DefaultClient it gives up on servers that accept a connection but
+// never respond.
+var DefaultClient = &http.Client{Transport: defaultTransport()}
+
+func defaultTransport() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ResponseHeaderTimeout = requestTimeout
+	return t
+}
+
+// readAheadSize is the minimum amount of data fetched by ReadAt. Callers
+// such as the ISO reader make many small reads of adjacent sectors which
+// would otherwise each be a request.
+const readAheadSize = 64 << 10
+
+// Redirector is implemented by remote file systems that can give clients
+// a URL from which to download a file directly
+type Redirector interface {
+	URL(name string) (string, error)
+}
+
+// IsRemote returns true if the location of a distribution tree is a
+// remote URL rather than a local path
+func IsRemote(location string) bool {
+	u, err := url.Parse(location)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "s3", "http", "https":
+		return true
+	}
+	return false
+}
+
+// Open returns the file system for the location of a distribution tree
+// which is one of:
+//
+//	s3://bucket/prefix?endpoint=https://minio.example.com&region=us-east-1
+//	https://mirror.example.com/netboot/
+//	/path/to/netboot
+//
+// S3 credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and AWS_SESSION_TOKEN. If they are not set requests are anonymous.
+func Open(location string) (fs.FS, error) {
+	if !IsRemote(location) {
+		return os.DirFS(location), nil
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "s3" {
+		return newS3FS(u)
+	}
+
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return &HttpFS{Base: u}, nil
+}
+
+// fetchFunc returns the body of a file starting at off. If length is
+// negative the body continues to the end of the file.
+type fetchFunc func(off, length int64) (io.ReadCloser, error)
+
+// cancelBody cancels the context of a request when its body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// rangeRequest performs a request for part of a file with a request
+// created by newRequest. Requests for a length are limited to
+// requestTimeout, requests for the rest of the file last until the body
+// is closed. Servers that ignore the Range header are only accepted
+// when the request is for the start of the file.
+func rangeRequest(client *http.Client, newRequest func(context.Context) (*http.Request, error), backend string, off, length int64) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if length >= 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), requestTimeout)
+	}
+
+	req, err := newRequest(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	body, err := doRange(client, req, backend, off, length)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &cancelBody{body, cancel}, nil
+}
+
+func doRange(client *http.Client, req *http.Request, backend string, off, length int64) (io.ReadCloser, error) {
+	if length < 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+	}
+
+	res, err := do(client, req, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case res.StatusCode == http.StatusPartialContent:
+		return res.Body, nil
+	case res.StatusCode == http.StatusOK && off == 0:
+		if length < 0 {
+			return res.Body, nil
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(res.Body, length), res.Body}, nil
+	case res.StatusCode == http.StatusOK:
+		res.Body.Close()
+		return nil, errors.New("server does not support range requests")
+	default:
+		res.Body.Close()
+		return nil, statusError(res)
+	}
+}
+
+// do performs a request and records metrics. Only transport errors are
+// returned, callers must check the status.
+func do(client *http.Client, req *http.Request, backend string) (*http.Response, error) {
+	remoteRequestMetric.WithLabelValues(backend, req.Method).Inc()
+
+	res, err := client.Do(req)
+	if err != nil {
+		remoteFailureMetric.WithLabelValues(backend).Inc()
+		return nil, err
+	}
+
+	if res.StatusCode >= 400 && res.StatusCode != http.StatusNotFound {
+		remoteFailureMetric.WithLabelValues(backend).Inc()
+	}
+
+	return res, nil
+}
+
+func statusError(res *http.Response) error {
+	if res.StatusCode == http.StatusNotFound {
+		return fs.ErrNotExist
+	}
+	return fmt.Errorf("unexpected response from %s: %s", res.Request.URL.Redacted(), res.Status)
+}
+
+// fileInfo describes a remote file or directory
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) ModTime() time.Time { return i.modTime }
+func (i *fileInfo) IsDir() bool        { return i.dir }
+func (i *fileInfo) Sys() any           { return nil }
+
+func (i *fileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func dirInfo(name string) *fileInfo {
+	return &fileInfo{name: path.Base(name), dir: true}
+}
+
+// file is an open remote file. Reads are streamed from a single request
+// which is replaced when the file is seeked. ReadAt makes independent
+// requests and keeps the last block so that small adjacent reads are
+// cheap. ReadAt is safe for concurrent use, as ISO images are shared by
+// every request for a file within them.
+type file struct {
+	path   string
+	info   *fileInfo
+	fetch  fetchFunc
+	offset int64
+
+	body    io.ReadCloser
+	bodyOff int64
+
+	block    []byte
+	blockOff int64
+	blockMu  sync.Mutex
+}
+
+var (
+	_ io.ReaderAt = (*file)(nil)
+	_ io.Seeker   = (*file)(nil)
+)
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *file) Read(p []byte) (int, error) {
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+
+	if f.body == nil || f.bodyOff != f.offset {
+		f.closeBody()
+		body, err := f.fetch(f.offset, -1)
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.path, Err: err}
+		}
+		f.body, f.bodyOff = body, f.offset
+	}
+
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	f.bodyOff += int64(n)
+
+	if err == io.EOF {
+		f.closeBody()
+		if f.offset < f.info.size {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &fs.PathError{Op: "readat", Path: f.path, Err: fs.ErrInvalid}
+	}
+	if off >= f.info.size {
+		return 0, io.EOF
+	}
+
+	f.blockMu.Lock()
+	defer f.blockMu.Unlock()
+
+	want := min(int64(len(p)), f.info.size-off)
+	if off < f.blockOff || off+want > f.blockOff+int64(len(f.block)) {
+		length := min(max(want, readAheadSize), f.info.size-off)
+		body, err := f.fetch(off, length)
+		if err != nil {
+			return 0, &fs.PathError{Op: "readat", Path: f.path, Err: err}
+		}
+		defer body.Close()
+
+		block := make([]byte, length)
+		if _, err := io.ReadFull(body, block); err != nil {
+			return 0, &fs.PathError{Op: "readat", Path: f.path, Err: err}
+		}
+		f.block, f.blockOff = block, off
+	}
+
+	n := copy(p, f.block[off-f.blockOff:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.path, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.path, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *file) closeBody() {
+	if f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+}
+
+func (f *file) Close() error {
+	f.closeBody()
+
+	f.blockMu.Lock()
+	f.block = nil
+	f.blockMu.Unlock()
+
+	return nil
+}
+
+// dirFile is an open remote directory with its listing
+type dirFile struct {
+	path    string
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return dirInfo(d.path), nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.path, Err: errors.New("is a directory")}
+}
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(rest))
+	d.offset += n
+	return rest[:n], nil
+}
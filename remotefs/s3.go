@@ -0,0 +1,319 @@
+package remotefs
+
+import (
+	"cmp"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultPresignExpiry is how long redirect URLs for S3 objects are
+// valid. It must be long enough for a client to download the largest
+// image after it has been redirected.
+const DefaultPresignExpiry = time.Hour
+
+// S3FS is a file system for a prefix within an S3 compatible bucket.
+// Directories are common prefixes of the object keys so empty
+// directories do not exist. Requests use path style addressing which
+// is supported by AWS and every S3 compatible server.
+type S3FS struct {
+	Endpoint     *url.URL
+	Bucket       string
+	Prefix       string
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Client       *http.Client
+	// PresignExpiry is the lifetime of URLs returned by URL, defaults to
+	// DefaultPresignExpiry
+	PresignExpiry time.Duration
+}
+
+var (
+	_ fs.ReadDirFS = (*S3FS)(nil)
+	_ fs.StatFS    = (*S3FS)(nil)
+	_ Redirector   = (*S3FS)(nil)
+)
+
+func newS3FS(u *url.URL) (*S3FS, error) {
+	if u.Host == "" {
+		return nil, errors.New("s3 location requires a bucket name")
+	}
+
+	q := u.Query()
+	region := cmp.Or(q.Get("region"), os.Getenv("AWS_REGION"), "us-east-1")
+
+	endpoint, err := url.Parse(cmp.Or(q.Get("endpoint"), "https://s3."+region+".amazonaws.com"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3FS{
+		Endpoint:     endpoint,
+		Bucket:       u.Host,
+		Prefix:       strings.Trim(u.Path, "/"),
+		Region:       region,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}, nil
+}
+
+func (s *S3FS) client() *http.Client {
+	if s.Client == nil {
+		return DefaultClient
+	}
+	return s.Client
+}
+
+// key returns the object key for a name in the file system
+func (s *S3FS) key(name string) string {
+	if name == "." {
+		return s.Prefix
+	}
+	return strings.TrimPrefix(path.Join(s.Prefix, name), "/")
+}
+
+func (s *S3FS) url(key string, query url.Values) *url.URL {
+	u := *s.Endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = awsEscape(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+func (s *S3FS) request(ctx context.Context, method, key string, query url.Values) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.url(key, query).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.AccessKey != "" {
+		s.sign(req, time.Now())
+	}
+	return req, nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list returns the entries directly beneath a prefix, following
+// continuation tokens until the listing is complete. If limit is
+// positive at most one page is fetched.
+func (s *S3FS) list(prefix string, limit int) ([]fs.DirEntry, error) {
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	entries := []fs.DirEntry{}
+	token := ""
+
+	for {
+		q := url.Values{
+			"list-type": {"2"},
+			"delimiter": {"/"},
+			"prefix":    {prefix},
+		}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		if limit > 0 {
+			q.Set("max-keys", "1")
+		}
+
+		out, err := s.listPage(q)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range out.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/")
+			if name != "" {
+				entries = append(entries, fs.FileInfoToDirEntry(dirInfo(name)))
+			}
+		}
+		for _, c := range out.Contents {
+			name := strings.TrimPrefix(c.Key, prefix)
+			if name == "" || strings.Contains(name, "/") {
+				continue // Directory marker objects
+			}
+			entries = append(entries, fs.FileInfoToDirEntry(&fileInfo{
+				name:    name,
+				size:    c.Size,
+				modTime: c.LastModified,
+			}))
+		}
+
+		if !out.IsTruncated || out.NextContinuationToken == "" || limit > 0 {
+			break
+		}
+		token = out.NextContinuationToken
+	}
+
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+// listPage fetches a single page of a listing
+func (s *S3FS) listPage(q url.Values) (*listBucketResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	req, err := s.request(ctx, http.MethodGet, "", q)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := do(s.client(), req, "s3")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, statusError(res)
+	}
+
+	out := &listBucketResult{}
+	if err := xml.NewDecoder(res.Body).Decode(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// head returns the info for an object, or fs.ErrNotExist
+func (s *S3FS) head(name string) (*fileInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	req, err := s.request(ctx, http.MethodHead, s.key(name), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := do(s.client(), req, "s3")
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, statusError(res)
+	}
+
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return &fileInfo{
+		name:    path.Base(name),
+		size:    res.ContentLength,
+		modTime: modTime,
+	}, nil
+}
+
+func (s *S3FS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name == "." {
+		return dirInfo(name), nil
+	}
+
+	info, err := s.head(name)
+	if err == nil {
+		return info, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	// Not an object so it could be a prefix
+	entries, err := s.list(s.key(name), 1)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if len(entries) == 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return dirInfo(name), nil
+}
+
+func (s *S3FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	entries, err := s.list(s.key(name), 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if len(entries) == 0 && name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return entries, nil
+}
+
+func (s *S3FS) Open(name string) (fs.File, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		var pe *fs.PathError
+		if errors.As(err, &pe) {
+			pe.Op = "open"
+		}
+		return nil, err
+	}
+
+	if info.IsDir() {
+		entries, err := s.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &dirFile{path: name, entries: entries}, nil
+	}
+
+	key := s.key(name)
+	return &file{
+		path: name,
+		info: info.(*fileInfo),
+		fetch: func(off, length int64) (io.ReadCloser, error) {
+			return rangeRequest(s.client(), func(ctx context.Context) (*http.Request, error) {
+				return s.request(ctx, http.MethodGet, key, nil)
+			}, "s3", off, length)
+		},
+	}, nil
+}
+
+// URL returns a presigned URL for an object, or the plain object URL if
+// no credentials are configured
+func (s *S3FS) URL(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "url", Path: name, Err: fs.ErrInvalid}
+	}
+
+	u := s.url(s.key(name), nil)
+	if s.AccessKey != "" {
+		s.presign(u, time.Now(), cmp.Or(s.PresignExpiry, DefaultPresignExpiry))
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// The buckets used by the server and their retention policies
+var (
+	BootHistory = BucketSpec{Name: "boot_history", Retention: 30 * 24 * time.Hour}
+	Overrides   = BucketSpec{Name: "overrides"}
+	Tokens      = BucketSpec{Name: "tokens"}
+	NetboxCache = BucketSpec{Name: "netbox_cache", Retention: 24 * time.Hour}
+)
+
+// Buckets are all of the buckets used by the server, for passing to Open
+var Buckets = []BucketSpec{BootHistory, Overrides, Tokens, NetboxCache}
+
+// Token is a token registered by a host. Only the hash of the token is
+// stored.
+type Token struct {
+	Name     string    `json:"name"`
+	Hash     string    `json:"hash"`
+	ClientIP string    `json:"client_ip"`
+	Created  time.Time `json:"created"`
+}
+
+// HashToken returns the hash under which a token secret is stored
+func HashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// CachedResponse is a cached Netbox API response body
+type CachedResponse struct {
+	Fetched time.Time       `json:"fetched"`
+	Body    json.RawMessage `json:"body"`
+}
+
+// Item is a record returned from a bucket scan
+type Item[T any] struct {
+	Key     string
+	Value   T
+	Written time.Time
+}
+
+// Bucket is a typed view of a bucket in a store. Values are stored as
+// JSON. A nil Bucket is valid, writes are discarded and reads return no
+// data, which allows callers to run without a store.
+type Bucket[T any] struct {
+	store *Store
+	name  string
+}
+
+// Typed returns a typed view of a bucket, or nil if the store is nil
+func Typed[T any](s *Store, spec BucketSpec) *Bucket[T] {
+	if s == nil {
+		return nil
+	}
+	return &Bucket[T]{s, spec.Name}
+}
+
+func (b *Bucket[T]) Get(key string) (value T, ok bool, err error) {
+	if b == nil {
+		return value, false, nil
+	}
+
+	raw, ok := b.store.get(b.name, key)
+	if !ok {
+		return value, false, nil
+	}
+
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return value, false, err
+	}
+	return value, true, nil
+}
+
+func (b *Bucket[T]) Put(key string, value T) error {
+	if b == nil {
+		return nil
+	}
+
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return b.store.put(b.name, key, raw)
+}
+
+func (b *Bucket[T]) Delete(key string) error {
+	if b == nil {
+		return nil
+	}
+	return b.store.delete(b.name, key)
+}
+
+// Scan returns all records with keys starting with prefix, sorted by
+// key. An empty prefix returns the whole bucket. Records that can not
+// be decoded are skipped and the last decode error is returned with the
+// records that could be decoded.
+func (b *Bucket[T]) Scan(prefix string) (out []Item[T], err error) {
+	if b == nil {
+		return nil, nil
+	}
+
+	for _, r := range b.store.scan(b.name, prefix) {
+		var value T
+		if uerr := json.Unmarshal(r.value, &value); uerr != nil {
+			err = uerr
+			continue
+		}
+		out = append(out, Item[T]{r.key, value, r.time})
+	}
+	return out, err
+}
@@ -0,0 +1,473 @@
+// Package store is a small embedded store for runtime state that should
+// survive restarts, such as boot history and next boot overrides.
+//
+// The store is a single append-only file of JSON lines. The first line
+// is a header containing the schema version and each following line is
+// a put or delete of a key in a bucket. The whole store is held in
+// memory and the file is only read when the store is opened. The file is
+// periodically compacted by rewriting it with only the live records,
+// which is also when bucket retention policies are applied.
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var (
+	storeCompactionMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_store_compactions",
+		Help: "Number of state store compactions",
+	})
+	storeWriteFailureMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_store_write_failures",
+		Help: "Failures writing to the state store",
+	})
+	storeRecordsMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "netboot_store_records",
+		Help: "Number of live records in the state store",
+	}, []string{"bucket"})
+)
+
+const (
+	// SchemaVersion is the version of the store format written by this
+	// code. Stores written by older versions are migrated when opened,
+	// stores written by newer versions are refused.
+	SchemaVersion = 1
+
+	FileName = "netboot.db"
+
+	// Compaction is triggered after a write once the log holds at least
+	// compactMinEntries and more than compactRatio times the number of
+	// live records
+	compactMinEntries = 1000
+	compactRatio      = 2
+)
+
+// migrations upgrade the records of a store from schema version n to
+// version n+1, indexed by n
+var migrations = map[int]func(buckets map[string]map[string]record) error{}
+
+type header struct {
+	Schema  int       `json:"schema"`
+	Created time.Time `json:"created"`
+}
+
+type entry struct {
+	Op     string          `json:"op"`
+	Bucket string          `json:"bucket"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value,omitempty"`
+	Time   time.Time       `json:"time"`
+}
+
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+type record struct {
+	value json.RawMessage
+	time  time.Time
+}
+
+// BucketSpec names a bucket and its retention policy. Records that have
+// not been written for longer than Retention are removed during
+// compaction, a zero Retention keeps records until they are deleted.
+type BucketSpec struct {
+	Name      string
+	Retention time.Duration
+}
+
+// Store is an open state store. A nil Store is valid, it stores nothing
+// and all reads return no data.
+type Store struct {
+	Logger     *zap.Logger
+	path       string
+	fd         *os.File
+	created    time.Time
+	buckets    map[string]map[string]record
+	retention  map[string]time.Duration
+	logEntries int
+	sync.Mutex
+}
+
+// Open opens or creates the store in dir. The specs set the retention
+// policies for buckets, buckets without a spec are kept forever.
+// Records in buckets unknown to this version of the code are preserved.
+func Open(dir string, logger *zap.Logger, specs ...BucketSpec) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		Logger:    logger,
+		path:      filepath.Join(dir, FileName),
+		created:   time.Now().UTC(),
+		buckets:   map[string]map[string]record{},
+		retention: map[string]time.Duration{},
+	}
+	for _, spec := range specs {
+		s.retention[spec.Name] = spec.Retention
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	// Always compact on open, this writes the current schema version,
+	// applies retention and drops any partial trailing write
+	s.Lock()
+	defer s.Unlock()
+	if err := s.compact(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// load replays the log file into memory and migrates it to the current
+// schema version
+func (s *Store) load() error {
+	fd, err := os.Open(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer fd.Close()
+
+	r := bufio.NewReader(fd)
+
+	line, err := r.ReadBytes('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && len(line) > 0) {
+		if errors.Is(err, io.EOF) {
+			return nil // Empty file, treat as new
+		}
+		return err
+	}
+
+	var h header
+	if err := json.Unmarshal(line, &h); err != nil {
+		return fmt.Errorf("store: invalid header in %s: %w", s.path, err)
+	}
+	if h.Schema > SchemaVersion {
+		return fmt.Errorf("store: %s has schema version %d, newer than supported version %d", s.path, h.Schema, SchemaVersion)
+	}
+	s.created = h.Created
+
+	for lineNo := 2; ; lineNo++ {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			var e entry
+			if jerr := json.Unmarshal(line, &e); jerr != nil {
+				// A partial final line is left by a crash during a write
+				// and is dropped. Anything else is corruption.
+				if errors.Is(err, io.EOF) {
+					s.Logger.Warn("Dropping partial record at end of state store", zap.Int("line", lineNo))
+					break
+				}
+				return fmt.Errorf("store: invalid record on line %d of %s: %w", lineNo, s.path, jerr)
+			}
+			s.apply(e)
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+	}
+
+	for v := h.Schema; v < SchemaVersion; v++ {
+		if migrate, ok := migrations[v]; ok {
+			if err := migrate(s.buckets); err != nil {
+				return fmt.Errorf("store: migrating from schema version %d: %w", v, err)
+			}
+		}
+		s.Logger.Info("Migrated state store schema", zap.Int("from", v), zap.Int("to", v+1))
+	}
+
+	return nil
+}
+
+// apply applies a log entry to the in-memory records
+func (s *Store) apply(e entry) {
+	switch e.Op {
+	case opPut:
+		b, ok := s.buckets[e.Bucket]
+		if !ok {
+			b = map[string]record{}
+			s.buckets[e.Bucket] = b
+		}
+		b[e.Key] = record{e.Value, e.Time}
+	case opDelete:
+		delete(s.buckets[e.Bucket], e.Key)
+	}
+	s.logEntries++
+}
+
+func (s *Store) live() (n int) {
+	for _, b := range s.buckets {
+		n += len(b)
+	}
+	return n
+}
+
+// write appends an entry to the log and applies it. Must be called with
+// the lock held.
+func (s *Store) write(e entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.fd.Write(append(line, '\n')); err != nil {
+		storeWriteFailureMetric.Inc()
+		return fmt.Errorf("store: writing %s: %w", s.path, err)
+	}
+	s.apply(e)
+
+	if s.logEntries >= compactMinEntries && s.logEntries > compactRatio*s.live() {
+		if err := s.compact(e.Time); err != nil {
+			// The write itself succeeded so this is not returned
+			storeWriteFailureMetric.Inc()
+			s.Logger.Error("Error compacting state store", zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// compact applies retention policies then rewrites the log with only
+// the live records. The new log is written to a temporary file and
+// renamed over the old one so a crash leaves one or the other intact.
+// Must be called with the lock held.
+func (s *Store) compact(now time.Time) error {
+	for name, b := range s.buckets {
+		if retention := s.retention[name]; retention > 0 {
+			for k, r := range b {
+				if now.Sub(r.time) > retention {
+					delete(b, k)
+				}
+			}
+		}
+		if len(b) == 0 {
+			delete(s.buckets, name)
+		}
+	}
+
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath) // No-op after a successful rename
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+
+	if err := enc.Encode(header{SchemaVersion, s.created}); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	names := make([]string, 0, len(s.buckets))
+	for name := range s.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	written := 0
+	for _, name := range names {
+		b := s.buckets[name]
+		keys := make([]string, 0, len(b))
+		for k := range b {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			r := b[k]
+			if err := enc.Encode(entry{opPut, name, k, r.value, r.time}); err != nil {
+				tmp.Close()
+				return err
+			}
+			written++
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if s.fd != nil {
+		s.fd.Close()
+		s.fd = nil
+	}
+
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+
+	if dir, err := os.Open(filepath.Dir(s.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	if s.fd, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600); err != nil {
+		return err
+	}
+	s.logEntries = written
+
+	storeRecordsMetric.Reset()
+	for name, b := range s.buckets {
+		storeRecordsMetric.WithLabelValues(name).Set(float64(len(b)))
+	}
+	storeCompactionMetric.Inc()
+
+	return nil
+}
+
+// Compact compacts the store and applies retention policies
+func (s *Store) Compact() error {
+	if s == nil {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.fd == nil {
+		return os.ErrClosed
+	}
+	return s.compact(time.Now())
+}
+
+// ManageAsync periodically compacts the store so that retention
+// policies are applied even when there are few writes
+func (s *Store) ManageAsync(ctx context.Context, wg *sync.WaitGroup) {
+	if s == nil {
+		return
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		t := time.NewTicker(time.Hour)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				s.Logger.Info("Application finished, closing state store")
+				if err := s.Close(); err != nil {
+					s.Logger.Error("Error closing state store", zap.Error(err))
+				}
+				return
+			case <-t.C:
+				s.Logger.Debug("Performing periodic state store compaction")
+				if err := s.Compact(); err != nil {
+					s.Logger.Error("Error compacting state store", zap.Error(err))
+				}
+			}
+		}
+	}()
+}
+
+// Close syncs and closes the store file, further writes will fail
+func (s *Store) Close() error {
+	if s == nil {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.fd == nil {
+		return nil
+	}
+
+	err := s.fd.Sync()
+	if cerr := s.fd.Close(); err == nil {
+		err = cerr
+	}
+	s.fd = nil
+	return err
+}
+
+func (s *Store) get(bucket, key string) (json.RawMessage, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	r, ok := s.buckets[bucket][key]
+	return r.value, ok
+}
+
+func (s *Store) put(bucket, key string, value json.RawMessage) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.fd == nil {
+		return os.ErrClosed
+	}
+	return s.write(entry{opPut, bucket, key, value, time.Now().UTC()})
+}
+
+func (s *Store) delete(bucket, key string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.fd == nil {
+		return os.ErrClosed
+	}
+	if _, ok := s.buckets[bucket][key]; !ok {
+		return nil
+	}
+	return s.write(entry{opDelete, bucket, key, nil, time.Now().UTC()})
+}
+
+// scan returns the records in a bucket with keys starting with prefix,
+// sorted by key
+func (s *Store) scan(bucket, prefix string) []rawItem {
+	s.Lock()
+	defer s.Unlock()
+
+	out := []rawItem{}
+	for k, r := range s.buckets[bucket] {
+		if strings.HasPrefix(k, prefix) {
+			out = append(out, rawItem{k, r})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].key < out[j].key })
+	return out
+}
+
+type rawItem struct {
+	key string
+	record
+}
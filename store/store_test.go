@@ -0,0 +1,231 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var testBucket = BucketSpec{Name: "test"}
+
+func openTestStore(t *testing.T, dir string, specs ...BucketSpec) *Store {
+	t.Helper()
+	s, err := Open(dir, zap.NewNop(), specs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestStoreReopen(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(b *Bucket[string]) error
+		want  map[string]string
+	}{
+		{
+			name: "put",
+			write: func(b *Bucket[string]) error {
+				return b.Put("a", "1")
+			},
+			want: map[string]string{"a": "1"},
+		},
+		{
+			name: "overwrite",
+			write: func(b *Bucket[string]) error {
+				if err := b.Put("a", "1"); err != nil {
+					return err
+				}
+				return b.Put("a", "2")
+			},
+			want: map[string]string{"a": "2"},
+		},
+		{
+			name: "delete",
+			write: func(b *Bucket[string]) error {
+				if err := b.Put("a", "1"); err != nil {
+					return err
+				}
+				if err := b.Put("b", "2"); err != nil {
+					return err
+				}
+				return b.Delete("a")
+			},
+			want: map[string]string{"b": "2"},
+		},
+		{
+			name: "delete missing key",
+			write: func(b *Bucket[string]) error {
+				return b.Delete("a")
+			},
+			want: map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			s := openTestStore(t, dir, testBucket)
+			if err := test.write(Typed[string](s, testBucket)); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			items, err := Typed[string](openTestStore(t, dir, testBucket), testBucket).Scan("")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := map[string]string{}
+			for _, item := range items {
+				got[item.Key] = item.Value
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("reopened store has %v, want %v", got, test.want)
+			}
+			for k, v := range test.want {
+				if got[k] != v {
+					t.Errorf("reopened store has %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreCompaction(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStore(t, dir, testBucket)
+	b := Typed[string](s, testBucket)
+
+	for i := 0; i < compactMinEntries; i++ {
+		if err := b.Put("a", "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s.logEntries >= compactMinEntries {
+		t.Errorf("log has %d entries after %d writes to one key, want compaction", s.logEntries, compactMinEntries)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines > compactMinEntries {
+		t.Errorf("log file has %d lines, want compaction", lines)
+	}
+
+	if v, ok, err := b.Get("a"); !ok || err != nil || v != "value" {
+		t.Errorf("Get() = %q, %v, %v after compaction", v, ok, err)
+	}
+}
+
+func TestStoreRetention(t *testing.T) {
+	expiring := BucketSpec{Name: "expiring", Retention: time.Hour}
+
+	s := openTestStore(t, t.TempDir(), testBucket, expiring)
+	if err := Typed[string](s, expiring).Put("old", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Typed[string](s, expiring).Put("new", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Typed[string](s, testBucket).Put("kept", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Lock()
+	old := s.buckets[expiring.Name]["old"]
+	old.time = time.Now().Add(-2 * time.Hour)
+	s.buckets[expiring.Name]["old"] = old
+	s.Unlock()
+
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		spec BucketSpec
+		key  string
+		want bool
+	}{
+		{expiring, "old", false},
+		{expiring, "new", true},
+		{testBucket, "kept", true},
+	}
+	for _, test := range tests {
+		if _, ok, _ := Typed[string](s, test.spec).Get(test.key); ok != test.want {
+			t.Errorf("%s/%s kept = %v, want %v", test.spec.Name, test.key, ok, test.want)
+		}
+	}
+}
+
+func TestStoreOpen(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:    "partial trailing write",
+			content: `{"schema":1}` + "\n" + `{"op":"put","bucket":"test","key":"a","value":"1"}` + "\n" + `{"op":"put","bu`,
+			want:    map[string]string{"a": "1"},
+		},
+		{
+			name:    "corrupt record",
+			content: `{"schema":1}` + "\n" + `garbage` + "\n" + `{"op":"put","bucket":"test","key":"a","value":"1"}` + "\n",
+			wantErr: true,
+		},
+		{
+			name:    "newer schema",
+			content: `{"schema":99}` + "\n",
+			wantErr: true,
+		},
+		{
+			name:    "empty file",
+			content: "",
+			want:    map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, FileName), []byte(test.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err := Open(dir, zap.NewNop(), testBucket)
+			if test.wantErr {
+				if err == nil {
+					s.Close()
+					t.Fatal("Open() succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			items, _ := Typed[string](s, testBucket).Scan("")
+			if len(items) != len(test.want) {
+				t.Fatalf("store has %v, want %v", items, test.want)
+			}
+			for _, item := range items {
+				if test.want[item.Key] != item.Value {
+					t.Errorf("%s = %q, want %q", item.Key, item.Value, test.want[item.Key])
+				}
+			}
+		})
+	}
+}
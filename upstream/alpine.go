@@ -0,0 +1,79 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Release is a single release from an upstream index
+type Release struct {
+	Version      string
+	Architecture string
+	Flavor       string
+	// URL of the release file and its expected SHA-256 checksum
+	URL    string
+	Sha256 string
+}
+
+// alpineRelease is an entry in Alpine's latest-releases.yaml
+type alpineRelease struct {
+	Branch  string `yaml:"branch"`
+	Arch    string `yaml:"arch"`
+	Version string `yaml:"version"`
+	Flavor  string `yaml:"flavor"`
+	File    string `yaml:"file"`
+	Sha256  string `yaml:"sha256"`
+}
+
+func alpineReleasesUrl(d *Definition, arch string) string {
+	return fmt.Sprintf("%s/%s/releases/%s", d.Mirror, d.Branch, arch)
+}
+
+// fetchAlpineReleases returns the releases in the Alpine release index
+// for an architecture that match the flavors in the definition
+func fetchAlpineReleases(ctx context.Context, client *http.Client, d *Definition, arch string) ([]Release, error) {
+	base := alpineReleasesUrl(d, arch)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/latest-releases.yaml", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream: fetching %s: %s", req.URL, res.Status)
+	}
+
+	var index []alpineRelease
+	if err := yaml.NewDecoder(res.Body).Decode(&index); err != nil {
+		return nil, fmt.Errorf("upstream: parsing %s: %w", req.URL, err)
+	}
+
+	out := []Release{}
+	for _, r := range index {
+		if r.Arch != arch || !slices.Contains(d.Flavors, r.Flavor) {
+			continue
+		}
+		if r.Version == "" || r.File == "" || r.Sha256 == "" {
+			return nil, fmt.Errorf("upstream: incomplete release entry for %s in %s", r.Flavor, req.URL)
+		}
+		out = append(out, Release{
+			Version:      r.Version,
+			Architecture: arch,
+			Flavor:       r.Flavor,
+			URL:          base + "/" + r.File,
+			Sha256:       r.Sha256,
+		})
+	}
+
+	return out, nil
+}
@@ -0,0 +1,81 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	DefinitionFile = "upstream.yaml"
+
+	IndexAlpine = "alpine"
+)
+
+// Definition describes where to find upstream releases for a
+// distribution. It is loaded from upstream.yaml next to distro.yaml.
+type Definition struct {
+	// Mirror is the base URL of the mirror, ex:
+	// https://dl-cdn.alpinelinux.org/alpine
+	Mirror string `yaml:"mirror"`
+	// Index is the format of the release index, only alpine is
+	// currently supported
+	Index string `yaml:"index"`
+	// Branch is the release branch within the mirror
+	Branch        string   `yaml:"branch"`
+	Architectures []string `yaml:"architectures"`
+	Flavors       []string `yaml:"flavors"`
+	// Keyring is a GPG keyring used to verify release signatures,
+	// relative to the distribution directory. Releases are not synced
+	// if it is not set unless signature checks are disabled.
+	Keyring string `yaml:"keyring"`
+}
+
+// LoadDefinition loads the upstream definition for a distribution
+// directory. A nil definition is returned if the distribution has no
+// upstream.yaml.
+func LoadDefinition(distroDir string) (*Definition, error) {
+	fd, err := os.Open(filepath.Join(distroDir, DefinitionFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer fd.Close()
+
+	d := &Definition{
+		Index:  IndexAlpine,
+		Branch: "latest-stable",
+	}
+	if err := yaml.NewDecoder(fd).Decode(d); err != nil {
+		return nil, err
+	}
+
+	if d.Mirror == "" {
+		return nil, fmt.Errorf("upstream: %s has no mirror", distroDir)
+	}
+	d.Mirror = strings.TrimSuffix(d.Mirror, "/")
+
+	if d.Index != IndexAlpine {
+		return nil, fmt.Errorf("upstream: %s has unsupported index format %q", distroDir, d.Index)
+	}
+
+	if len(d.Architectures) == 0 {
+		return nil, fmt.Errorf("upstream: %s has no architectures", distroDir)
+	}
+
+	if len(d.Flavors) == 0 {
+		d.Flavors = []string{"alpine-netboot"}
+	}
+
+	if d.Keyring != "" && !filepath.IsAbs(d.Keyring) {
+		d.Keyring = filepath.Join(distroDir, d.Keyring)
+	}
+
+	return d, nil
+}
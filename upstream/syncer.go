@@ -0,0 +1,350 @@
+// Package upstream syncs distribution releases from upstream mirrors
+// into the distribution catalog directory.
+package upstream
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var (
+	syncReleaseAddedMetric = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netboot_sync_releases_added",
+		Help: "Upstream releases added to the distribution catalog",
+	})
+	syncFailureMetric = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "netboot_sync_failure",
+		Help: "Failures syncing upstream releases",
+	}, []string{"reason"})
+)
+
+// StagingDir is the directory within the catalog root where releases
+// are prepared. It is on the same file system as the catalog so that
+// releases can be moved into place with an atomic rename.
+const StagingDir = ".sync-staging"
+
+// Syncer downloads new upstream releases for every distribution in Root
+// that has an upstream.yaml. Releases are downloaded and verified in a
+// staging directory then renamed to <short_name>/<version>/<arch> so the
+// catalog never sees a partial release.
+type Syncer struct {
+	Root   string
+	Logger *zap.Logger
+	Client *http.Client
+	// Gpgv is the path to the gpgv binary used to verify signatures,
+	// defaults to gpgv in the PATH
+	Gpgv string
+	// InsecureSkipSignature allows releases of distributions without a
+	// keyring to be installed without verifying their signatures
+	InsecureSkipSignature bool
+}
+
+func (s *Syncer) client() *http.Client {
+	if s.Client == nil {
+		return http.DefaultClient
+	}
+	return s.Client
+}
+
+func (s *Syncer) gpgv() string {
+	if s.Gpgv == "" {
+		return "gpgv"
+	}
+	return s.Gpgv
+}
+
+// Sync syncs all distributions, or only the distribution with the short
+// name only if it is not empty. It returns the catalog paths of the
+// releases that were added. Failures for one distribution or release do
+// not stop the others from syncing, all failures are returned joined.
+func (s *Syncer) Sync(ctx context.Context, only string) ([]string, error) {
+	entries, err := os.ReadDir(s.Root)
+	if err != nil {
+		syncFailureMetric.WithLabelValues("root_read_failed").Inc()
+		return nil, err
+	}
+
+	added := []string{}
+	errs := []error{}
+
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if only != "" && e.Name() != only {
+			continue
+		}
+
+		def, err := LoadDefinition(filepath.Join(s.Root, e.Name()))
+		if err != nil {
+			syncFailureMetric.WithLabelValues("definition_invalid").Inc()
+			errs = append(errs, err)
+			continue
+		}
+		if def == nil {
+			continue
+		}
+
+		paths, err := s.syncDistro(ctx, e.Name(), def)
+		added = append(added, paths...)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return added, errors.Join(errs...)
+}
+
+func (s *Syncer) syncDistro(ctx context.Context, shortName string, def *Definition) ([]string, error) {
+	added := []string{}
+	errs := []error{}
+
+	for _, arch := range def.Architectures {
+		releases, err := fetchAlpineReleases(ctx, s.client(), def, arch)
+		if err != nil {
+			syncFailureMetric.WithLabelValues("index_fetch_failed").Inc()
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, r := range releases {
+			target := path.Join(shortName, r.Version, r.Architecture)
+			if _, err := os.Stat(filepath.Join(s.Root, target)); err == nil {
+				s.Logger.Debug("Upstream release already present", zap.String("path", target))
+				continue
+			}
+
+			s.Logger.Info("Syncing upstream release", zap.String("path", target), zap.String("url", r.URL))
+
+			if err := s.syncRelease(ctx, def, r, target); err != nil {
+				errs = append(errs, fmt.Errorf("upstream: syncing %s: %w", target, err))
+				continue
+			}
+
+			syncReleaseAddedMetric.Inc()
+			s.Logger.Info("Added upstream release", zap.String("path", target))
+			added = append(added, target)
+		}
+	}
+
+	return added, errors.Join(errs...)
+}
+
+// syncRelease downloads, verifies and extracts a release into the
+// staging directory then renames it into place
+func (s *Syncer) syncRelease(ctx context.Context, def *Definition, r Release, target string) error {
+	if def.Keyring == "" && !s.InsecureSkipSignature {
+		syncFailureMetric.WithLabelValues("no_keyring").Inc()
+		return fmt.Errorf("no keyring configured to verify %s", r.URL)
+	}
+	if def.Keyring != "" {
+		if _, err := os.Stat(def.Keyring); err != nil {
+			syncFailureMetric.WithLabelValues("no_keyring").Inc()
+			return fmt.Errorf("keyring for %s: %w", r.URL, err)
+		}
+	}
+
+	stagingRoot := filepath.Join(s.Root, StagingDir)
+	if err := os.MkdirAll(stagingRoot, 0755); err != nil {
+		syncFailureMetric.WithLabelValues("staging_failed").Inc()
+		return err
+	}
+
+	staging, err := os.MkdirTemp(stagingRoot, "release-")
+	if err != nil {
+		syncFailureMetric.WithLabelValues("staging_failed").Inc()
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	archive := filepath.Join(staging, path.Base(r.URL))
+	sum, err := s.download(ctx, r.URL, archive)
+	if err != nil {
+		syncFailureMetric.WithLabelValues("download_failed").Inc()
+		return err
+	}
+
+	if !strings.EqualFold(sum, r.Sha256) {
+		syncFailureMetric.WithLabelValues("checksum_mismatch").Inc()
+		return fmt.Errorf("checksum mismatch for %s, expected %s got %s", r.URL, r.Sha256, sum)
+	}
+
+	if def.Keyring != "" {
+		if err := s.verifySignature(ctx, def.Keyring, r.URL, archive); err != nil {
+			syncFailureMetric.WithLabelValues("signature_invalid").Inc()
+			return err
+		}
+	} else {
+		s.Logger.Warn("No keyring configured and signature checks are disabled, not verifying release signature", zap.String("url", r.URL))
+	}
+
+	files := filepath.Join(staging, "files")
+	if err := extractBoot(archive, files); err != nil {
+		syncFailureMetric.WithLabelValues("extract_failed").Inc()
+		return err
+	}
+
+	dest := filepath.Join(s.Root, target)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		syncFailureMetric.WithLabelValues("install_failed").Inc()
+		return err
+	}
+
+	if err := os.Rename(files, dest); err != nil {
+		syncFailureMetric.WithLabelValues("install_failed").Inc()
+		return err
+	}
+
+	return nil
+}
+
+// download fetches a URL to a file and returns its hex SHA-256 checksum
+func (s *Syncer) download(ctx context.Context, url, dest string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := s.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching %s: %s", url, res.Status)
+	}
+
+	fd, err := os.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(fd, h), res.Body); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), fd.Close()
+}
+
+// verifySignature verifies the detached signature published next to a
+// release file, at the same URL with .asc appended, using gpgv
+func (s *Syncer) verifySignature(ctx context.Context, keyring, url, file string) error {
+	sig := file + ".asc"
+	if _, err := s.download(ctx, url+".asc", sig); err != nil {
+		return err
+	}
+
+	out := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, s.gpgv(), "--keyring", keyring, sig, file)
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("signature verification failed for %s: %w: %s", url, err, strings.TrimSpace(out.String()))
+	}
+
+	return nil
+}
+
+// extractBoot extracts the contents of the boot directory of a netboot
+// tarball into dest, which must not exist
+func extractBoot(archive, dest string) error {
+	fd, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	gr, err := gzip.NewReader(fd)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	if err := os.Mkdir(dest, 0755); err != nil {
+		return err
+	}
+
+	count := 0
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name, ok := strings.CutPrefix(path.Clean(strings.TrimPrefix(hdr.Name, "./")), "boot/")
+		if !ok || !filepath.IsLocal(name) {
+			continue
+		}
+		target := filepath.Join(dest, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := writeFile(target, tr); err != nil {
+				return err
+			}
+			count++
+		case tar.TypeSymlink:
+			// Only links that stay within the boot directory
+			if !filepath.IsLocal(filepath.Join(filepath.Dir(name), hdr.Linkname)) {
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+
+	if count == 0 {
+		return fmt.Errorf("no boot files found in %s", filepath.Base(archive))
+	}
+
+	return nil
+}
+
+func writeFile(target string, r io.Reader) error {
+	fd, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	if _, err := io.Copy(fd, r); err != nil {
+		return err
+	}
+	return fd.Close()
+}
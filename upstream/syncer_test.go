@@ -0,0 +1,52 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestSyncReleaseKeyring(t *testing.T) {
+	tests := []struct {
+		name      string
+		keyring   string
+		insecure  bool
+		wantFetch bool
+	}{
+		{name: "no keyring"},
+		{name: "missing keyring", keyring: "missing.gpg"},
+		{name: "missing keyring with signature checks disabled", keyring: "missing.gpg", insecure: true},
+		{name: "no keyring with signature checks disabled", insecure: true, wantFetch: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fetched := false
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetched = true
+				http.NotFound(w, r)
+			}))
+			defer srv.Close()
+
+			root := t.TempDir()
+			def := &Definition{}
+			if test.keyring != "" {
+				def.Keyring = filepath.Join(root, test.keyring)
+			}
+
+			s := &Syncer{Root: root, Logger: zap.NewNop(), InsecureSkipSignature: test.insecure}
+			release := Release{URL: srv.URL + "/release.tar.gz", Version: "1.0", Architecture: "x86_64"}
+			if err := s.syncRelease(context.Background(), def, release, "test/1.0/x86_64"); err == nil {
+				t.Fatal("syncRelease() succeeded")
+			}
+
+			if fetched != test.wantFetch {
+				t.Errorf("release fetched = %v, want %v", fetched, test.wantFetch)
+			}
+		})
+	}
+}